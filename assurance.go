@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// roleAssuranceRule requires JWT logins to the roles matching one of Roles to
+// carry an authenticator assurance level of at least MinAAL, and when MaxAge is
+// set, an authentication method in amr used no longer than MaxAge ago.
+type roleAssuranceRule struct {
+	Roles  []string
+	MinAAL int
+	// zero when the age of the authentication doesn't matter
+	MaxAge time.Duration
+}
+
+func (r roleAssuranceRule) String() string {
+	s := strings.Join(r.Roles, ",") + " aal=" + formatAAL(r.MinAAL)
+	if r.MaxAge > 0 {
+		s += " max_age=" + r.MaxAge.String()
+	}
+	return s
+}
+
+func (r roleAssuranceRule) matches(role string) bool {
+	return matchRole(r.Roles, role)
+}
+
+// amrEntry is an authentication method reference. Supabase Auth issues them
+// as objects with the time the method was used, RFC 8176 as plain strings.
+type amrEntry struct {
+	Method string `json:"method"`
+	// nil when the token doesn't say when the method was used
+	Timestamp *numericDate `json:"timestamp"`
+}
+
+func (e *amrEntry) UnmarshalJSON(b []byte) error {
+	var method string
+	if err := json.Unmarshal(b, &method); err == nil {
+		*e = amrEntry{Method: method}
+		return nil
+	}
+	type plain amrEntry
+	return json.Unmarshal(b, (*plain)(e))
+}
+
+// checkAssurance returns errInsufficientAssurance when the claims of the token
+// don't meet the requirements for role. The first rule matching the role
+// decides, roles no rule matches accept any token.
+func (c *config) checkAssurance(role string, claims *jwtClaims, now time.Time) error {
+	for _, r := range c.RoleAssurance {
+		if !r.matches(role) {
+			continue
+		}
+		aal, err := parseAAL(claims.AAL)
+		if claims.AAL == "" {
+			return fmt.Errorf("%w: role %s requires %s, the token has no aal claim (rule %v)", errInsufficientAssurance, role, formatAAL(r.MinAAL), r)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v (rule %v)", errInsufficientAssurance, err, r)
+		}
+		if aal < r.MinAAL {
+			return fmt.Errorf("%w: role %s requires %s, the token has %s (rule %v)", errInsufficientAssurance, role, formatAAL(r.MinAAL), claims.AAL, r)
+		}
+		if r.MaxAge == 0 {
+			return nil
+		}
+		var latest time.Time
+		for _, e := range claims.AMR {
+			if e.Timestamp != nil && e.Timestamp.Time().After(latest) {
+				latest = e.Timestamp.Time()
+			}
+		}
+		if latest.IsZero() {
+			return fmt.Errorf("%w: role %s requires an authentication within %v, the token has no amr timestamps (rule %v)", errInsufficientAssurance, role, r.MaxAge, r)
+		}
+		if age := now.Sub(latest); age > r.MaxAge {
+			return fmt.Errorf("%w: role %s requires an authentication within %v, the last was %v ago (rule %v)", errInsufficientAssurance, role, r.MaxAge, age.Round(time.Second), r)
+		}
+		return nil
+	}
+	return nil
+}
+
+// parseAAL parses an authenticator assurance level, aal1 to aal3
+func parseAAL(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "aal"))
+	if err != nil || !strings.HasPrefix(s, "aal") || n < 1 || n > 3 {
+		return 0, fmt.Errorf("invalid assurance level: %q", s)
+	}
+	return n, nil
+}
+
+func formatAAL(n int) string {
+	return "aal" + strconv.Itoa(n)
+}
+
+// parseRoleAssurance parses the roleAssurance argument, rules are separated by
+// semicolons and give the minimum level for the roles, optionally followed by
+// the maximum age of the authentication, eg.
+//
+//	postgres,supabase_admin=aal2:15m;reader_*=aal1
+func parseRoleAssurance(arg string) ([]roleAssuranceRule, error) {
+	var rules []roleAssuranceRule
+	for _, s := range strings.Split(arg, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		roles, requirement, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed roleAssurance rule: %v", s)
+		}
+		aal, maxAge, _ := strings.Cut(strings.TrimSpace(requirement), ":")
+		rule, err := newRoleAssuranceRule(splitList(roles), aal, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newRoleAssuranceRule(roles []string, aal, maxAge string) (roleAssuranceRule, error) {
+	if len(roles) == 0 {
+		return roleAssuranceRule{}, fmt.Errorf("roleAssurance rule without roles")
+	}
+	if _, err := parseRolePatterns(roles); err != nil {
+		return roleAssuranceRule{}, err
+	}
+	rule := roleAssuranceRule{Roles: roles, MinAAL: 1}
+	if aal != "" {
+		var err error
+		if rule.MinAAL, err = parseAAL(aal); err != nil {
+			return roleAssuranceRule{}, err
+		}
+	}
+	if maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			return roleAssuranceRule{}, fmt.Errorf("invalid max age: %q", maxAge)
+		}
+		rule.MaxAge = d
+	}
+	return rule, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_checkAssurance(t *testing.T) {
+	c, err := configFromArgs([]string{"roleAssurance=postgres,supabase_admin=aal2:15m;reader_*=aal1;*=aal2"})
+	assert.NoError(t, err)
+	now := time.Now().Truncate(time.Second)
+	stamp := func(ago time.Duration) *numericDate {
+		n := numericDate(now.Add(-ago).Unix())
+		return &n
+	}
+	fresh := &jwtClaims{AAL: "aal2", AMR: []amrEntry{{Method: "password", Timestamp: stamp(time.Hour)}, {Method: "totp", Timestamp: stamp(time.Minute)}}}
+	stale := &jwtClaims{AAL: "aal2", AMR: []amrEntry{{Method: "totp", Timestamp: stamp(time.Hour)}}}
+	aal1 := &jwtClaims{AAL: "aal1", AMR: []amrEntry{{Method: "password", Timestamp: stamp(time.Minute)}}}
+
+	t.Run("accepts tokens meeting the rule", func(t *testing.T) {
+		assert.NoError(t, c.checkAssurance("postgres", fresh, now))
+		assert.NoError(t, c.checkAssurance("reader_app", aal1, now))
+		assert.NoError(t, c.checkAssurance("app_user", stale, now))
+	})
+
+	t.Run("rejects a lower level and names it", func(t *testing.T) {
+		err := c.checkAssurance("supabase_admin", aal1, now)
+		assert.ErrorIs(t, err, errInsufficientAssurance)
+		assert.NotErrorIs(t, err, errPermDenied)
+		assert.ErrorContains(t, err, "role supabase_admin requires aal2, the token has aal1")
+
+		assert.ErrorContains(t, c.checkAssurance("app_user", &jwtClaims{}, now), "the token has no aal claim")
+		assert.ErrorContains(t, c.checkAssurance("app_user", &jwtClaims{AAL: "high"}, now), `invalid assurance level: "high"`)
+	})
+
+	t.Run("rejects a stale authentication", func(t *testing.T) {
+		err := c.checkAssurance("postgres", stale, now)
+		assert.ErrorIs(t, err, errInsufficientAssurance)
+		assert.ErrorContains(t, err, "role postgres requires an authentication within 15m0s, the last was 1h0m0s ago")
+
+		err = c.checkAssurance("postgres", &jwtClaims{AAL: "aal2", AMR: []amrEntry{{Method: "totp"}}}, now)
+		assert.ErrorContains(t, err, "the token has no amr timestamps")
+	})
+
+	t.Run("roles without a rule accept any token", func(t *testing.T) {
+		c, err := configFromArgs([]string{"roleAssurance=postgres=aal2"})
+		assert.NoError(t, err)
+		assert.NoError(t, c.checkAssurance("reader", &jwtClaims{}, now))
+	})
+
+	t.Run("loads rules from the config file", func(t *testing.T) {
+		path := writeConfig(t, `
+role_assurance:
+  - roles: [postgres]
+    aal: aal2
+    max_age: 15m
+  - roles: ["reader_*"]
+`)
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		assert.Equal(t, []roleAssuranceRule{{Roles: []string{"postgres"}, MinAAL: 2, MaxAge: 15 * time.Minute}, {Roles: []string{"reader_*"}, MinAAL: 1}}, c.RoleAssurance)
+	})
+
+	t.Run("rejects malformed rules", func(t *testing.T) {
+		_, err := configFromArgs([]string{"roleAssurance=postgres"})
+		assert.ErrorContains(t, err, "malformed roleAssurance rule: postgres")
+
+		_, err = configFromArgs([]string{"roleAssurance=postgres=aal4"})
+		assert.ErrorContains(t, err, `invalid assurance level: "aal4"`)
+
+		_, err = configFromArgs([]string{"roleAssurance=postgres=aal2:soon"})
+		assert.ErrorContains(t, err, `invalid max age: "soon"`)
+
+		_, err = configFromArgs([]string{"roleAssurance=service_[=aal2"})
+		assert.ErrorContains(t, err, `invalid role pattern "service_["`)
+	})
+}
+
+func TestAMREntry_unmarshal(t *testing.T) {
+	var claims jwtClaims
+	assert.NoError(t, json.Unmarshal([]byte(`{"aal":"aal2","amr":[{"method":"totp","timestamp":1751978755},"pwd"]}`), &claims))
+	stamp := numericDate(1751978755)
+	assert.Equal(t, []amrEntry{{Method: "totp", Timestamp: &stamp}, {Method: "pwd"}}, claims.AMR)
+}
+
+func TestGatekeeper_assurance(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(permsHandler))
+	defer api.Close()
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "roleAssurance=postgres=aal2:15m"})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	signer := newTestSigner(t, "ES256")
+
+	claims := validClaims()
+	claims["aal"] = "aal2"
+	claims["amr"] = []any{map[string]any{"method": "totp", "timestamp": time.Now().Add(-time.Minute).Unix()}}
+	g, err := gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.1", Token: signer.sign(t, claims)})
+	assert.NoError(t, err)
+	assert.Equal(t, AuthJwt, g.Method)
+
+	claims["aal"] = "aal1"
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.1", Token: signer.sign(t, claims)})
+	assert.ErrorIs(t, err, errInsufficientAssurance)
+	assert.Equal(t, "insufficient_assurance", newErrorRecord(err).Kind)
+
+	// other methods aren't affected
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.1", Token: "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"})
+	assert.NoError(t, err)
+}
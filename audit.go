@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultAuditMaxFiles = 5
+
+	// fsync every event before the login is answered
+	auditFsyncAlways = "always"
+	// leave flushing to the OS
+	auditFsyncNever = "never"
+)
+
+// auditConfig configures the audit log, a JSON Lines file with one event for every decision
+type auditConfig struct {
+	// empty to disable the audit log
+	Path string
+	// the log is rotated before it grows beyond this many bytes, 0 to never rotate
+	MaxSize int64
+	// rotated logs kept as <Path>.1 (the newest) to <Path>.<MaxFiles>
+	MaxFiles int
+	// auditFsyncAlways or auditFsyncNever
+	Fsync string
+	// path of the HMAC key tokens are fingerprinted with, created when missing. Defaults to <Path>.key
+	KeyFile string
+	// PEM Ed25519 private key checkpoints are signed with, empty to not sign the log
+	SigningKey string
+	// every CheckpointEvery-th line is a checkpoint, 0 for defaultAuditCheckpointEvery
+	CheckpointEvery int
+}
+
+func (c auditConfig) keyFile() string {
+	if c.KeyFile != "" {
+		return c.KeyFile
+	}
+	return c.Path + ".key"
+}
+
+func (c auditConfig) checkpointEvery() uint64 {
+	if c.CheckpointEvery > 0 {
+		return uint64(c.CheckpointEvery)
+	}
+	return defaultAuditCheckpointEvery
+}
+
+type auditDecision string
+
+const (
+	auditAllow auditDecision = "allow"
+	auditDeny  auditDecision = "deny"
+)
+
+// auditEvent is a line of the audit log
+type auditEvent struct {
+	chainLink
+	Time time.Time `json:"time"`
+	// the Postgres backend the login was for
+	PID    int        `json:"pid,omitempty"`
+	Rhost  string     `json:"rhost"`
+	Role   string     `json:"role"`
+	Method AuthMethod `json:"method,omitempty"`
+	// keyed hash of the token, the same token always has the same fingerprint but can't be recovered from it
+	TokenFingerprint string        `json:"token_fingerprint,omitempty"`
+	UserId           string        `json:"user_id,omitempty"`
+	GrantId          string        `json:"grant_id,omitempty"`
+	ExpiresAt        time.Time     `json:"expires_at,omitzero"`
+	Decision         auditDecision `json:"decision"`
+	Reason           string        `json:"reason,omitempty"`
+	LatencyMs        float64       `json:"latency_ms"`
+}
+
+func newAuditEvent(req *loginRequest, method AuthMethod, g *grant, err error, start, now time.Time) *auditEvent {
+	ev := &auditEvent{
+		Time:      now.UTC(),
+		PID:       req.PID,
+		Rhost:     req.Rhost,
+		Role:      req.User,
+		Method:    method,
+		Decision:  auditAllow,
+		LatencyMs: float64(now.Sub(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		ev.Decision = auditDeny
+		ev.Reason = err.Error()
+	}
+	if g != nil {
+		ev.UserId = g.UserId
+		ev.GrantId = g.Id
+		ev.ExpiresAt = g.ExpiresAt.UTC()
+		if g.Method == AuthTrust {
+			ev.Reason = "trusted connection"
+		}
+		if g.Degraded != "" {
+			ev.Reason = "degraded mode, cached grant honoured: " + g.Degraded
+		}
+	}
+	return ev
+}
+
+// auditLog appends events to the audit log. Every process logging to the same
+// path takes a flock on <path>.lock while appending, so lines never interleave
+// and only one process rotates the log.
+type auditLog struct {
+	config auditConfig
+
+	mu     sync.Mutex
+	key    []byte
+	signer ed25519.PrivateKey
+}
+
+func newAuditLog(cfg auditConfig) *auditLog {
+	return &auditLog{config: cfg}
+}
+
+// fingerprint returns the keyed hash of the token, empty when there is no token
+func (a *auditLog) fingerprint(token string) (string, error) {
+	if token == "" {
+		return "", nil
+	}
+	a.mu.Lock()
+	if a.key == nil {
+		key, err := loadOrCreateKey(a.config.keyFile())
+		if err != nil {
+			a.mu.Unlock()
+			return "", err
+		}
+		a.key = key
+	}
+	a.mu.Unlock()
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// auditRecord is a line of the audit log, chained to the line before it
+type auditRecord interface {
+	link() *chainLink
+}
+
+func (a *auditLog) write(rec auditRecord) error {
+	signer, err := a.signingKey()
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(a.config.Path, syscall.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// the record is chained to the last line written, by any process
+	link := rec.link()
+	*link, err = a.chainHead()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	lines := append(line, '\n')
+	if signer != nil && (link.Seq+1)%a.config.checkpointEvery() == 0 {
+		cp := auditCheckpoint{
+			chainLink: chainLink{Seq: link.Seq + 1, PrevHash: lineHash(line)},
+			Type:      checkpointType,
+			Time:      time.Now().UTC(),
+		}
+		cp.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(signer, checkpointMessage(cp.chainLink)))
+		line, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	if a.config.MaxSize > 0 {
+		fi, err := os.Stat(a.config.Path)
+		if err == nil && fi.Size() > 0 && fi.Size()+int64(len(lines)) > a.config.MaxSize {
+			if err := a.rotate(); err != nil {
+				return err
+			}
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
+	_, statErr := os.Stat(a.config.Path)
+	f, err := os.OpenFile(a.config.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	// the admin commands audit as root, the log stays the backends'
+	if errors.Is(statErr, fs.ErrNotExist) {
+		if err := adoptOwner(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	// a torn last line gets its newline, so that the record starts a line of its own
+	if fi, err := f.Stat(); err == nil && fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err == nil && last[0] != '\n' {
+			lines = append([]byte{'\n'}, lines...)
+		}
+	}
+	if _, err := f.Write(lines); err != nil {
+		f.Close()
+		return err
+	}
+	if a.config.Fsync != auditFsyncNever {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// rotate moves the log to <path>.1, shifting the older ones and dropping the oldest
+func (a *auditLog) rotate() error {
+	path := a.config.Path
+	if a.config.MaxFiles <= 0 {
+		// the config is validated against this, the log is never dropped
+		return fmt.Errorf("not rotating %s: no rotated logs are kept", path)
+	}
+	if err := os.Remove(fmt.Sprintf("%s.%d", path, a.config.MaxFiles)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := a.config.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+// parseSize parses a size in bytes, optionally with a K, M or G suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	for suffix, m := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if n, ok := strings.CutSuffix(number, suffix); ok {
+			number, multiplier = n, m
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func parseFsyncPolicy(policy string) (string, error) {
+	switch policy {
+	case auditFsyncAlways, auditFsyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy: %v", policy)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditLog(t *testing.T, path string) []auditEvent {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev auditEvent
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &ev))
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestAudit_gatekeeper(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(permsHandler))
+	defer api.Close()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "trustLocal=true", "audit=" + path})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: pat, PID: 4242})
+	assert.NoError(t, err)
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString", PID: 4243})
+	assert.Error(t, err)
+	_, err = gk.Trust(ctx, &loginRequest{User: "postgres", Rhost: "[local]", PID: 4244})
+	assert.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), pat)
+	assert.NotContains(t, string(data), "aPasswordString")
+
+	events := readAuditLog(t, path)
+	assert.Len(t, events, 3)
+
+	allowed := events[0]
+	assert.Equal(t, 4242, allowed.PID)
+	assert.Equal(t, "10.0.0.2", allowed.Rhost)
+	assert.Equal(t, "postgres", allowed.Role)
+	assert.Equal(t, AuthPat, allowed.Method)
+	assert.Equal(t, validPerms.UserId, allowed.UserId)
+	assert.Equal(t, auditAllow, allowed.Decision)
+	assert.Len(t, allowed.TokenFingerprint, 32)
+	assert.WithinDuration(t, time.Now(), allowed.Time, time.Minute)
+
+	denied := events[1]
+	assert.Equal(t, AuthPassword, denied.Method)
+	assert.Equal(t, auditDeny, denied.Decision)
+	assert.NotEmpty(t, denied.Reason)
+	assert.NotEqual(t, allowed.TokenFingerprint, denied.TokenFingerprint)
+
+	trusted := events[2]
+	assert.Equal(t, AuthTrust, trusted.Method)
+	assert.Equal(t, auditAllow, trusted.Decision)
+	assert.Equal(t, "trusted connection", trusted.Reason)
+	assert.Empty(t, trusted.TokenFingerprint)
+}
+
+func TestAudit_fingerprint(t *testing.T) {
+	a := newAuditLog(auditConfig{Path: filepath.Join(t.TempDir(), "audit.jsonl")})
+	first, err := a.fingerprint("token")
+	assert.NoError(t, err)
+
+	// another process shares the key
+	again, err := newAuditLog(a.config).fingerprint("token")
+	assert.NoError(t, err)
+	assert.Equal(t, first, again)
+
+	other, err := a.fingerprint("other token")
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, other)
+}
+
+func TestAudit_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := newAuditLog(auditConfig{Path: path, MaxSize: 300, MaxFiles: 2, Fsync: auditFsyncAlways})
+
+	for i := range 10 {
+		ev := &auditEvent{Role: strings.Repeat("r", i), Decision: auditAllow}
+		assert.NoError(t, a.write(ev))
+	}
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, fi.Size(), int64(300))
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// the newest event is in the current log
+	events := readAuditLog(t, path)
+	assert.Equal(t, strings.Repeat("r", 9), events[len(events)-1].Role)
+}
+
+func TestAudit_config(t *testing.T) {
+	for in, want := range map[string]int64{"512": 512, "10K": 10 << 10, "100MB": 100 << 20, "1g": 1 << 30} {
+		size, err := parseSize(in)
+		assert.NoError(t, err)
+		assert.Equal(t, want, size, in)
+	}
+	_, err := parseSize("lots")
+	assert.Error(t, err)
+
+	path := writeConfig(t, "audit:\n  path: /var/log/audit.jsonl\n  max_size: 10M\n  max_files: 2\n  fsync: never\n")
+	c, err := configFromArgs([]string{"config=" + path})
+	assert.NoError(t, err)
+	assert.Equal(t, auditConfig{Path: "/var/log/audit.jsonl", MaxSize: 10 << 20, MaxFiles: 2, Fsync: auditFsyncNever}, c.Audit)
+	assert.NoError(t, c.validate())
+
+	// rotating without keeping the rotated log would delete the audit history
+	c, err = configFromArgs([]string{"config=" + path, "auditMaxFiles=0"})
+	assert.NoError(t, err)
+	assert.EqualError(t, c.validate(), "auditMaxSize is set but auditMaxFiles is 0, rotating would drop the audit log")
+	a := newAuditLog(c.Audit)
+	assert.ErrorContains(t, a.rotate(), "no rotated logs are kept")
+
+	_, err = configFromArgs([]string{"auditFsync=sometimes"})
+	assert.ErrorContains(t, err, "unknown fsync policy: sometimes")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+// every this many lines of the audit log is a signed checkpoint when a signing key is configured
+const defaultAuditCheckpointEvery = 100
+
+// the records of the audit log form a hash chain: every line holds the
+// SHA-256 of the line before it, so removing or changing a line breaks the
+// chain at that point. The chain continues across rotated logs.
+type chainLink struct {
+	// counts up by one from the first line ever written
+	Seq uint64 `json:"seq"`
+	// hex SHA-256 of the previous line, without its newline. Empty for the first line.
+	PrevHash string `json:"prev_hash"`
+}
+
+func (l *chainLink) link() *chainLink {
+	return l
+}
+
+const checkpointType = "checkpoint"
+
+// auditCheckpoint is a line of the audit log signing the chain up to it, it
+// proves the lines before it were written by whoever holds the signing key
+type auditCheckpoint struct {
+	chainLink
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// base64 Ed25519 signature of checkpointMessage
+	Signature string `json:"signature"`
+}
+
+// checkpointMessage is what a checkpoint signs, the position in and the hash of the chain it follows
+func checkpointMessage(link chainLink) []byte {
+	return []byte("jit-gatekeeper audit checkpoint\n" + strconv.FormatUint(link.Seq, 10) + "\n" + link.PrevHash)
+}
+
+func lineHash(line []byte) string {
+	digest := sha256.Sum256(line)
+	return hex.EncodeToString(digest[:])
+}
+
+// chainHead returns the link for the next line, following the last line of
+// the log, or of the most recently rotated one when the log is empty
+func (a *auditLog) chainHead() (chainLink, error) {
+	for _, path := range []string{a.config.Path, a.config.Path + ".1"} {
+		line, err := lastLine(path)
+		if err != nil {
+			return chainLink{}, err
+		}
+		if line == nil {
+			continue
+		}
+		var prev chainLink
+		if err := json.Unmarshal(line, &prev); err != nil {
+			// torn by a crash or a full disk, or edited by hand. Refusing to
+			// write would stop auditing for good, the chain goes on from the
+			// line instead and verify reports the break.
+			seq, err := a.lastSeq(path)
+			if err != nil {
+				return chainLink{}, err
+			}
+			// the malformed line takes the place after the last good record
+			return chainLink{Seq: seq + 2, PrevHash: lineHash(line)}, nil
+		}
+		return chainLink{Seq: prev.Seq + 1, PrevHash: lineHash(line)}, nil
+	}
+	return chainLink{Seq: 1}, nil
+}
+
+// lastSeq returns the seq of the last well-formed record in path, or in the
+// rotated logs after it when it has none. Zero when there is none at all.
+func (a *auditLog) lastSeq(path string) (uint64, error) {
+	paths := []string{a.config.Path, a.config.Path + ".1"}
+	if path != a.config.Path {
+		paths = paths[1:]
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var seq uint64
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), 2*maxFrameSize)
+		for scanner.Scan() {
+			var link chainLink
+			if json.Unmarshal(scanner.Bytes(), &link) == nil {
+				seq = link.Seq
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		if seq > 0 {
+			return seq, nil
+		}
+	}
+	return 0, nil
+}
+
+// lastLine returns the last line of the file without its newline, nil when the file is empty or missing
+func lastLine(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// lines are far shorter than this, a frame is at most maxFrameSize
+	size := min(fi.Size(), 2*maxFrameSize)
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, fi.Size()-size); err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	i := bytes.LastIndexByte(buf, '\n')
+	if i < 0 && size < fi.Size() {
+		return nil, fmt.Errorf("last record of %s is too long", path)
+	}
+	return buf[i+1:], nil
+}
+
+// signingKey loads the Ed25519 key checkpoints are signed with, nil when none is configured
+func (a *auditLog) signingKey() (ed25519.PrivateKey, error) {
+	if a.config.SigningKey == "" {
+		return nil, nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.signer == nil {
+		key, err := loadEd25519Key(a.config.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		a.signer = key
+	}
+	return a.signer, nil
+}
+
+// loadEd25519Key reads a PKCS #8 PEM private key, as created by openssl genpkey -algorithm ed25519
+func loadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in signing key %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is a %T, not Ed25519", path, key)
+	}
+	return edKey, nil
+}
+
+// loadEd25519PublicKey reads a PKIX PEM public key, or derives it from a PKCS #8 private key
+func loadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in key %s", path)
+	}
+	if block.Type == "PRIVATE KEY" {
+		key, err := loadEd25519Key(path)
+		if err != nil {
+			return nil, err
+		}
+		return key.Public().(ed25519.PublicKey), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is a %T, not Ed25519", path, key)
+	}
+	return edKey, nil
+}
+
+// chainReport is the outcome of verifying the audit logs
+type chainReport struct {
+	Records     int
+	Checkpoints int
+	FirstSeq    uint64
+	LastSeq     uint64
+	// sequence number of the last valid checkpoint, the records after it are not signed
+	LastCheckpoint uint64
+	// where the chain breaks, as file:line: problem
+	Breaks []string
+}
+
+// verifyAuditChain walks the logs, oldest first, and reports where the chain
+// breaks. Checkpoint signatures are only checked when pub is set.
+func verifyAuditChain(paths []string, pub ed25519.PublicKey) (*chainReport, error) {
+	report := &chainReport{}
+	var prevLine []byte
+	var prev chainLink
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), 2*maxFrameSize)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := scanner.Bytes()
+			broken := func(format string, a ...any) {
+				report.Breaks = append(report.Breaks, fmt.Sprintf("%s:%d: %s", path, lineNo, fmt.Sprintf(format, a...)))
+			}
+
+			var rec struct {
+				chainLink
+				Type      string `json:"type"`
+				Signature string `json:"signature"`
+			}
+			if err := json.Unmarshal(line, &rec); err != nil {
+				broken("malformed record: %v", err)
+				prevLine, prev = bytes.Clone(line), chainLink{}
+				continue
+			}
+
+			if prevLine == nil {
+				// the chain starts here, older logs may have been rotated away
+				report.FirstSeq = rec.Seq
+			} else {
+				if rec.Seq != prev.Seq+1 {
+					broken("expected seq %d, found %d", prev.Seq+1, rec.Seq)
+				}
+				if rec.PrevHash != lineHash(prevLine) {
+					broken("prev_hash of seq %d does not match the record before it", rec.Seq)
+				}
+			}
+
+			if rec.Type == checkpointType {
+				report.Checkpoints++
+				if pub != nil {
+					sig, err := base64.StdEncoding.DecodeString(rec.Signature)
+					if err != nil || !ed25519.Verify(pub, checkpointMessage(rec.chainLink), sig) {
+						broken("invalid signature on checkpoint seq %d", rec.Seq)
+					} else {
+						report.LastCheckpoint = rec.Seq
+					}
+				}
+			}
+
+			report.Records++
+			report.LastSeq = rec.Seq
+			prevLine, prev = bytes.Clone(line), rec.chainLink
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return report, nil
+}
+
+// auditLogFiles lists the log and its rotated copies that exist, oldest first
+func auditLogFiles(cfg auditConfig) []string {
+	var paths []string
+	for i := cfg.MaxFiles; i >= 1; i-- {
+		path := fmt.Sprintf("%s.%d", cfg.Path, i)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	if _, err := os.Stat(cfg.Path); err == nil {
+		paths = append(paths, cfg.Path)
+	}
+	return paths
+}
+
+// runAudit is gatekeeper audit, verify walks the hash chain of the audit log and reports where it breaks
+func runAudit(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: gatekeeper audit verify [-config path] [-key public.pem] [log ...]")
+		return 2
+	}
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	keyPath := flags.String("key", "", "Ed25519 public key checkpoints are verified with, defaults to the signing key of the config")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 || *keyPath == "" {
+		cfg, err := configFromArgs([]string{"config=" + *configPath})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+			return 1
+		}
+		if len(paths) == 0 {
+			paths = auditLogFiles(cfg.Audit)
+		}
+		if *keyPath == "" {
+			*keyPath = cfg.Audit.SigningKey
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "no audit logs found")
+		return 1
+	}
+
+	var pub ed25519.PublicKey
+	if *keyPath != "" {
+		var err error
+		if pub, err = loadEd25519PublicKey(*keyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	report, err := verifyAuditChain(paths, pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to verify: %v\n", err)
+		return 1
+	}
+	for _, b := range report.Breaks {
+		fmt.Println(b)
+	}
+	fmt.Printf("%d records (seq %d to %d), %d checkpoints\n", report.Records, report.FirstSeq, report.LastSeq, report.Checkpoints)
+	switch {
+	case pub == nil:
+		fmt.Println("no key given, checkpoint signatures were not verified")
+	case report.LastCheckpoint == 0:
+		fmt.Println("no valid checkpoint, nothing is signed")
+	case report.LastCheckpoint < report.LastSeq:
+		fmt.Printf("records after seq %d are not covered by a checkpoint yet\n", report.LastCheckpoint)
+	}
+	if len(report.Breaks) > 0 {
+		fmt.Printf("chain broken in %d places\n", len(report.Breaks))
+		return 1
+	}
+	fmt.Println("chain intact")
+	return 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSigningKey(t *testing.T) (string, ed25519.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return path, pub
+}
+
+func writeAuditEvents(t *testing.T, a *auditLog, n int) {
+	for i := range n {
+		assert.NoError(t, a.write(&auditEvent{Role: strings.Repeat("r", i%5), Decision: auditAllow}))
+	}
+}
+
+func TestAuditChain_verify(t *testing.T) {
+	keyPath, pub := writeSigningKey(t)
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	cfg := auditConfig{Path: path, MaxSize: 1000, MaxFiles: 10, Fsync: auditFsyncNever, SigningKey: keyPath, CheckpointEvery: 4}
+	writeAuditEvents(t, newAuditLog(cfg), 10)
+	// another process continues the chain
+	writeAuditEvents(t, newAuditLog(cfg), 3)
+
+	files := auditLogFiles(cfg)
+	assert.Greater(t, len(files), 1)
+	report, err := verifyAuditChain(files, pub)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Breaks)
+	// 13 events and every 4th line a checkpoint
+	assert.Equal(t, 17, report.Records)
+	assert.Equal(t, 4, report.Checkpoints)
+	assert.Equal(t, uint64(1), report.FirstSeq)
+	assert.Equal(t, uint64(17), report.LastSeq)
+	assert.Equal(t, uint64(16), report.LastCheckpoint)
+
+	// the chain starts at the oldest log kept
+	report, err = verifyAuditChain(files[1:], pub)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Breaks)
+	assert.Greater(t, report.FirstSeq, uint64(1))
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	report, err = verifyAuditChain(files, otherPub)
+	assert.NoError(t, err)
+	assert.Len(t, report.Breaks, 4)
+	assert.Contains(t, report.Breaks[0], "invalid signature on checkpoint seq 4")
+}
+
+func TestAuditChain_tamper(t *testing.T) {
+	setup := func(t *testing.T) (string, [][]byte) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		writeAuditEvents(t, newAuditLog(auditConfig{Path: path, Fsync: auditFsyncNever}), 5)
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		return path, bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	}
+	verify := func(t *testing.T, path string, lines [][]byte) []string {
+		assert.NoError(t, os.WriteFile(path, append(bytes.Join(lines, []byte("\n")), '\n'), 0600))
+		report, err := verifyAuditChain([]string{path}, nil)
+		assert.NoError(t, err)
+		return report.Breaks
+	}
+
+	t.Run("edited", func(t *testing.T) {
+		path, lines := setup(t)
+		lines[2] = bytes.Replace(lines[2], []byte(`"decision":"allow"`), []byte(`"decision":"deny"`), 1)
+		breaks := verify(t, path, lines)
+		assert.Equal(t, []string{path + ":4: prev_hash of seq 4 does not match the record before it"}, breaks)
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		path, lines := setup(t)
+		lines = append(lines[:1], lines[2:]...)
+		breaks := verify(t, path, lines)
+		assert.Equal(t, []string{
+			path + ":2: expected seq 2, found 3",
+			path + ":2: prev_hash of seq 3 does not match the record before it",
+		}, breaks)
+	})
+
+	t.Run("reordered", func(t *testing.T) {
+		path, lines := setup(t)
+		lines[1], lines[2] = lines[2], lines[1]
+		breaks := verify(t, path, lines)
+		assert.Len(t, breaks, 6)
+		assert.Contains(t, breaks[0], path+":2: expected seq 2, found 3")
+	})
+
+	t.Run("garbled", func(t *testing.T) {
+		path, lines := setup(t)
+		lines[4] = []byte("{")
+		breaks := verify(t, path, lines)
+		assert.Len(t, breaks, 1)
+		assert.Contains(t, breaks[0], path+":5: malformed record")
+	})
+}
+
+func TestAuditChain_tornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a := newAuditLog(auditConfig{Path: path, Fsync: auditFsyncNever})
+	writeAuditEvents(t, a, 5)
+	// a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.WriteString(`{"seq":6,"prev_ha`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	// auditing goes on
+	writeAuditEvents(t, a, 2)
+	writeAuditEvents(t, newAuditLog(auditConfig{Path: path, Fsync: auditFsyncNever}), 1)
+
+	report, err := verifyAuditChain([]string{path}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, report.Records)
+	assert.Equal(t, uint64(9), report.LastSeq)
+	// the torn line and the seq following it are the only breaks
+	if assert.Len(t, report.Breaks, 2) {
+		assert.Contains(t, report.Breaks[0], path+":6: malformed record")
+		assert.Equal(t, path+":7: expected seq 1, found 7", report.Breaks[1])
+	}
+}
+
+func TestAuditChain_config(t *testing.T) {
+	keyPath, pub := writeSigningKey(t)
+	derived, err := loadEd25519PublicKey(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, pub, derived)
+
+	path := writeConfig(t, "audit:\n  path: /var/log/audit.jsonl\n  signing_key: "+keyPath+"\n  checkpoint_every: 50\n")
+	c, err := configFromArgs([]string{"config=" + path})
+	assert.NoError(t, err)
+	assert.Equal(t, keyPath, c.Audit.SigningKey)
+	assert.Equal(t, uint64(50), c.Audit.checkpointEvery())
+
+	c, err = configFromArgs([]string{"auditSigningKey=" + keyPath})
+	assert.NoError(t, err)
+	assert.ErrorContains(t, c.validate(), "auditSigningKey is set but audit is not")
+}
@@ -5,12 +5,18 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type AuthMethod string
@@ -19,55 +25,146 @@ const (
 	AuthPassword AuthMethod = "password"
 	AuthPat      AuthMethod = "pat"
 	AuthJwt      AuthMethod = "jwt"
+	// connection came from a trusted network and was not authenticated
+	AuthTrust AuthMethod = "trust"
 )
 
-type authenticator struct {
-	// use password authentication, this falls through to the native scram-sha256 auth
-	AuthMethod AuthMethod
-
-	ApiUrl string
-}
-
 type AuthZRequest struct {
 	Role  string `json:"role"`
 	Rhost string `json:"rhost"`
 }
 
 type UserPermissionSet struct {
-	UserId string   `json:"user_id"`
-	Role   UserRole `json:"user_role"`
+	UserId string     `json:"user_id"`
+	Roles  []UserRole `json:"user_roles,omitempty"`
+	// legacy single role response, superseded by Roles
+	Role UserRole `json:"user_role"`
 }
 
 type UserRole struct {
-	Role string `json:"role"`
+	// identifies the approval, empty when the API doesn't send one
+	GrantId   string  `json:"grant_id,omitempty"`
+	Role      string  `json:"role"`
+	ExpiresAt apiTime `json:"expires_at"`
+}
+
+// apiAuthenticator authenticates tokens against the API
+type apiAuthenticator struct {
+	ApiUrl string
+
+	// deadlines, TLS, proxy and retry settings for requests to the API
+	Client httpClientConfig
+
+	// nil when the breaker is disabled
+	Breaker *circuitBreaker
+
+	// built from Client once, so that logins reuse its connections. clientErr
+	// fails the logins using the API rather than every login.
+	client    *http.Client
+	clientErr error
+}
+
+func newAPIAuthenticator(config *config) apiAuthenticator {
+	a := apiAuthenticator{ApiUrl: config.AuthAPIURL, Client: config.APIClient, Breaker: newCircuitBreaker(config.APIBreaker)}
+	a.client, a.clientErr = a.Client.client()
+	return a
+}
+
+func (a *apiAuthenticator) closeIdleConnections() {
+	if a.client != nil {
+		a.client.CloseIdleConnections()
+	}
+}
+
+func (a *apiAuthenticator) authenticate(ctx context.Context, req *authRequest, method AuthMethod) (*grant, error) {
+	if a.clientErr != nil {
+		return nil, classify(a.clientErr, errServiceConfig)
+	}
+	if err := a.Breaker.allow(ctx, time.Now()); err != nil {
+		return nil, err
+	}
+	g, err := authApi(ctx, a.client, a.Client.Retry, a.ApiUrl, req)
+	// the breaker only guards against the API being unavailable, failing to update it is not fatal
+	_ = a.Breaker.record(errors.Is(err, errAuthInfoUnavailable), time.Now())
+	if err != nil {
+		return nil, classify(err, errAuthFailed)
+	}
+	g.Method = method
+	return g, nil
+}
+
+// patAuthenticator authenticates Supabase personal access tokens against the API
+type patAuthenticator struct {
+	apiAuthenticator
+}
+
+func (a *patAuthenticator) Method() AuthMethod {
+	return AuthPat
+}
+
+func (a *patAuthenticator) Detect(token string) bool {
+	return looksLikePAT(token)
 }
 
-/* discoverAuthenticator uses the auth token to determine which authentication mechanism to use */
-func discoverAuthenticator(ctx context.Context, config *config, token string) (*authenticator, error) {
-	if looksLikePAT(token) {
-		return &authenticator{
-			ApiUrl:     config.AuthAPIURL,
-			AuthMethod: AuthPat,
-		}, nil
+func (a *patAuthenticator) Authenticate(ctx context.Context, req *authRequest) (*grant, error) {
+	return a.authenticate(ctx, req, AuthPat)
+}
+
+// jwtAuthenticator authenticates JWTs, against the API or locally when a JWKS is configured
+type jwtAuthenticator struct {
+	apiAuthenticator
+
+	// verifies JWTs locally against a JWKS, when set the API is not used
+	Verifier *jwtVerifier
+}
+
+func (a *jwtAuthenticator) Method() AuthMethod {
+	return AuthJwt
+}
+
+func (a *jwtAuthenticator) Detect(token string) bool {
+	return looksLikeJWT(token)
+}
+
+func (a *jwtAuthenticator) closeIdleConnections() {
+	a.apiAuthenticator.closeIdleConnections()
+	if a.Verifier != nil {
+		a.Verifier.Keys.closeIdleConnections()
 	}
-	if looksLikeJWT(token) {
-		return &authenticator{
-			ApiUrl:     config.AuthAPIURL,
-			AuthMethod: AuthJwt,
-		}, nil
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, req *authRequest) (*grant, error) {
+	if a.Verifier != nil {
+		g, err := a.Verifier.Authenticate(ctx, req)
+		return g, classify(err, errAuthFailed)
 	}
-	return &authenticator{
-		AuthMethod: AuthPassword,
-	}, nil
+	return a.authenticate(ctx, req, AuthJwt)
 }
 
-// Authenticate authenticates a user with the provided token.
-func (a *authenticator) Authenticate(ctx context.Context, user, token string) error {
-	if a.AuthMethod == AuthPassword {
-		return authPassword(ctx, user, token)
+// passwordAuthenticator uses password authentication, this falls through to the native scram-sha256 auth
+type passwordAuthenticator struct {
+	// connection used to check passwords against the local database
+	Password passwordConfig
+}
+
+func (a *passwordAuthenticator) Method() AuthMethod {
+	return AuthPassword
+}
+
+// Detect accepts anything, password authentication is the fallback for tokens no other method recognises
+func (a *passwordAuthenticator) Detect(token string) bool {
+	return true
+}
+
+func (a *passwordAuthenticator) Authenticate(ctx context.Context, req *authRequest) (*grant, error) {
+	if req.Ephemeral {
+		// the role doesn't exist before the login, let alone have a password
+		return nil, fmt.Errorf("%w: ephemeral role %s can't be reached with a password", errPermDenied, req.User)
+	}
+	if err := authPassword(ctx, a.Password, req.User, req.Token); err != nil {
+		return nil, classify(err, errAuthFailed)
 	}
-	// AuthPat and AuthJwt use the same API
-	return authApi(ctx, a.ApiUrl, user, token)
+	return &grant{Role: req.User, Method: AuthPassword}, nil
 }
 
 // looksLikePAT simply checks if a supplied token has the supabase PAT prefix
@@ -88,92 +185,275 @@ func looksLikeJWT(token string) bool {
 	return hasPrefix(parts[0]) && hasPrefix(parts[1])
 }
 
+// passwordConfig configures the connection authPassword uses to check passwords against the local database
+type passwordConfig struct {
+	Host string
+	Port int
+	// directory of the unix socket, used instead of Host when set
+	SocketDir string
+	// database to connect to, this should not exist so no session is ever established
+	Database string
+	Timeout  time.Duration
+}
+
+// withDefaults fills in the unset fields, matching what was hard-coded before these were configurable
+func (c passwordConfig) withDefaults() passwordConfig {
+	if c.Host == "" {
+		c.Host = "127.0.0.1"
+	}
+	if c.Port == 0 {
+		c.Port = 5432
+	}
+	if c.Database == "" {
+		c.Database = "authdbsupabase"
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	return c
+}
+
+// dsn builds the libpq connection string with every value quoted, so that a
+// password containing spaces or "host=" can't inject connection parameters
+func (c passwordConfig) dsn(username, password string) string {
+	host := c.Host
+	if c.SocketDir != "" {
+		host = c.SocketDir
+	}
+	params := [][2]string{
+		{"host", host},
+		{"port", strconv.Itoa(c.Port)},
+		{"dbname", c.Database},
+		{"user", username},
+		{"password", password},
+		{"sslmode", "disable"},
+		{"connect_timeout", strconv.Itoa(int(math.Ceil(c.Timeout.Seconds())))},
+	}
+	parts := make([]string, len(params))
+	for i, p := range params {
+		parts[i] = p[0] + "=" + quoteConnValue(p[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteConnValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
 /* authPassword will attempt to auth  to the local postgres database */
-func authPassword(ctx context.Context, username, password string) error {
-	connStr := fmt.Sprintf("user=%s password=%s dbname=authdbsupabase sslmode=disable host=127.0.0.1", username, password)
+func authPassword(ctx context.Context, cfg passwordConfig, username, password string) error {
+	cfg = cfg.withDefaults()
 
-	db, err := sql.Open("postgres", connStr)
+	connector, err := pq.NewConnector(cfg.dsn(username, password))
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %w", errServiceConfig, err)
 	}
+	db := sql.OpenDB(connector)
 	defer db.Close()
 
-	err = db.Ping()
-	if err != nil {
-		// valid username + password and permitted to login
-		if strings.Contains(err.Error(), "database \"authdbsupabase\" does not exist") {
-			return nil
-		}
-		return err
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	// valid username + password and permitted to login
+	ctx, sp := startClientSpan(ctx, "password ping", attr("server.address", cfg.Host), attr("server.port", cfg.Port), attr("db.name", cfg.Database))
+	start := time.Now()
+	err = classifyPasswordError(db.PingContext(ctx), cfg.Database)
+	metricsFrom(ctx).observe(metricPasswordLatency, time.Since(start).Seconds())
+	sp.finish(err)
+	return err
+}
+
+// classifyPasswordError decides the outcome of the login attempt from the SQLSTATE Postgres returned
+func classifyPasswordError(err error, database string) error {
+	if err == nil {
+		return nil
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		// never got an answer from Postgres
+		return fmt.Errorf("%w: %w", errAuthInfoUnavailable, err)
+	}
+	switch pqErr.Code {
+	case "3D000": // invalid_catalog_name
+		// authentication succeeded and the sentinel database does not exist, as intended
+		return nil
+	case "28P01": // invalid_password
+		return fmt.Errorf("%w: invalid password", errAuthFailed)
+	case "28000": // invalid_authorization_specification, eg. no pg_hba.conf entry or role without LOGIN
+		return fmt.Errorf("%w: %s", errPermDenied, pqErr.Message)
+	default:
+		return fmt.Errorf("%w: %w", errAuthFailed, err)
 	}
-	return nil
 }
 
-func authApi(ctx context.Context, apiUrl, username, token string) error {
+func authApi(ctx context.Context, client *http.Client, retry retryPolicy, apiUrl string, authReq *authRequest) (*grant, error) {
+	username, token := authReq.User, authReq.Token
 	// make an API request to check if the user is authorized to login
 	// uses the incoming token to authenticate against the API
 	// giving the guarantee that the user token is still valid and permitted
 	// to  interact with the project
 	if rhost, ok := ctx.Value(rhostKey).(string); !ok {
-		return fmt.Errorf("context does not have rhost")
+		return nil, fmt.Errorf("context does not have rhost")
 	} else {
 		jsonData, err := json.Marshal(&AuthZRequest{username, rhost})
 		if err != nil {
 			panic(err)
 		}
 
-		client := &http.Client{}
-		req, err := http.NewRequest("POST", apiUrl, bytes.NewBuffer(jsonData))
-		if err != nil {
-			return err
-		}
-		// set auth for API server, only bearer support for now
-		req.Header.Add("Authorization", "Bearer "+token)
-		req.Header.Add("Accept", "application/json")
-		req.Header.Add("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
+		resp, err := retry.do(ctx, func() (*apiResponse, error) {
+			return postAuthz(ctx, client, apiUrl, token, jsonData)
+		})
 		if err != nil {
-			return err
+			return nil, classify(err, errAuthInfoUnavailable)
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
+		if resp.Status != http.StatusOK {
 			// user has no authorization setup if a 406 error is returned
-			if resp.StatusCode == http.StatusNotAcceptable {
-				return fmt.Errorf("user not authorized for JIT access to database")
+			if resp.Status == http.StatusNotAcceptable {
+				return nil, fmt.Errorf("%w: user not authorized for JIT access to database", errPermDenied)
 			}
 
-			if resp.StatusCode == http.StatusForbidden {
-				return fmt.Errorf("user not authorized due to restriction")
+			if resp.Status == http.StatusForbidden {
+				return nil, fmt.Errorf("%w: user not authorized due to restriction", errPermDenied)
+			}
+			// the API is having trouble, rather than rejecting the token
+			if resp.Status >= http.StatusInternalServerError {
+				return nil, fmt.Errorf("%w: failed with status: %d", errAuthInfoUnavailable, resp.Status)
 			}
 			// something else went wrong
-			return fmt.Errorf("failed with status: %d", resp.StatusCode)
+			return nil, fmt.Errorf("%w: failed with status: %d", errAuthFailed, resp.Status)
 		}
 
-		body, err := io.ReadAll(resp.Body)
+		var perms UserPermissionSet
+		if err := json.Unmarshal(resp.Body, &perms); err != nil {
+			return nil, fmt.Errorf("%w: malformed response: %w", errAuthInfoUnavailable, err)
+		}
+
+		// validate the user's permission
+		if authReq.Ephemeral {
+			role, err := approvedRole(perms, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return &grant{Id: role.GrantId, Role: username, Target: role.Role, UserId: perms.UserId, ExpiresAt: role.ExpiresAt.Time}, nil
+		}
+		role, err := isPermitted(ctx, username, perms, time.Now())
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return &grant{Id: role.GrantId, Role: role.Role, UserId: perms.UserId, ExpiresAt: role.ExpiresAt.Time}, nil
+	}
+}
 
-		var perms UserPermissionSet
-		if err := json.Unmarshal(body, &perms); err != nil {
-			return err
+// postAuthz makes a single request to the API
+func postAuthz(ctx context.Context, client *http.Client, apiUrl, token string, jsonData []byte) (*apiResponse, error) {
+	ctx, sp := startClientSpan(ctx, "POST", attr("http.request.method", "POST"), attr("url.full", apiUrl))
+	if sp != nil {
+		ctx = httptrace.WithClientTrace(ctx, sp.clientTrace())
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", apiUrl, bytes.NewReader(jsonData))
+	if err != nil {
+		sp.finish(err)
+		return nil, classify(err, errServiceConfig)
+	}
+	// set auth for API server, only bearer support for now
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	if sp != nil {
+		// the API's spans join the trace of the login
+		req.Header.Set("traceparent", sp.traceparent())
+	}
+
+	m := metricsFrom(ctx)
+	start := time.Now()
+	resp, err := client.Do(req)
+	m.observe(metricAPILatency, time.Since(start).Seconds())
+	if err != nil {
+		m.inc(metricAPIStatus, label("code", "error"))
+		sp.finish(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	m.inc(metricAPIStatus, label("code", strconv.Itoa(resp.StatusCode)))
+	sp.setAttributes(attr("http.response.status_code", resp.StatusCode))
+	// the body is read below, the round trip is over once the headers are in
+	if resp.StatusCode >= http.StatusBadRequest {
+		sp.finish(fmt.Errorf("status %d", resp.StatusCode))
+	} else {
+		sp.finish(nil)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &apiResponse{Status: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After"), Body: body}, nil
+}
+
+// roles returns every role in the response, whether sent as user_roles or the legacy user_role
+func (p *UserPermissionSet) roles() []UserRole {
+	roles := p.Roles
+	if p.Role.Role != "" {
+		roles = append(roles[:len(roles):len(roles)], p.Role)
+	}
+	return roles
+}
+
+// pickRole picks the longest lasting of the unexpired entries for role, or of
+// all of them when role is empty. It also returns the distinct roles of those
+// entries, and whether any entry was skipped for having expired.
+func pickRole(perms UserPermissionSet, role string, now time.Time) (match *UserRole, roles []string, expired bool) {
+	for _, r := range perms.roles() {
+		if role != "" && r.Role != role {
+			continue
+		}
+		if !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt.Time) {
+			expired = true
+			continue
+		}
+		if !slices.Contains(roles, r.Role) {
+			roles = append(roles, r.Role)
+		}
+		if match == nil || r.ExpiresAt.IsZero() || (!match.ExpiresAt.IsZero() && r.ExpiresAt.After(match.ExpiresAt.Time)) {
+			match = &r
 		}
+	}
+	return match, roles, expired
+}
 
-		// validate the user's permission
-		return isPermitted(ctx, username, perms)
+// approvedRole picks the role an ephemeral role becomes a member of. The token
+// must be approved for exactly one role, picking one of several would grant
+// more than the user asked for.
+func approvedRole(perms UserPermissionSet, now time.Time) (*UserRole, error) {
+	match, approved, expired := pickRole(perms, "", now)
+	switch {
+	case len(approved) == 1:
+		return match, nil
+	case len(approved) > 1:
+		return nil, fmt.Errorf("%w: approved for several roles (%s), log in as one of them", errPermDenied, strings.Join(approved, ", "))
+	case expired:
+		return nil, fmt.Errorf("%w: %w", errCredExpired, errGrantExpired)
+	default:
+		return nil, fmt.Errorf("%w: not approved for any role", errPermDenied)
 	}
 }
 
-func isPermitted(ctx context.Context, username string, perms UserPermissionSet) error {
+// isPermitted picks the role from the response that matches the requested user.
+// Expired entries are dropped, and if several entries match the longest lasting one is used.
+func isPermitted(ctx context.Context, username string, perms UserPermissionSet, now time.Time) (*UserRole, error) {
 	if username == "" {
-		return fmt.Errorf("empty username")
+		return nil, fmt.Errorf("%w: empty username", errAuthFailed)
 	}
-	// not strictly required anymore,
-	// but double check the response from the server is what we were expecting
-	if perms.Role.Role == username {
-		return nil
+
+	match, _, expired := pickRole(perms, username, now)
+	if match != nil {
+		return match, nil
+	}
+	if expired {
+		return nil, fmt.Errorf("%w: %w for %s", errCredExpired, errGrantExpired, username)
 	}
-	return fmt.Errorf("not permitted to assume %s", username)
+	return nil, fmt.Errorf("%w: not permitted to assume %s", errPermDenied, username)
 }
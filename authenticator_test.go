@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -15,48 +20,51 @@ func TestAuthenticate_Discover(t *testing.T) {
 	c := &config{
 		AuthAPIURL: "https://mocked.api",
 	}
-	ctx := context.Background()
 
 	t.Run("discovers PAT token for auth", func(t *testing.T) {
 		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthPat, ApiUrl: c.AuthAPIURL}, auth)
+		assert.IsType(t, &patAuthenticator{}, auth)
+		assert.Equal(t, c.AuthAPIURL, auth.(*patAuthenticator).ApiUrl)
 	})
 
 	t.Run("discovers oauth PAT token for auth", func(t *testing.T) {
 		token := "sbp_oauth_1112223336d4dddd54e60cfa33441499b182bbbb"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthPat, ApiUrl: c.AuthAPIURL}, auth)
+		assert.IsType(t, &patAuthenticator{}, auth)
+		assert.Equal(t, c.AuthAPIURL, auth.(*patAuthenticator).ApiUrl)
 	})
 
 	t.Run("discovers JWT token for auth", func(t *testing.T) {
 		token := "eyJhbGciOiJSUzI1NiIsImtpZCI6IjcyYjY2NjA1IiwidHlwIjoiSldUIn0.eyJhYWwiOiJhYWwyIiwiYW1yIjpbeyJtZXRob2QiOiJ0b3RwIiwidGltZXN0YW1wIjoxNzUxOTc4NzU1fSx7Im1ldGhvZCI6InBhc3N3b3JkIiwidGltZXN0YW1wIjoxNzUxOTc4NzM2fV0sImFwcF9tZXRhZGF0YSI6eyJwcm92aWRlciI6ImVtYWlsIiwicHJvdmlkZXJzIjpbImVtYWlsIiwiZ2l0aHViIl19LCJhdWQiOiJhdXRoZW50aWNhdGVkIiwiZW1haWwiOiJldGllbm5lQHN1cGFiYXNlLmlvIiwiZXhwIjoxNzUzOTUzMTQ0LCJpYXQiOjE3NTM5NTI1NDQsImlzX2Fub255bW91cyI6ZmFsc2UsImlzcyI6Imh0dHBzOi8vYWx0LnN1cGFiYXNlLmdyZWVuL2F1dGgvdjEiLCJwaG9uZSI6IiIsInJvbGUiOiJhdXRoZW50aWNhdGVkIiwic2Vzc2lvbl9pZCI6ImI2MjZhNjMzLThhMzktNGFkYy1hY2FmLTVhYTNhMmQwYTg1ZiIsInN1YiI6ImZmOTIxZDE5LTk0NWYtNDRiMy1iNzg2LTE5MTViNmViMWQwZSIsInVzZXJfbWV0YWRhdGEiOnsiYXZhdGFyX3VybCI6Imh0dHBzOi8vYXZhdGFycy5naXRodWJ1c2VyY29udGVudC5jb20vdS80MjAwODMyP3Y9NCIsImVtYWlsIjoiZXN0YWxtYW5zQGdtYWlsLmNvbSIsImVtYWlsX3ZlcmlmaWVkIjp0cnVlLCJmdWxsX25hbWUiOiJFdGllbm5lIFN0YWxtYW5zIiwiaXNzIjoiaHR0cHM6Ly9hcGkuZ2l0aHViLmNvbSIsIm5hbWUiOiJFdGllbm5lIFN0YWxtYW5zIiwicGhvbmVfdmVyaWZpZWQiOmZhbHNlLCJwcmVmZXJyZWRfdXNlcm5hbWUiOiJzdGFhbGRyYWFkIiwicHJvdmlkZXJfaWQiOiI0MjAwODMyIiwic3ViIjoiNDIwMDgzMiIsInVzZXJfbmFtZSI6InN0YWFsZHJhYWQifX0.E4sLsEcjxg3WWsHVV7-37RqhvZqPRShVpCcaavEf2or88J4o1HS0bM_fGzUPULDfE0jzzu-2N9vvlvX41XVaCMsuVh5kspfcTBhQ9eCaqIYok_5nh5AiNafdI8mvSJTpwo9Qem1Fqj9Ka9pqg5mUCkU39r1N04a30py9xmI1hERN8C1rJK2BxMMDQkjjcWA0Bgyk8fyj8kwJ-CoYuIGVsOqI1rc__U3yxG48RmZrIXsgyl6PxQDjM724lVI2gjSQG2zIugT7QDn41OuZdEFKnVf5jPslt9zMl39CwnDhNiMSFBLKfaT6X6N9LcDU7N0vDw2Xp8YOj6RhKFxNUAVNYQ"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthJwt, ApiUrl: c.AuthAPIURL}, auth)
+		assert.IsType(t, &jwtAuthenticator{}, auth)
+		assert.Equal(t, c.AuthAPIURL, auth.(*jwtAuthenticator).ApiUrl)
+		assert.Nil(t, auth.(*jwtAuthenticator).Verifier)
 	})
 
 	t.Run("discovers Password for auth", func(t *testing.T) {
 		token := "aPasswordString"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthPassword}, auth)
+		assert.Equal(t, &passwordAuthenticator{}, auth)
 	})
 
 	t.Run("short token supported", func(t *testing.T) {
 		token := "sbp"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthPassword}, auth)
+		assert.Equal(t, &passwordAuthenticator{}, auth)
 	})
 
 	t.Run("bad PAT treated as password", func(t *testing.T) {
 		token := "sbp_1112223336d4dddd54e6"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		assert.Equal(t, &authenticator{AuthMethod: AuthPassword}, auth)
+		assert.Equal(t, &passwordAuthenticator{}, auth)
 	})
 }
 
@@ -81,9 +89,9 @@ func TestAuthenticate_authApi(t *testing.T) {
 		ctx := context.Background()
 		ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
 		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		err = auth.Authenticate(ctx, "postgres", token)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
 		assert.NoError(t, err)
 		defer mockServer.Close()
 	})
@@ -100,9 +108,9 @@ func TestAuthenticate_authApi(t *testing.T) {
 		ctx := context.Background()
 		ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
 		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		err = auth.Authenticate(ctx, "", token)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "", Token: token})
 		assert.Error(t, err)
 		assert.ErrorContains(t, err, "empty username")
 		defer mockServer.Close()
@@ -120,11 +128,250 @@ func TestAuthenticate_authApi(t *testing.T) {
 		ctx := context.Background()
 		ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
 		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
-		auth, err := discoverAuthenticator(ctx, c, token)
+		auth, err := mustRegistry(t, c).discover(token)
 		assert.NoError(t, err)
-		err = auth.Authenticate(ctx, "postgres", token)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
 		assert.Error(t, err)
 		assert.ErrorContains(t, err, "not permitted to assume postgres")
 		defer mockServer.Close()
 	})
+	t.Run("grant carries expiry from the API", func(t *testing.T) {
+		expiresAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		validUser := &UserPermissionSet{UserId: "99cf6d1d-7c39-46b4-bc58-688f6dd897ad", Role: UserRole{Role: "postgres", ExpiresAt: apiTime{expiresAt}}}
+
+		mockServer := mockServer(validUser)
+		defer mockServer.Close()
+
+		c := &config{
+			AuthAPIURL: mockServer.URL,
+		}
+		ctx := context.Background()
+		ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
+		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		g, err := auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.NoError(t, err)
+		assert.True(t, expiresAt.Equal(g.ExpiresAt))
+		g.ExpiresAt = expiresAt
+		assert.Equal(t, &grant{Role: "postgres", UserId: validUser.UserId, Method: AuthPat, ExpiresAt: expiresAt}, g)
+	})
+
+	t.Run("fails when grant has expired", func(t *testing.T) {
+		validUser := &UserPermissionSet{UserId: "99cf6d1d-7c39-46b4-bc58-688f6dd897ad", Role: UserRole{Role: "postgres", ExpiresAt: apiTime{time.Now().Add(-time.Minute)}}}
+
+		mockServer := mockServer(validUser)
+		defer mockServer.Close()
+
+		c := &config{
+			AuthAPIURL: mockServer.URL,
+		}
+		ctx := context.Background()
+		ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
+		token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorIs(t, err, errGrantExpired)
+	})
+}
+
+func mockServerJSON(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestAuthenticate_authApiRoles(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rhostKey, "10.0.0.2")
+	token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+	future := time.Now().Add(time.Hour).UnixMilli()
+	past := time.Now().Add(-time.Hour).UnixMilli()
+
+	authenticate := func(t *testing.T, body, user string) (*grant, error) {
+		mockServer := mockServerJSON(body)
+		defer mockServer.Close()
+
+		auth, err := mustRegistry(t, &config{AuthAPIURL: mockServer.URL}).discover(token)
+		assert.NoError(t, err)
+		return auth.Authenticate(ctx, &authRequest{User: user, Token: token})
+	}
+
+	t.Run("picks the matching role from user_roles", func(t *testing.T) {
+		body := fmt.Sprintf(`{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_roles":[
+			{"role":"supabase_read_only_user","expires_at":"%d"},
+			{"role":"postgres","expires_at":"%d"}]}`, future, future)
+		g, err := authenticate(t, body, "postgres")
+		assert.NoError(t, err)
+		assert.Equal(t, "postgres", g.Role)
+		assert.Equal(t, "2256c8fe-95a6-4554-a2e3-0e6a095b72d7", g.UserId)
+		assert.Equal(t, future, g.ExpiresAt.UnixMilli())
+	})
+
+	t.Run("drops expired entries", func(t *testing.T) {
+		body := fmt.Sprintf(`{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_roles":[
+			{"role":"postgres","expires_at":"%d"},
+			{"role":"postgres","expires_at":"%d"}]}`, past, future)
+		g, err := authenticate(t, body, "postgres")
+		assert.NoError(t, err)
+		assert.Equal(t, future, g.ExpiresAt.UnixMilli())
+	})
+
+	t.Run("fails when all matching entries expired", func(t *testing.T) {
+		body := fmt.Sprintf(`{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_roles":[
+			{"role":"postgres","expires_at":"%d"},
+			{"role":"supabase_read_only_user","expires_at":"%d"}]}`, past, future)
+		_, err := authenticate(t, body, "postgres")
+		assert.ErrorIs(t, err, errGrantExpired)
+	})
+
+	t.Run("fails when no entry matches", func(t *testing.T) {
+		body := fmt.Sprintf(`{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_roles":[
+			{"role":"supabase_read_only_user","expires_at":"%d"}]}`, future)
+		_, err := authenticate(t, body, "postgres")
+		assert.ErrorContains(t, err, "not permitted to assume postgres")
+	})
+
+	t.Run("fails on empty user_roles", func(t *testing.T) {
+		_, err := authenticate(t, `{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_roles":[]}`, "postgres")
+		assert.ErrorContains(t, err, "not permitted to assume postgres")
+	})
+
+	t.Run("accepts legacy user_role", func(t *testing.T) {
+		g, err := authenticate(t, `{"user_id":"2256c8fe-95a6-4554-a2e3-0e6a095b72d7","user_role":{"role":"postgres"}}`, "postgres")
+		assert.NoError(t, err)
+		assert.Equal(t, "postgres", g.Role)
+		assert.True(t, g.ExpiresAt.IsZero())
+	})
+}
+
+func TestAuthenticate_errors(t *testing.T) {
+	ctx := context.WithValue(context.Background(), rhostKey, "10.0.0.2")
+	token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	statusServer := func(status int, body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}))
+	}
+	authenticate := func(c *config) error {
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		return err
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   error
+	}{
+		{"no JIT access setup", http.StatusNotAcceptable, "", errPermDenied},
+		{"restricted", http.StatusForbidden, "", errPermDenied},
+		{"invalid token", http.StatusUnauthorized, "", errAuthFailed},
+		{"API error", http.StatusBadGateway, "", errAuthInfoUnavailable},
+		{"malformed JSON", http.StatusOK, "{not json", errAuthInfoUnavailable},
+		{"role not granted", http.StatusOK, `{"user_roles":[{"role":"supabase_read_only_user"}]}`, errPermDenied},
+		{"grant expired", http.StatusOK, `{"user_roles":[{"role":"postgres","expires_at":"1"}]}`, errCredExpired},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := statusServer(tc.status, tc.body)
+			defer server.Close()
+			assert.ErrorIs(t, authenticate(&config{AuthAPIURL: server.URL}), tc.want)
+		})
+	}
+
+	t.Run("API unreachable", func(t *testing.T) {
+		server := statusServer(http.StatusOK, "")
+		server.Close()
+		assert.ErrorIs(t, authenticate(&config{AuthAPIURL: server.URL}), errAuthInfoUnavailable)
+	})
+
+	t.Run("malformed client config", func(t *testing.T) {
+		err := authenticate(&config{AuthAPIURL: "https://mocked.api", APIClient: httpClientConfig{CABundle: "/nonexistent/ca.pem"}})
+		assert.ErrorIs(t, err, errServiceConfig)
+	})
+}
+
+// fakePostgres answers every startup message with an ErrorResponse carrying the given SQLSTATE
+func fakePostgres(t *testing.T, code, message string) (string, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var length uint32
+			if err := binary.Read(conn, binary.BigEndian, &length); err == nil {
+				_, _ = io.CopyN(io.Discard, conn, int64(length)-4)
+			}
+			fields := "SFATAL\x00C" + code + "\x00M" + message + "\x00\x00"
+			msg := []byte{'E', 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(msg[1:], uint32(len(fields)+4))
+			_, _ = conn.Write(append(msg, fields...))
+			conn.Close()
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func TestAuthenticate_authPassword(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("quotes every connection parameter", func(t *testing.T) {
+		cfg := passwordConfig{}.withDefaults()
+		dsn := cfg.dsn("postgres", `pass host=evil.example.com dbname='x' \`)
+		assert.Equal(t, `host='127.0.0.1' port='5432' dbname='authdbsupabase' user='postgres' password='pass host=evil.example.com dbname=\'x\' \\' sslmode='disable' connect_timeout='5'`, dsn)
+	})
+
+	t.Run("uses the unix socket directory", func(t *testing.T) {
+		cfg := passwordConfig{SocketDir: "/run/postgresql", Port: 6543, Database: "sentinel", Timeout: 1500 * time.Millisecond}.withDefaults()
+		dsn := cfg.dsn("postgres", "secret")
+		assert.Equal(t, `host='/run/postgresql' port='6543' dbname='sentinel' user='postgres' password='secret' sslmode='disable' connect_timeout='2'`, dsn)
+	})
+
+	for _, tc := range []struct {
+		name string
+		code string
+		want error
+	}{
+		{"wrong password", "28P01", errAuthFailed},
+		{"not permitted to login", "28000", errPermDenied},
+		{"other error", "53300", errAuthFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			host, port := fakePostgres(t, tc.code, "nope")
+			auth, err := mustRegistry(t, &config{Password: passwordConfig{Host: host, Port: port}}).discover("aPasswordString")
+			assert.NoError(t, err)
+			_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: "aPasswordString"})
+			assert.ErrorIs(t, err, tc.want)
+		})
+	}
+
+	t.Run("sentinel database missing means the password is valid", func(t *testing.T) {
+		host, port := fakePostgres(t, "3D000", `database "authdbsupabase" does not exist`)
+		auth, err := mustRegistry(t, &config{Password: passwordConfig{Host: host, Port: port}}).discover("aPasswordString")
+		assert.NoError(t, err)
+		g, err := auth.Authenticate(ctx, &authRequest{User: "postgres", Token: "aPasswordString"})
+		assert.NoError(t, err)
+		assert.Equal(t, &grant{Role: "postgres", Method: AuthPassword}, g)
+	})
+
+	t.Run("database unreachable", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+
+		err = authPassword(ctx, passwordConfig{Port: port}, "postgres", "aPasswordString")
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+	})
 }
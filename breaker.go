@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultBreakerCooldown = 30 * time.Second
+	defaultBreakerPath     = "/run/jit-gatekeeper/breaker.json"
+)
+
+// breakerConfig configures the circuit breaker in front of the API, shared by every process using the same Path
+type breakerConfig struct {
+	// consecutive requests to the API that failed before it is no longer asked, 0 disables the breaker
+	Threshold int
+	// how long the breaker stays open before a single login is let through to probe the API
+	Cooldown time.Duration
+	// path of the store the state is kept in
+	Path string
+}
+
+// breakerState is the state of the breaker. It is closed while OpenUntil is
+// zero, open until OpenUntil and half-open after it, when the first login
+// probes the API and the others keep failing until ProbeUntil.
+type breakerState struct {
+	Failures   int       `json:"failures"`
+	OpenUntil  time.Time `json:"open_until,omitzero"`
+	ProbeUntil time.Time `json:"probe_until,omitzero"`
+}
+
+// circuitBreaker fails logins fast while the API is down, instead of every
+// backend of a connection storm waiting for it to time out
+type circuitBreaker struct {
+	config breakerConfig
+	store  *fileStore[breakerState]
+}
+
+// newCircuitBreaker returns nil when the breaker is disabled
+func newCircuitBreaker(cfg breakerConfig) *circuitBreaker {
+	if cfg.Threshold <= 0 {
+		return nil
+	}
+	return &circuitBreaker{config: cfg, store: &fileStore[breakerState]{Path: cfg.Path}}
+}
+
+// allow returns errAuthInfoUnavailable when the API should not be asked. A
+// broken store must not stop logins, it lets them through.
+func (b *circuitBreaker) allow(ctx context.Context, now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	_, sp := startSpan(ctx, "circuit_breaker")
+	var refused error
+	var closed bool
+	err := b.store.view(func(s *breakerState) error {
+		closed = s.OpenUntil.IsZero()
+		return nil
+	})
+	if err == nil && !closed {
+		err = b.store.update(func(s *breakerState) error {
+			switch {
+			case s.OpenUntil.IsZero():
+				// closed by another login in the meantime
+			case now.Before(s.OpenUntil):
+				refused = fmt.Errorf("%w: circuit breaker open until %s after %d failed requests to the API", errAuthInfoUnavailable, s.OpenUntil.UTC().Format(time.RFC3339), s.Failures)
+			case now.Before(s.ProbeUntil):
+				refused = fmt.Errorf("%w: circuit breaker half-open, another login is probing the API", errAuthInfoUnavailable)
+			default:
+				// this login probes the API, should it never report back another one will after the cooldown
+				s.ProbeUntil = now.Add(b.config.Cooldown)
+			}
+			return nil
+		})
+	}
+	if refused != nil {
+		metricsFrom(ctx).inc(metricBreakerRejections)
+		sp.setAttributes(attr("breaker.state", "open"))
+		sp.finish(refused)
+		return refused
+	}
+	sp.finish(err)
+	return nil
+}
+
+// record counts the outcome of a request to the API. Enough failures in a row
+// open the breaker, a failed probe opens it again and a success closes it.
+func (b *circuitBreaker) record(failed bool, now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	if !failed {
+		// most logins succeed with a closed breaker, there is nothing to write then
+		var clean bool
+		if err := b.store.view(func(s *breakerState) error {
+			clean = *s == breakerState{}
+			return nil
+		}); err != nil || clean {
+			return err
+		}
+	}
+	return b.store.update(func(s *breakerState) error {
+		if !failed {
+			*s = breakerState{}
+			return nil
+		}
+		s.Failures++
+		if s.Failures >= b.config.Threshold || !s.OpenUntil.IsZero() {
+			s.OpenUntil = now.Add(b.config.Cooldown)
+			s.ProbeUntil = time.Time{}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBreaker(t *testing.T, threshold int) *circuitBreaker {
+	return newCircuitBreaker(breakerConfig{Threshold: threshold, Cooldown: 30 * time.Second, Path: filepath.Join(t.TempDir(), "breaker.json")})
+}
+
+func TestBreaker_states(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	t.Run("disabled without a threshold", func(t *testing.T) {
+		b := newCircuitBreaker(breakerConfig{Cooldown: time.Second})
+		assert.Nil(t, b)
+		assert.NoError(t, b.allow(ctx, now))
+		assert.NoError(t, b.record(true, now))
+	})
+
+	t.Run("opens after consecutive failures", func(t *testing.T) {
+		b := newTestBreaker(t, 3)
+		assert.NoError(t, b.record(true, now))
+		assert.NoError(t, b.record(true, now))
+		assert.NoError(t, b.allow(ctx, now))
+
+		assert.NoError(t, b.record(true, now))
+		err := b.allow(ctx, now)
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.ErrorContains(t, err, "circuit breaker open until")
+	})
+
+	t.Run("a success resets the count", func(t *testing.T) {
+		b := newTestBreaker(t, 2)
+		assert.NoError(t, b.record(true, now))
+		assert.NoError(t, b.record(false, now))
+		assert.NoError(t, b.record(true, now))
+		assert.NoError(t, b.allow(ctx, now))
+	})
+
+	t.Run("lets a single probe through after the cooldown", func(t *testing.T) {
+		b := newTestBreaker(t, 1)
+		assert.NoError(t, b.record(true, now))
+		later := now.Add(31 * time.Second)
+
+		assert.NoError(t, b.allow(ctx, later))
+		err := b.allow(ctx, later)
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.ErrorContains(t, err, "half-open")
+
+		// the probe never reported back
+		assert.NoError(t, b.allow(ctx, later.Add(31*time.Second)))
+	})
+
+	t.Run("a successful probe closes the breaker", func(t *testing.T) {
+		b := newTestBreaker(t, 1)
+		assert.NoError(t, b.record(true, now))
+		later := now.Add(31 * time.Second)
+		assert.NoError(t, b.allow(ctx, later))
+		assert.NoError(t, b.record(false, later))
+		assert.NoError(t, b.allow(ctx, later))
+		assert.NoError(t, b.allow(ctx, later))
+	})
+
+	t.Run("a failed probe opens the breaker again", func(t *testing.T) {
+		b := newTestBreaker(t, 1)
+		assert.NoError(t, b.record(true, now))
+		later := now.Add(31 * time.Second)
+		assert.NoError(t, b.allow(ctx, later))
+		assert.NoError(t, b.record(true, later))
+		assert.ErrorContains(t, b.allow(ctx, later.Add(29*time.Second)), "circuit breaker open until")
+	})
+
+	t.Run("is shared through the store", func(t *testing.T) {
+		b := newTestBreaker(t, 1)
+		other := newCircuitBreaker(b.config)
+		assert.NoError(t, b.record(true, now))
+		assert.ErrorIs(t, other.allow(ctx, now), errAuthInfoUnavailable)
+	})
+
+	t.Run("lets logins through when the store is broken", func(t *testing.T) {
+		// a file where the directory of the store should be
+		dir := filepath.Join(t.TempDir(), "run")
+		assert.NoError(t, os.WriteFile(dir, nil, 0600))
+		b := newCircuitBreaker(breakerConfig{Threshold: 1, Cooldown: time.Second, Path: filepath.Join(dir, "breaker.json")})
+		assert.Error(t, b.record(true, now))
+		assert.NoError(t, b.allow(ctx, now))
+	})
+}
+
+func TestBreaker_config(t *testing.T) {
+	c, err := configFromArgs(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, retryPolicy{Retries: defaultAPIRetries, Base: defaultAPIRetryBase, Max: defaultAPIRetryMax}, c.APIClient.Retry)
+	assert.Equal(t, breakerConfig{Cooldown: defaultBreakerCooldown, Path: defaultBreakerPath}, c.APIBreaker)
+	assert.Nil(t, newCircuitBreaker(c.APIBreaker))
+
+	c, err = configFromArgs([]string{"apiRetries=0", "apiRetryMax=5s", "apiBreakerThreshold=5", "apiBreakerCooldown=1m", "apiBreakerPath=/tmp/breaker.json"})
+	assert.NoError(t, err)
+	assert.Equal(t, retryPolicy{Base: defaultAPIRetryBase, Max: 5 * time.Second}, c.APIClient.Retry)
+	assert.Equal(t, breakerConfig{Threshold: 5, Cooldown: time.Minute, Path: "/tmp/breaker.json"}, c.APIBreaker)
+
+	path := writeConfig(t, `
+api:
+  retries: 0
+  retry_base: 50ms
+  breaker:
+    threshold: 3
+    cooldown: 10s
+`)
+	c, err = configFromArgs([]string{"config=" + path})
+	assert.NoError(t, err)
+	assert.Equal(t, retryPolicy{Base: 50 * time.Millisecond, Max: defaultAPIRetryMax}, c.APIClient.Retry)
+	assert.Equal(t, breakerConfig{Threshold: 3, Cooldown: 10 * time.Second, Path: defaultBreakerPath}, c.APIBreaker)
+
+	_, err = configFromArgs([]string{"apiRetries=-1"})
+	assert.ErrorContains(t, err, "invalid apiRetries")
+	_, err = configFromArgs([]string{"config=" + writeConfig(t, "api:\n  retries: -1\n")})
+	assert.ErrorContains(t, err, "invalid api retries: -1")
+	_, err = configFromArgs([]string{"config=" + writeConfig(t, "api:\n  breaker:\n    threshold: -5\n")})
+	assert.ErrorContains(t, err, "invalid api breaker threshold: -5")
+	_, err = configFromArgs([]string{"apiBreakerCooldown=x"})
+	assert.ErrorContains(t, err, "invalid apiBreakerCooldown")
+}
+
+func TestBreaker_authenticate(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		permsHandler(w, r)
+	}))
+	defer server.Close()
+
+	ctx := context.WithValue(context.Background(), rhostKey, "10.0.0.2")
+	token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+	c := &config{
+		AuthAPIURL: server.URL,
+		APIClient:  httpClientConfig{Proxy: "none"},
+		APIBreaker: breakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond, Path: filepath.Join(t.TempDir(), "breaker.json")},
+	}
+	login := func() error {
+		// a new authenticator per login, as every backend has its own
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		return err
+	}
+
+	assert.ErrorContains(t, login(), "failed with status: 500")
+	assert.ErrorContains(t, login(), "failed with status: 500")
+	err := login()
+	assert.ErrorIs(t, err, errAuthInfoUnavailable)
+	assert.ErrorContains(t, err, "circuit breaker open")
+	assert.Equal(t, int32(2), calls.Load())
+
+	down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, login())
+	assert.NoError(t, login())
+	assert.Equal(t, int32(4), calls.Load())
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheDenyTTL = 10 * time.Second
+	defaultCachePath    = "/run/jit-gatekeeper/decisions.json"
+	// upper bound on the number of cached decisions, the ones expiring first are dropped beyond it
+	maxCachedDecisions = 10000
+)
+
+// cacheConfig configures the decision cache shared by every process using the same Path
+type cacheConfig struct {
+	// how long a granted login is cached, 0 disables the cache
+	TTL time.Duration
+	// how long a refused login is cached
+	DenyTTL time.Duration
+	// path of the store the decisions are kept in
+	Path string
+	// path of the HMAC key the cache is keyed with, created when missing. Defaults to <Path>.key
+	KeyFile string
+	// roles whose cached grants are honoured until they expire while the API can't be reached, as globs
+	DegradedRoles []string
+}
+
+// degraded reports whether the cached grants for role may be used while the API can't be reached
+func (c cacheConfig) degraded(role string) bool {
+	return matchRole(c.DegradedRoles, role)
+}
+
+func (c cacheConfig) keyFile() string {
+	if c.KeyFile != "" {
+		return c.KeyFile
+	}
+	return c.Path + ".key"
+}
+
+// cachedDecision is the outcome of a login, either Grant or Error is set
+type cachedDecision struct {
+	// requested role, kept so the decisions for a role can be purged
+	User      string       `json:"user"`
+	Grant     *grant       `json:"grant,omitempty"`
+	Error     *errorRecord `json:"error,omitempty"`
+	ExpiresAt time.Time    `json:"expires_at"`
+	// the grant is honoured until then while the API can't be reached, zero when it isn't
+	StaleUntil time.Time `json:"stale_until,omitzero"`
+}
+
+// keepUntil is when the decision is no longer of any use
+func (d *cachedDecision) keepUntil() time.Time {
+	if d.StaleUntil.After(d.ExpiresAt) {
+		return d.StaleUntil
+	}
+	return d.ExpiresAt
+}
+
+func (d *cachedDecision) result() (*grant, error) {
+	if d.Error != nil {
+		return nil, d.Error
+	}
+	return d.Grant, nil
+}
+
+// decisionCache remembers logins so that a storm of connections with the
+// same token only asks the API once. Entries are keyed by an HMAC of the
+// token, user and rhost, so the store never holds anything a token can be
+// recovered from.
+type decisionCache struct {
+	config cacheConfig
+	store  *fileStore[map[string]*cachedDecision]
+
+	// loaded on first use, gatekeeperd looks up decisions concurrently
+	mu  sync.Mutex
+	key []byte
+}
+
+func newDecisionCache(cfg cacheConfig) *decisionCache {
+	return &decisionCache{config: cfg, store: &fileStore[map[string]*cachedDecision]{Path: cfg.Path}}
+}
+
+// cacheable reports whether the outcome of a login with method may be cached.
+// Passwords are checked locally and a changed password must take effect at
+// once, and failures to reach the API or a misconfiguration are not decisions.
+func cacheable(method AuthMethod, err error) bool {
+	if method == AuthPassword {
+		return false
+	}
+	return !errors.Is(err, errAuthInfoUnavailable) && !errors.Is(err, errServiceConfig)
+}
+
+func (c *decisionCache) entryKey(req *loginRequest) (string, error) {
+	c.mu.Lock()
+	if c.key == nil {
+		key, err := loadOrCreateKey(c.config.keyFile())
+		if err != nil {
+			c.mu.Unlock()
+			return "", err
+		}
+		c.key = key
+	}
+	c.mu.Unlock()
+
+	mac := hmac.New(sha256.New, c.key)
+	for _, part := range []string{req.User, req.Rhost, req.Token} {
+		mac.Write([]byte(part))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// lookup returns the cached decision for the login, if there is one that has not expired
+func (c *decisionCache) lookup(req *loginRequest, now time.Time) (*cachedDecision, error) {
+	key, err := c.entryKey(req)
+	if err != nil {
+		return nil, err
+	}
+	var found *cachedDecision
+	err = c.store.view(func(entries *map[string]*cachedDecision) error {
+		if d, ok := (*entries)[key]; ok && now.Before(d.ExpiresAt) {
+			found = d
+		}
+		return nil
+	})
+	return found, err
+}
+
+// lookupStale returns the cached grant for the login that may be honoured while the API can't be reached
+func (c *decisionCache) lookupStale(req *loginRequest, now time.Time) (*cachedDecision, error) {
+	key, err := c.entryKey(req)
+	if err != nil {
+		return nil, err
+	}
+	var found *cachedDecision
+	err = c.store.view(func(entries *map[string]*cachedDecision) error {
+		if d, ok := (*entries)[key]; ok && d.Grant != nil && now.Before(d.StaleUntil) {
+			found = d
+		}
+		return nil
+	})
+	return found, err
+}
+
+// add caches the outcome of the login, until the grant or token expires when that is sooner than the TTL.
+// Grants of degraded roles are kept until they expire. A refusal replaces the grant cached for the login.
+func (c *decisionCache) add(req *loginRequest, g *grant, authErr error, now time.Time) error {
+	key, err := c.entryKey(req)
+	if err != nil {
+		return err
+	}
+
+	// the token's own expiry, the signature may not have been checked but the exp can only make the entry shorter lived
+	var tokenExpiry time.Time
+	if looksLikeJWT(req.Token) {
+		if p, err := parseJWT(req.Token); err == nil && p.Claims.ExpiresAt != nil {
+			tokenExpiry = p.Claims.ExpiresAt.Time()
+		}
+	}
+	d := &cachedDecision{User: req.User, Grant: g, ExpiresAt: earliest(now.Add(c.config.TTL), tokenExpiry)}
+	if authErr != nil {
+		d.Grant = nil
+		d.Error = newErrorRecord(authErr)
+		d.ExpiresAt = earliest(now.Add(c.config.DenyTTL), tokenExpiry)
+	} else if !g.ExpiresAt.IsZero() {
+		d.ExpiresAt = earliest(d.ExpiresAt, g.ExpiresAt)
+		// grants that never expire are not honoured without the API, there would be no end to it
+		if c.config.degraded(req.User) {
+			d.StaleUntil = earliest(g.ExpiresAt, tokenExpiry)
+		}
+	}
+
+	return c.store.update(func(entries *map[string]*cachedDecision) error {
+		if *entries == nil {
+			*entries = map[string]*cachedDecision{}
+		}
+		pruneDecisions(*entries, now)
+		if now.Before(d.keepUntil()) {
+			(*entries)[key] = d
+		} else {
+			delete(*entries, key)
+		}
+		return nil
+	})
+}
+
+// earliest returns the earlier of t and limit, or t when limit is zero
+func earliest(t, limit time.Time) time.Time {
+	if !limit.IsZero() && limit.Before(t) {
+		return limit
+	}
+	return t
+}
+
+// purge drops the cached decisions for user, or all of them when user is empty, and returns how many were dropped
+func (c *decisionCache) purge(user string) (int, error) {
+	purged := 0
+	err := c.store.update(func(entries *map[string]*cachedDecision) error {
+		for key, d := range *entries {
+			if user == "" || d.User == user {
+				delete(*entries, key)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
+
+// pruneDecisions drops expired decisions, and the ones expiring first when there are too many
+func pruneDecisions(entries map[string]*cachedDecision, now time.Time) {
+	for key, d := range entries {
+		if !now.Before(d.keepUntil()) {
+			delete(entries, key)
+		}
+	}
+	if len(entries) < maxCachedDecisions {
+		return
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		return entries[a].keepUntil().Compare(entries[b].keepUntil())
+	})
+	for _, key := range keys[:len(keys)-maxCachedDecisions+1] {
+		delete(entries, key)
+	}
+}
+
+// loadOrCreateKey reads the HMAC key at path, creating a random one when it does not exist.
+// Processes racing to create it all end up with the one created first.
+func loadOrCreateKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("key %s is shorter than 32 bytes", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read key: %w", err)
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(key); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	// link fails when another process created the key first, in which case that one is used
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return loadOrCreateKey(path)
+		}
+		return nil, fmt.Errorf("failed to create key: %w", err)
+	}
+	return key, nil
+}
+
+// runCache is gatekeeper cache, purge drops cached decisions so the next login of everyone, or of -user, is checked again
+func runCache(args []string) int {
+	if len(args) == 0 || args[0] != "purge" {
+		fmt.Fprintln(os.Stderr, "usage: gatekeeper cache purge [-config path] [-user role]")
+		return 2
+	}
+	flags := flag.NewFlagSet("cache purge", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	user := flags.String("user", "", "only purge the decisions for this role")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := configFromArgs([]string{"config=" + *configPath})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	cache := newDecisionCache(cfg.Cache)
+	cache.store.Existing = true
+	purged, err := cache.purge(*user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to purge cache: %v\n", err)
+		return 1
+	}
+	fmt.Printf("purged %d cached decisions\n", purged)
+	return 0
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(t *testing.T) *decisionCache {
+	return newDecisionCache(cacheConfig{TTL: 5 * time.Minute, DenyTTL: 10 * time.Second, Path: filepath.Join(t.TempDir(), "decisions.json")})
+}
+
+func TestCache_decisions(t *testing.T) {
+	now := time.Now()
+	req := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"}
+
+	t.Run("caches grants without the token", func(t *testing.T) {
+		c := newTestCache(t)
+		g := &grant{Role: "postgres", Method: AuthPat}
+		assert.NoError(t, c.add(req, g, nil, now))
+
+		d, err := c.lookup(req, now.Add(time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, g, d.Grant)
+
+		data, err := os.ReadFile(c.config.Path)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), req.Token)
+	})
+
+	t.Run("keys on user, rhost and token", func(t *testing.T) {
+		c := newTestCache(t)
+		assert.NoError(t, c.add(req, &grant{Role: "postgres", Method: AuthPat}, nil, now))
+
+		for _, other := range []loginRequest{
+			{User: "supabase_admin", Rhost: req.Rhost, Token: req.Token},
+			{User: req.User, Rhost: "10.0.0.3", Token: req.Token},
+			{User: req.User, Rhost: req.Rhost, Token: req.Token + "x"},
+		} {
+			d, err := c.lookup(&other, now)
+			assert.NoError(t, err)
+			assert.Nil(t, d)
+		}
+	})
+
+	t.Run("expires with the ttl", func(t *testing.T) {
+		c := newTestCache(t)
+		assert.NoError(t, c.add(req, &grant{Role: "postgres", Method: AuthPat}, nil, now))
+		d, err := c.lookup(req, now.Add(5*time.Minute))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+	})
+
+	t.Run("expires with the grant", func(t *testing.T) {
+		c := newTestCache(t)
+		assert.NoError(t, c.add(req, &grant{Role: "postgres", Method: AuthPat, ExpiresAt: now.Add(time.Minute)}, nil, now))
+		d, err := c.lookup(req, now.Add(time.Minute))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+	})
+
+	t.Run("expires with the jwt", func(t *testing.T) {
+		c := newTestCache(t)
+		exp := now.Add(30 * time.Second).Unix()
+		jwtReq := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: newTestSigner(t, "ES256").sign(t, map[string]any{"exp": exp})}
+		assert.NoError(t, c.add(jwtReq, &grant{Role: "postgres", Method: AuthJwt}, nil, now))
+
+		d, err := c.lookup(jwtReq, now.Add(10*time.Second))
+		assert.NoError(t, err)
+		assert.NotNil(t, d)
+		d, err = c.lookup(jwtReq, time.Unix(exp, 0))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+	})
+
+	t.Run("caches denials briefly", func(t *testing.T) {
+		c := newTestCache(t)
+		assert.NoError(t, c.add(req, nil, fmt.Errorf("%w: not permitted to assume postgres", errPermDenied), now))
+
+		d, err := c.lookup(req, now.Add(5*time.Second))
+		assert.NoError(t, err)
+		_, authErr := d.result()
+		assert.ErrorIs(t, authErr, errPermDenied)
+		assert.EqualError(t, authErr, "permission denied: not permitted to assume postgres")
+
+		d, err = c.lookup(req, now.Add(10*time.Second))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+	})
+
+	t.Run("does not cache passwords or unavailability", func(t *testing.T) {
+		assert.True(t, cacheable(AuthPat, errPermDenied))
+		assert.False(t, cacheable(AuthPassword, nil))
+		assert.False(t, cacheable(AuthPat, fmt.Errorf("%w: failed with status: 503", errAuthInfoUnavailable)))
+		assert.False(t, cacheable(AuthJwt, errServiceConfig))
+	})
+
+	t.Run("purges by user or everything", func(t *testing.T) {
+		c := newTestCache(t)
+		admin := &loginRequest{User: "supabase_admin", Rhost: req.Rhost, Token: req.Token}
+		assert.NoError(t, c.add(req, &grant{Role: "postgres", Method: AuthPat}, nil, now))
+		assert.NoError(t, c.add(admin, &grant{Role: "supabase_admin", Method: AuthPat}, nil, now))
+
+		purged, err := c.purge("postgres")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, purged)
+		d, _ := c.lookup(admin, now)
+		assert.NotNil(t, d)
+
+		purged, err = c.purge("")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, purged)
+		d, _ = c.lookup(admin, now)
+		assert.Nil(t, d)
+	})
+
+	t.Run("keeps grants of degraded roles until they expire", func(t *testing.T) {
+		c := newTestCache(t)
+		c.config.DegradedRoles = []string{"post*"}
+		g := &grant{Role: "postgres", Method: AuthPat, ExpiresAt: now.Add(time.Hour)}
+		assert.NoError(t, c.add(req, g, nil, now))
+
+		d, err := c.lookup(req, now.Add(30*time.Minute))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+		d, err = c.lookupStale(req, now.Add(30*time.Minute))
+		assert.NoError(t, err)
+		if assert.NotNil(t, d) {
+			assert.True(t, g.ExpiresAt.Equal(d.Grant.ExpiresAt))
+		}
+		d, err = c.lookupStale(req, now.Add(time.Hour))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+
+		// grants that never expire, and other roles, are only cached for the ttl
+		admin := &loginRequest{User: "supabase_admin", Rhost: req.Rhost, Token: req.Token}
+		assert.NoError(t, c.add(admin, &grant{Role: "supabase_admin", Method: AuthPat, ExpiresAt: now.Add(time.Hour)}, nil, now))
+		forever := &loginRequest{User: "postgres", Rhost: "10.0.0.3", Token: req.Token}
+		assert.NoError(t, c.add(forever, &grant{Role: "postgres", Method: AuthPat}, nil, now))
+		for _, r := range []*loginRequest{admin, forever} {
+			d, err = c.lookupStale(r, now.Add(30*time.Minute))
+			assert.NoError(t, err)
+			assert.Nil(t, d)
+		}
+	})
+
+	t.Run("refusals drop the grant", func(t *testing.T) {
+		c := newTestCache(t)
+		c.config.DegradedRoles = []string{"postgres"}
+		c.config.DenyTTL = 0
+		assert.NoError(t, c.add(req, &grant{Role: "postgres", Method: AuthPat, ExpiresAt: now.Add(time.Hour)}, nil, now))
+		assert.NoError(t, c.add(req, nil, fmt.Errorf("%w: user not authorized due to restriction", errPermDenied), now.Add(10*time.Minute)))
+
+		d, err := c.lookupStale(req, now.Add(20*time.Minute))
+		assert.NoError(t, err)
+		assert.Nil(t, d)
+	})
+
+	t.Run("is shared between processes", func(t *testing.T) {
+		c := newTestCache(t)
+		var wg sync.WaitGroup
+		for i := range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// a cache per goroutine, like one per backend, sharing the store and key
+				other := newDecisionCache(c.config)
+				user := fmt.Sprintf("user%d", i)
+				assert.NoError(t, other.add(&loginRequest{User: user, Token: req.Token}, &grant{Role: user, Method: AuthPat}, nil, now))
+			}()
+		}
+		wg.Wait()
+
+		for i := range 20 {
+			user := fmt.Sprintf("user%d", i)
+			d, err := c.lookup(&loginRequest{User: user, Token: req.Token}, now)
+			assert.NoError(t, err)
+			assert.NotNil(t, d, user)
+		}
+	})
+}
+
+func TestCache_gatekeeper(t *testing.T) {
+	var calls atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		permsHandler(w, r)
+	}))
+	defer api.Close()
+
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "cacheTtl=1m", "cachePath=" + filepath.Join(t.TempDir(), "decisions.json")})
+	assert.NoError(t, err)
+	ctx := context.Background()
+	req := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"}
+
+	for range 3 {
+		// a gatekeeper per login, like the PAM module
+		gk, err := newGatekeeper(cfg, discardLog)
+		assert.NoError(t, err)
+		g, err := gk.Authenticate(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, "postgres", g.Role)
+	}
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestCache_degraded(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(&UserPermissionSet{UserId: "user-1", Roles: []UserRole{{Role: "postgres", ExpiresAt: apiTime{time.Now().Add(time.Hour)}}, {Role: "reader", ExpiresAt: apiTime{time.Now().Add(time.Hour)}}}})
+	}))
+	defer api.Close()
+
+	dir := t.TempDir()
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "cacheTtl=1ms", "cacheDenyTtl=1ms", "cachePath=" + filepath.Join(dir, "decisions.json"), "degradedRoles=postgres", "audit=" + filepath.Join(dir, "audit.log"), "metricsTextfile=" + dir, "metricsPath=" + filepath.Join(dir, "metrics.json")})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+	postgres := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: pat}
+	reader := &loginRequest{User: "reader", Rhost: "10.0.0.2", Token: pat}
+
+	for _, req := range []*loginRequest{postgres, reader} {
+		g, err := gk.Authenticate(ctx, req)
+		assert.NoError(t, err)
+		assert.Empty(t, g.Degraded)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	status.Store(http.StatusServiceUnavailable)
+	g, err := gk.Authenticate(ctx, postgres)
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres", g.Role)
+	assert.Equal(t, "authentication information unavailable: failed with status: 503", g.Degraded)
+	// not a degraded role
+	_, err = gk.Authenticate(ctx, reader)
+	assert.ErrorIs(t, err, errAuthInfoUnavailable)
+
+	// once the API refuses the grant it is no longer honoured
+	status.Store(http.StatusForbidden)
+	_, err = gk.Authenticate(ctx, postgres)
+	assert.ErrorIs(t, err, errPermDenied)
+	time.Sleep(5 * time.Millisecond)
+	status.Store(http.StatusServiceUnavailable)
+	_, err = gk.Authenticate(ctx, postgres)
+	assert.ErrorIs(t, err, errAuthInfoUnavailable)
+
+	prom, err := os.ReadFile(filepath.Join(dir, metricsTextfileName))
+	assert.NoError(t, err)
+	assert.Contains(t, string(prom), `jit_gatekeeper_decisions_total{method="pat",result="allow_degraded"} 1`)
+	assert.Contains(t, string(prom), `jit_gatekeeper_cache_lookups_total{result="stale_hit"} 1`)
+	audit, err := os.ReadFile(filepath.Join(dir, "audit.log"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(audit), `"reason":"degraded mode, cached grant honoured: authentication information unavailable: failed with status: 503"`)
+
+	_, err = configFromArgs([]string{"degradedRoles=["})
+	assert.ErrorContains(t, err, "invalid role pattern")
+	cfg, err = configFromArgs([]string{"degradedRoles=postgres"})
+	assert.NoError(t, err)
+	assert.EqualError(t, cfg.validate(), "degradedRoles is set but cacheTtl is not")
+}
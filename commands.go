@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// commands of the gatekeeper executable, run as gatekeeper <command> [args]
+var commands = map[string]func(args []string) int{
+	"daemon":  runDaemon,
+	"cache":   runCache,
+	"lockout": runLockout,
+	"audit":   runAudit,
+	"roles":   runRoles,
+	"reaper":  runReaper,
+	"whois":   runWhois,
+}
+
+// runCommand runs the command named by args[1], or gatekeeperd when the executable is called that
+func runCommand(args []string) int {
+	if filepath.Base(args[0]) == "gatekeeperd" {
+		return runDaemon(args[1:])
+	}
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s <command> [args]\n", filepath.Base(args[0]))
+		return 2
+	}
+	command, ok := commands[args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[1])
+		return 2
+	}
+	return command(args[2:])
+}
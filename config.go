@@ -2,19 +2,131 @@ package main
 
 import (
 	"fmt"
+	"log/syslog"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// deadlines for requests to the API when none are configured
+const (
+	defaultAPITimeout        = 10 * time.Second
+	defaultAPIConnectTimeout = 3 * time.Second
+	defaultAPITLSTimeout     = 3 * time.Second
+)
+
+// deadline for a login forwarded to gatekeeperd, it covers the API and password deadlines
+const defaultDaemonTimeout = 15 * time.Second
+
 type config struct {
 	// Trust local connections, emulating the trust you could set via pg_hba.conf
 	TrustLocal bool
 
+	// Additional networks that are trusted, like TrustLocal these skip authentication
+	TrustRules []trustRule
+
+	// When set, only roles matching these globs can be reached through a trusted connection
+	TrustRoles []string
+
 	// URL for the API to authenticate against (PAT and JWT)
 	AuthAPIURL string
+
+	// Enabled authentication methods, in the order they are tried. Empty for the default order.
+	AuthMethods []AuthMethod
+
+	// Authentication methods permitted per role, checked before the token is authenticated
+	RoleMethods []roleMethodRule
+
+	// Assurance required of JWT logins per role, checked once the token is authenticated
+	RoleAssurance []roleAssuranceRule
+
+	// Deadlines, TLS, proxy and retry settings for requests to the API
+	APIClient httpClientConfig
+
+	// Circuit breaker failing logins fast while the API is down
+	APIBreaker breakerConfig
+
+	// Connection used to check passwords against the local database
+	Password passwordConfig
+
+	// Roles created for the user on login, instead of logging in as a shared role
+	Ephemeral ephemeralConfig
+
+	// URL of the JWKS used to verify JWTs locally, instead of sending them to the API
+	JWKSURL string
+
+	// Path of the file the fetched JWKS is cached in, so JWT logins survive the JWKS endpoint being down
+	JWKSCachePath string
+
+	// Expected issuer (iss claim) of locally verified JWTs
+	JWTIssuer string
+
+	// Path to the YAML file mapping JWT identities (email or sub) to Postgres roles
+	MappingsPath string
+
+	// Path to the YAML policy further restricting granted logins, empty for none
+	PolicyPath string
+
+	// Cache of login decisions shared by all processes
+	Cache cacheConfig
+
+	// Lockout and tarpit for failed logins
+	Lockout lockoutConfig
+
+	// Who every backend logged in as, for gatekeeper whois and the reaper
+	Sessions sessionsConfig
+
+	// JSON Lines log of every decision
+	Audit auditConfig
+
+	// Prometheus metrics shared by all processes
+	Metrics metricsConfig
+
+	// OpenTelemetry tracing of the authentication path
+	Tracing tracingConfig
+
+	// gatekeeperd, and whether the PAM module forwards logins to it
+	Daemon daemonConfig
+
+	// Least severe priority that is written to syslog
+	LogLevel syslog.Priority
+
+	// problems with the options that don't stop them from being used, logged once the config is loaded
+	Warnings []string
 }
 
 func configFromArgs(args []string) (*config, error) {
-	c := &config{}
+	c := &config{
+		APIClient: httpClientConfig{
+			Timeout:             defaultAPITimeout,
+			ConnectTimeout:      defaultAPIConnectTimeout,
+			TLSHandshakeTimeout: defaultAPITLSTimeout,
+			Retry:               retryPolicy{Retries: defaultAPIRetries, Base: defaultAPIRetryBase, Max: defaultAPIRetryMax},
+		},
+		APIBreaker: breakerConfig{Cooldown: defaultBreakerCooldown, Path: defaultBreakerPath},
+		Cache:      cacheConfig{DenyTTL: defaultCacheDenyTTL, Path: defaultCachePath},
+		Lockout: lockoutConfig{
+			Base:      defaultLockoutBase,
+			Max:       defaultLockoutMax,
+			Window:    defaultLockoutWindow,
+			TarpitMax: defaultTarpitMax,
+			Path:      defaultLockoutStorePath,
+		},
+		Sessions: sessionsConfig{Path: defaultSessionsPath},
+		Audit:    auditConfig{MaxFiles: defaultAuditMaxFiles, Fsync: auditFsyncAlways},
+		Metrics:  metricsConfig{Path: defaultMetricsPath},
+		Daemon:   daemonConfig{Timeout: defaultDaemonTimeout},
+		LogLevel: syslog.LOG_INFO,
+	}
+
+	// load the config file first, so that the arguments override it
+	for _, arg := range args {
+		if path, ok := strings.CutPrefix(arg, "config="); ok {
+			if err := c.loadFile(path); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	for _, arg := range args {
 		parts := strings.SplitN(arg, "=", 2)
@@ -23,13 +135,316 @@ func configFromArgs(args []string) (*config, error) {
 		}
 
 		switch parts[0] {
+		case "config":
+			// already loaded
 		case "trustLocal":
-			c.TrustLocal = true
+			trust, err := strconv.ParseBool(parts[1])
+			if err != nil {
+				// trustLocal used to enable trust whatever its value, PAM lines written then keep working
+				trust = true
+				c.Warnings = append(c.Warnings, fmt.Sprintf("trustLocal=%s is taken as trustLocal=true, set it to true or false", parts[1]))
+			}
+			c.TrustLocal = trust
+		case "trustCidrs":
+			prefixes, err := parseCIDRs(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range prefixes {
+				c.TrustRules = append(c.TrustRules, trustRule{Prefix: p})
+			}
+		case "trustRoles":
+			roles, err := parseRolePatterns(splitList(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+			c.TrustRoles = roles
 		case "apiUrl":
 			c.AuthAPIURL = parts[1]
+		case "methods":
+			methods, err := parseAuthMethods(splitList(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+			c.AuthMethods = methods
+		case "roleMethods":
+			rules, err := parseRoleMethods(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			c.RoleMethods = append(c.RoleMethods, rules...)
+		case "roleAssurance":
+			rules, err := parseRoleAssurance(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			c.RoleAssurance = append(c.RoleAssurance, rules...)
+		case "apiTimeout", "apiConnectTimeout", "apiTlsTimeout":
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
+			}
+			switch parts[0] {
+			case "apiTimeout":
+				c.APIClient.Timeout = timeout
+			case "apiConnectTimeout":
+				c.APIClient.ConnectTimeout = timeout
+			case "apiTlsTimeout":
+				c.APIClient.TLSHandshakeTimeout = timeout
+			}
+		case "apiCaBundle":
+			c.APIClient.CABundle = parts[1]
+		case "apiClientCert":
+			c.APIClient.ClientCert = parts[1]
+		case "apiClientKey":
+			c.APIClient.ClientKey = parts[1]
+		case "apiPins":
+			c.APIClient.Pins = splitList(parts[1])
+		case "apiProxy":
+			c.APIClient.Proxy = parts[1]
+		case "apiRetries", "apiBreakerThreshold":
+			n, err := strconv.Atoi(parts[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid %s: %v", parts[0], parts[1])
+			}
+			if parts[0] == "apiRetries" {
+				c.APIClient.Retry.Retries = n
+			} else {
+				c.APIBreaker.Threshold = n
+			}
+		case "apiRetryBase", "apiRetryMax", "apiBreakerCooldown":
+			d, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
+			}
+			switch parts[0] {
+			case "apiRetryBase":
+				c.APIClient.Retry.Base = d
+			case "apiRetryMax":
+				c.APIClient.Retry.Max = d
+			case "apiBreakerCooldown":
+				c.APIBreaker.Cooldown = d
+			}
+		case "apiBreakerPath":
+			c.APIBreaker.Path = parts[1]
+		case "passwordHost":
+			c.Password.Host = parts[1]
+		case "passwordPort":
+			port, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid passwordPort: %w", err)
+			}
+			c.Password.Port = port
+		case "passwordSocketDir":
+			c.Password.SocketDir = parts[1]
+		case "passwordDatabase":
+			c.Password.Database = parts[1]
+		case "passwordTimeout":
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid passwordTimeout: %w", err)
+			}
+			c.Password.Timeout = timeout
+		case "ephemeralPrefix":
+			c.Ephemeral.Prefix = parts[1]
+		case "ephemeralUser":
+			c.Ephemeral.User = parts[1]
+		case "ephemeralHost":
+			c.Ephemeral.Conn.Host = parts[1]
+		case "ephemeralPort":
+			port, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid ephemeralPort: %w", err)
+			}
+			c.Ephemeral.Conn.Port = port
+		case "ephemeralSocketDir":
+			c.Ephemeral.Conn.SocketDir = parts[1]
+		case "ephemeralDatabase":
+			c.Ephemeral.Conn.Database = parts[1]
+		case "ephemeralTimeout":
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid ephemeralTimeout: %w", err)
+			}
+			c.Ephemeral.Conn.Timeout = timeout
+		case "jwks":
+			c.JWKSURL = parts[1]
+		case "jwksCache":
+			c.JWKSCachePath = parts[1]
+		case "issuer":
+			c.JWTIssuer = parts[1]
+		case "mappings":
+			c.MappingsPath = parts[1]
+		case "policy":
+			c.PolicyPath = parts[1]
+		case "cacheTtl", "cacheDenyTtl":
+			ttl, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
+			}
+			if parts[0] == "cacheTtl" {
+				c.Cache.TTL = ttl
+			} else {
+				c.Cache.DenyTTL = ttl
+			}
+		case "cachePath":
+			c.Cache.Path = parts[1]
+		case "cacheKeyFile":
+			c.Cache.KeyFile = parts[1]
+		case "degradedRoles":
+			roles, err := parseRolePatterns(splitList(parts[1]))
+			if err != nil {
+				return nil, err
+			}
+			c.Cache.DegradedRoles = roles
+		case "lockoutThreshold", "lockoutRhostThreshold":
+			threshold, err := strconv.Atoi(parts[1])
+			if err != nil || threshold < 0 {
+				return nil, fmt.Errorf("invalid %s: %v", parts[0], parts[1])
+			}
+			if parts[0] == "lockoutThreshold" {
+				c.Lockout.Threshold = threshold
+			} else {
+				c.Lockout.RhostThreshold = threshold
+			}
+		case "lockoutBase", "lockoutMax", "lockoutWindow", "tarpit", "tarpitMax":
+			d, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", parts[0], err)
+			}
+			switch parts[0] {
+			case "lockoutBase":
+				c.Lockout.Base = d
+			case "lockoutMax":
+				c.Lockout.Max = d
+			case "lockoutWindow":
+				c.Lockout.Window = d
+			case "tarpit":
+				c.Lockout.Tarpit = d
+			case "tarpitMax":
+				c.Lockout.TarpitMax = d
+			}
+		case "lockoutPath":
+			c.Lockout.Path = parts[1]
+		case "trackSessions":
+			track, err := strconv.ParseBool(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid trackSessions: %w", err)
+			}
+			c.Sessions.Track = track
+		case "sessionsPath":
+			c.Sessions.Path = parts[1]
+		case "audit":
+			c.Audit.Path = parts[1]
+		case "auditMaxSize":
+			size, err := parseSize(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid auditMaxSize: %w", err)
+			}
+			c.Audit.MaxSize = size
+		case "auditMaxFiles":
+			files, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid auditMaxFiles: %w", err)
+			}
+			c.Audit.MaxFiles = files
+		case "auditFsync":
+			policy, err := parseFsyncPolicy(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			c.Audit.Fsync = policy
+		case "auditKeyFile":
+			c.Audit.KeyFile = parts[1]
+		case "auditSigningKey":
+			c.Audit.SigningKey = parts[1]
+		case "auditCheckpointEvery":
+			every, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid auditCheckpointEvery: %w", err)
+			}
+			c.Audit.CheckpointEvery = every
+		case "metricsTextfile":
+			c.Metrics.Textfile = parts[1]
+		case "metricsPath":
+			c.Metrics.Path = parts[1]
+		case "tracingEndpoint":
+			c.Tracing.Endpoint = parts[1]
+		case "tracingFile":
+			c.Tracing.File = parts[1]
+		case "daemonSocket":
+			c.Daemon.Socket = parts[1]
+		case "daemonFallback":
+			fallback, err := strconv.ParseBool(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid daemonFallback: %w", err)
+			}
+			c.Daemon.Fallback = fallback
+		case "daemonTimeout":
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid daemonTimeout: %w", err)
+			}
+			c.Daemon.Timeout = timeout
+		case "daemonMetricsListen":
+			c.Daemon.MetricsListen = parts[1]
+		case "logLevel":
+			level, err := parseLogLevel(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			c.LogLevel = level
 		default:
 			return nil, fmt.Errorf("unknown option: %v", parts[0])
 		}
 	}
 	return c, nil
 }
+
+// validate checks that options which depend on each other are set together
+func (c *config) validate() error {
+	if c.JWKSURL != "" && c.MappingsPath == "" {
+		return fmt.Errorf("jwks is set but mappings is not")
+	}
+	if c.MappingsPath != "" && c.JWKSURL == "" {
+		return fmt.Errorf("mappings is set but jwks is not")
+	}
+	if len(c.Cache.DegradedRoles) > 0 && c.Cache.TTL == 0 {
+		return fmt.Errorf("degradedRoles is set but cacheTtl is not")
+	}
+	if c.Audit.MaxSize > 0 && c.Audit.MaxFiles < 1 {
+		return fmt.Errorf("auditMaxSize is set but auditMaxFiles is %d, rotating would drop the audit log", c.Audit.MaxFiles)
+	}
+	if c.Audit.SigningKey != "" && c.Audit.Path == "" {
+		return fmt.Errorf("auditSigningKey is set but audit is not")
+	}
+	return nil
+}
+
+func parseLogLevel(level string) (syslog.Priority, error) {
+	switch strings.ToLower(level) {
+	case "error", "err":
+		return syslog.LOG_ERR, nil
+	case "warning", "warn":
+		return syslog.LOG_WARNING, nil
+	case "notice":
+		return syslog.LOG_NOTICE, nil
+	case "info":
+		return syslog.LOG_INFO, nil
+	case "debug":
+		return syslog.LOG_DEBUG, nil
+	default:
+		return 0, fmt.Errorf("unknown log level: %v", level)
+	}
+}
+
+// splitList splits a comma separated argument, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
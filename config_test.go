@@ -0,0 +1,130 @@
+package main
+
+import (
+	"log/syslog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestConfig_fromArgs(t *testing.T) {
+	t.Run("parses pam.d arguments", func(t *testing.T) {
+		c, err := configFromArgs([]string{"apiUrl=https://mocked.api", "apiTimeout=3s", "logLevel=warning"})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://mocked.api", c.AuthAPIURL)
+		assert.Equal(t, 3*time.Second, c.APIClient.Timeout)
+		assert.Equal(t, syslog.LOG_WARNING, c.LogLevel)
+	})
+
+	t.Run("applies defaults", func(t *testing.T) {
+		c, err := configFromArgs(nil)
+		assert.NoError(t, err)
+		assert.Equal(t, defaultAPITimeout, c.APIClient.Timeout)
+		assert.Equal(t, syslog.LOG_INFO, c.LogLevel)
+	})
+
+	t.Run("rejects unknown option", func(t *testing.T) {
+		_, err := configFromArgs([]string{"nope=1"})
+		assert.ErrorContains(t, err, "unknown option: nope")
+	})
+
+	t.Run("rejects malformed arg", func(t *testing.T) {
+		_, err := configFromArgs([]string{"apiUrl"})
+		assert.ErrorContains(t, err, "malformed arg")
+	})
+}
+
+func TestConfig_file(t *testing.T) {
+	t.Run("loads the file", func(t *testing.T) {
+		path := writeConfig(t, `
+trust_local: true
+api:
+  url: https://file.api
+  timeout: 2s
+jwt:
+  jwks: https://auth.example.com/jwks.json
+  issuer: https://auth.example.com
+  mappings: /etc/users.yaml
+logging:
+  level: debug
+`)
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		assert.True(t, c.TrustLocal)
+		assert.Equal(t, "https://file.api", c.AuthAPIURL)
+		assert.Equal(t, 2*time.Second, c.APIClient.Timeout)
+		assert.Equal(t, "https://auth.example.com/jwks.json", c.JWKSURL)
+		assert.Equal(t, "https://auth.example.com", c.JWTIssuer)
+		assert.Equal(t, "/etc/users.yaml", c.MappingsPath)
+		assert.Equal(t, syslog.LOG_DEBUG, c.LogLevel)
+	})
+
+	t.Run("arguments override the file regardless of order", func(t *testing.T) {
+		path := writeConfig(t, "api:\n  url: https://file.api\n  timeout: 2s\n")
+		c, err := configFromArgs([]string{"apiUrl=https://arg.api", "config=" + path})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://arg.api", c.AuthAPIURL)
+		assert.Equal(t, 2*time.Second, c.APIClient.Timeout)
+	})
+
+	t.Run("expands environment variables", func(t *testing.T) {
+		t.Setenv("GATEKEEPER_API_HOST", "env.api")
+		path := writeConfig(t, "api:\n  url: https://${GATEKEEPER_API_HOST}/v1\n")
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://env.api/v1", c.AuthAPIURL)
+	})
+
+	t.Run("fails on unset environment variable", func(t *testing.T) {
+		path := writeConfig(t, "api:\n  url: https://${GATEKEEPER_UNSET_VARIABLE}/v1\n")
+		_, err := configFromArgs([]string{"config=" + path})
+		assert.ErrorContains(t, err, path+":2:8: environment variable GATEKEEPER_UNSET_VARIABLE is not set")
+	})
+
+	t.Run("reads _file indirection", func(t *testing.T) {
+		secret := filepath.Join(t.TempDir(), "url")
+		assert.NoError(t, os.WriteFile(secret, []byte("https://secret.api\n"), 0600))
+		path := writeConfig(t, "api:\n  url_file: "+secret+"\n")
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		assert.Equal(t, "https://secret.api", c.AuthAPIURL)
+	})
+
+	t.Run("rejects key set directly and through _file", func(t *testing.T) {
+		secret := filepath.Join(t.TempDir(), "url")
+		assert.NoError(t, os.WriteFile(secret, []byte("https://secret.api"), 0600))
+		path := writeConfig(t, "api:\n  url: https://file.api\n  url_file: "+secret+"\n")
+		_, err := configFromArgs([]string{"config=" + path})
+		assert.ErrorContains(t, err, path+":3:3: url is set more than once")
+	})
+
+	t.Run("reports position of unknown keys", func(t *testing.T) {
+		path := writeConfig(t, "api:\n  url: https://file.api\n  timeuot: 2s\n")
+		_, err := configFromArgs([]string{"config=" + path})
+		assert.EqualError(t, err, path+`:3:3: unknown key "timeuot" in api`)
+
+		path = writeConfig(t, "apiUrl: https://file.api\n")
+		_, err = configFromArgs([]string{"config=" + path})
+		assert.EqualError(t, err, path+`:1:1: unknown key "apiUrl"`)
+	})
+
+	t.Run("fails on missing file", func(t *testing.T) {
+		_, err := configFromArgs([]string{"config=/nonexistent/config.yaml"})
+		assert.ErrorContains(t, err, "failed to read config")
+	})
+
+	t.Run("rejects invalid log level", func(t *testing.T) {
+		path := writeConfig(t, "logging:\n  level: loud\n")
+		_, err := configFromArgs([]string{"config=" + path})
+		assert.ErrorContains(t, err, "unknown log level: loud")
+	})
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the layout of the file passed with config=. Every value may
+// reference environment variables as ${NAME}, and any key may be given as
+// <key>_file instead, in which case the value is read from that file. The
+// latter keeps secrets out of the config file itself.
+//
+//	methods: [pat, jwt]
+//	role_methods:
+//	  - roles: [postgres, supabase_admin]
+//	    methods: [pat, jwt]
+//	role_assurance:
+//	  - roles: [postgres]
+//	    aal: aal2
+//	    max_age: 15m
+//	api:
+//	  url: https://api.example.com/v1/jit
+//	  timeout: 5s
+//	  ca_bundle: /etc/jit-gatekeeper/ca.pem
+//	  breaker:
+//	    threshold: 5
+//	jwt:
+//	  jwks: https://auth.example.com/auth/v1/.well-known/jwks.json
+//	  mappings: /etc/jit-gatekeeper/users.yaml
+//	logging:
+//	  level: info
+//	trust_cidrs:
+//	  - cidrs: [10.0.0.0/8]
+//	    roles: [app_user]
+type fileConfig struct {
+	Methods       []string                  `yaml:"methods"`
+	RoleMethods   []roleMethodFileConfig    `yaml:"role_methods"`
+	RoleAssurance []roleAssuranceFileConfig `yaml:"role_assurance"`
+	TrustLocal    *bool                     `yaml:"trust_local"`
+	TrustCIDRs    []trustFileConfig         `yaml:"trust_cidrs"`
+	TrustRoles    []string                  `yaml:"trust_roles"`
+	Policy        string                    `yaml:"policy"`
+	API           apiFileConfig             `yaml:"api"`
+	Password      passwordFileConfig        `yaml:"password"`
+	Ephemeral     ephemeralFileConfig       `yaml:"ephemeral"`
+	JWT           jwtFileConfig             `yaml:"jwt"`
+	Cache         cacheFileConfig           `yaml:"cache"`
+	Lockout       lockoutFileConfig         `yaml:"lockout"`
+	Sessions      sessionsFileConfig        `yaml:"sessions"`
+	Audit         auditFileConfig           `yaml:"audit"`
+	Metrics       metricsFileConfig         `yaml:"metrics"`
+	Tracing       tracingFileConfig         `yaml:"tracing"`
+	Daemon        daemonFileConfig          `yaml:"daemon"`
+	Logging       logFileConfig             `yaml:"logging"`
+}
+
+type roleMethodFileConfig struct {
+	Roles   []string `yaml:"roles"`
+	Methods []string `yaml:"methods"`
+}
+
+type roleAssuranceFileConfig struct {
+	Roles  []string `yaml:"roles"`
+	AAL    string   `yaml:"aal"`
+	MaxAge string   `yaml:"max_age"`
+}
+
+type trustFileConfig struct {
+	CIDRs []string `yaml:"cidrs"`
+	Roles []string `yaml:"roles"`
+}
+
+type apiFileConfig struct {
+	URL            string            `yaml:"url"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	ConnectTimeout time.Duration     `yaml:"connect_timeout"`
+	TLSTimeout     time.Duration     `yaml:"tls_timeout"`
+	CABundle       string            `yaml:"ca_bundle"`
+	ClientCert     string            `yaml:"client_cert"`
+	ClientKey      string            `yaml:"client_key"`
+	Pins           []string          `yaml:"pins"`
+	Proxy          string            `yaml:"proxy"`
+	Retries        *int              `yaml:"retries"`
+	RetryBase      time.Duration     `yaml:"retry_base"`
+	RetryMax       time.Duration     `yaml:"retry_max"`
+	Breaker        breakerFileConfig `yaml:"breaker"`
+}
+
+type breakerFileConfig struct {
+	Threshold int           `yaml:"threshold"`
+	Cooldown  time.Duration `yaml:"cooldown"`
+	Path      string        `yaml:"path"`
+}
+
+type passwordFileConfig struct {
+	Host      string        `yaml:"host"`
+	Port      int           `yaml:"port"`
+	SocketDir string        `yaml:"socket_dir"`
+	Database  string        `yaml:"database"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+type ephemeralFileConfig struct {
+	Prefix    string        `yaml:"prefix"`
+	User      string        `yaml:"user"`
+	Password  string        `yaml:"password"`
+	Host      string        `yaml:"host"`
+	Port      int           `yaml:"port"`
+	SocketDir string        `yaml:"socket_dir"`
+	Database  string        `yaml:"database"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+type jwtFileConfig struct {
+	JWKS      string `yaml:"jwks"`
+	JWKSCache string `yaml:"jwks_cache"`
+	Issuer    string `yaml:"issuer"`
+	Mappings  string `yaml:"mappings"`
+}
+
+type cacheFileConfig struct {
+	TTL           time.Duration `yaml:"ttl"`
+	DenyTTL       time.Duration `yaml:"deny_ttl"`
+	Path          string        `yaml:"path"`
+	KeyPath       string        `yaml:"key_path"`
+	DegradedRoles []string      `yaml:"degraded_roles"`
+}
+
+type lockoutFileConfig struct {
+	Threshold      int           `yaml:"threshold"`
+	RhostThreshold int           `yaml:"rhost_threshold"`
+	Base           time.Duration `yaml:"base"`
+	Max            time.Duration `yaml:"max"`
+	Window         time.Duration `yaml:"window"`
+	Tarpit         time.Duration `yaml:"tarpit"`
+	TarpitMax      time.Duration `yaml:"tarpit_max"`
+	Path           string        `yaml:"path"`
+}
+
+type sessionsFileConfig struct {
+	Track     *bool         `yaml:"track"`
+	Path      string        `yaml:"path"`
+	Grace     time.Duration `yaml:"grace"`
+	Interval  time.Duration `yaml:"interval"`
+	User      string        `yaml:"user"`
+	Password  string        `yaml:"password"`
+	Host      string        `yaml:"host"`
+	Port      int           `yaml:"port"`
+	SocketDir string        `yaml:"socket_dir"`
+	Database  string        `yaml:"database"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+type auditFileConfig struct {
+	Path            string `yaml:"path"`
+	MaxSize         string `yaml:"max_size"`
+	MaxFiles        *int   `yaml:"max_files"`
+	Fsync           string `yaml:"fsync"`
+	KeyPath         string `yaml:"key_path"`
+	SigningKey      string `yaml:"signing_key"`
+	CheckpointEvery int    `yaml:"checkpoint_every"`
+}
+
+type metricsFileConfig struct {
+	Textfile string `yaml:"textfile"`
+	Path     string `yaml:"path"`
+}
+
+type tracingFileConfig struct {
+	Endpoint string `yaml:"endpoint"`
+	File     string `yaml:"file"`
+}
+
+type daemonFileConfig struct {
+	Socket        string        `yaml:"socket"`
+	Fallback      *bool         `yaml:"fallback"`
+	Timeout       time.Duration `yaml:"timeout"`
+	AllowedUsers  []string      `yaml:"allowed_users"`
+	MetricsListen string        `yaml:"metrics_listen"`
+}
+
+type logFileConfig struct {
+	Level string `yaml:"level"`
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadFile reads the config file at path into c, only the values set in the file are changed
+func (c *config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	// an empty file is a valid, empty, config
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+
+	if err := resolveNode(root); err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+	if err := checkKnownKeys(root, reflect.TypeOf(fileConfig{}), ""); err != nil {
+		return fmt.Errorf("%s:%w", path, err)
+	}
+
+	var fc fileConfig
+	if err := root.Decode(&fc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return fc.apply(c)
+}
+
+func (fc *fileConfig) apply(c *config) error {
+	if len(fc.Methods) > 0 {
+		methods, err := parseAuthMethods(fc.Methods)
+		if err != nil {
+			return err
+		}
+		c.AuthMethods = methods
+	}
+	for _, r := range fc.RoleMethods {
+		rule, err := newRoleMethodRule(r.Roles, r.Methods)
+		if err != nil {
+			return err
+		}
+		c.RoleMethods = append(c.RoleMethods, rule)
+	}
+	for _, r := range fc.RoleAssurance {
+		rule, err := newRoleAssuranceRule(r.Roles, r.AAL, r.MaxAge)
+		if err != nil {
+			return err
+		}
+		c.RoleAssurance = append(c.RoleAssurance, rule)
+	}
+	if fc.TrustLocal != nil {
+		c.TrustLocal = *fc.TrustLocal
+	}
+	for _, t := range fc.TrustCIDRs {
+		prefixes, err := parseCIDRs(strings.Join(t.CIDRs, ","))
+		if err != nil {
+			return err
+		}
+		roles, err := parseRolePatterns(t.Roles)
+		if err != nil {
+			return err
+		}
+		for _, p := range prefixes {
+			c.TrustRules = append(c.TrustRules, trustRule{Prefix: p, Roles: roles})
+		}
+	}
+	setIf(&c.PolicyPath, fc.Policy)
+	if len(fc.TrustRoles) > 0 {
+		roles, err := parseRolePatterns(fc.TrustRoles)
+		if err != nil {
+			return err
+		}
+		c.TrustRoles = roles
+	}
+	setIf(&c.AuthAPIURL, fc.API.URL)
+	setIfDuration(&c.APIClient.Timeout, fc.API.Timeout)
+	setIfDuration(&c.APIClient.ConnectTimeout, fc.API.ConnectTimeout)
+	setIfDuration(&c.APIClient.TLSHandshakeTimeout, fc.API.TLSTimeout)
+	setIf(&c.APIClient.CABundle, fc.API.CABundle)
+	setIf(&c.APIClient.ClientCert, fc.API.ClientCert)
+	setIf(&c.APIClient.ClientKey, fc.API.ClientKey)
+	if len(fc.API.Pins) > 0 {
+		c.APIClient.Pins = fc.API.Pins
+	}
+	setIf(&c.APIClient.Proxy, fc.API.Proxy)
+	if fc.API.Retries != nil {
+		if *fc.API.Retries < 0 {
+			return fmt.Errorf("invalid api retries: %d", *fc.API.Retries)
+		}
+		c.APIClient.Retry.Retries = *fc.API.Retries
+	}
+	setIfDuration(&c.APIClient.Retry.Base, fc.API.RetryBase)
+	setIfDuration(&c.APIClient.Retry.Max, fc.API.RetryMax)
+	if fc.API.Breaker.Threshold < 0 {
+		return fmt.Errorf("invalid api breaker threshold: %d", fc.API.Breaker.Threshold)
+	}
+	if fc.API.Breaker.Threshold != 0 {
+		c.APIBreaker.Threshold = fc.API.Breaker.Threshold
+	}
+	setIfDuration(&c.APIBreaker.Cooldown, fc.API.Breaker.Cooldown)
+	setIf(&c.APIBreaker.Path, fc.API.Breaker.Path)
+	setIf(&c.Password.Host, fc.Password.Host)
+	if fc.Password.Port != 0 {
+		c.Password.Port = fc.Password.Port
+	}
+	setIf(&c.Password.SocketDir, fc.Password.SocketDir)
+	setIf(&c.Password.Database, fc.Password.Database)
+	setIfDuration(&c.Password.Timeout, fc.Password.Timeout)
+	setIf(&c.Ephemeral.Prefix, fc.Ephemeral.Prefix)
+	setIf(&c.Ephemeral.User, fc.Ephemeral.User)
+	setIf(&c.Ephemeral.Password, fc.Ephemeral.Password)
+	setIf(&c.Ephemeral.Conn.Host, fc.Ephemeral.Host)
+	if fc.Ephemeral.Port != 0 {
+		c.Ephemeral.Conn.Port = fc.Ephemeral.Port
+	}
+	setIf(&c.Ephemeral.Conn.SocketDir, fc.Ephemeral.SocketDir)
+	setIf(&c.Ephemeral.Conn.Database, fc.Ephemeral.Database)
+	setIfDuration(&c.Ephemeral.Conn.Timeout, fc.Ephemeral.Timeout)
+	setIf(&c.JWKSURL, fc.JWT.JWKS)
+	setIf(&c.JWKSCachePath, fc.JWT.JWKSCache)
+	setIf(&c.JWTIssuer, fc.JWT.Issuer)
+	setIf(&c.MappingsPath, fc.JWT.Mappings)
+	setIfDuration(&c.Cache.TTL, fc.Cache.TTL)
+	setIfDuration(&c.Cache.DenyTTL, fc.Cache.DenyTTL)
+	setIf(&c.Cache.Path, fc.Cache.Path)
+	setIf(&c.Cache.KeyFile, fc.Cache.KeyPath)
+	if len(fc.Cache.DegradedRoles) > 0 {
+		roles, err := parseRolePatterns(fc.Cache.DegradedRoles)
+		if err != nil {
+			return err
+		}
+		c.Cache.DegradedRoles = roles
+	}
+	if fc.Lockout.Threshold != 0 {
+		c.Lockout.Threshold = fc.Lockout.Threshold
+	}
+	if fc.Lockout.RhostThreshold != 0 {
+		c.Lockout.RhostThreshold = fc.Lockout.RhostThreshold
+	}
+	setIfDuration(&c.Lockout.Base, fc.Lockout.Base)
+	setIfDuration(&c.Lockout.Max, fc.Lockout.Max)
+	setIfDuration(&c.Lockout.Window, fc.Lockout.Window)
+	setIfDuration(&c.Lockout.Tarpit, fc.Lockout.Tarpit)
+	setIfDuration(&c.Lockout.TarpitMax, fc.Lockout.TarpitMax)
+	setIf(&c.Lockout.Path, fc.Lockout.Path)
+	if fc.Sessions.Track != nil {
+		c.Sessions.Track = *fc.Sessions.Track
+	}
+	setIf(&c.Sessions.Path, fc.Sessions.Path)
+	setIfDuration(&c.Sessions.Grace, fc.Sessions.Grace)
+	setIfDuration(&c.Sessions.Interval, fc.Sessions.Interval)
+	setIf(&c.Sessions.User, fc.Sessions.User)
+	setIf(&c.Sessions.Password, fc.Sessions.Password)
+	setIf(&c.Sessions.Conn.Host, fc.Sessions.Host)
+	if fc.Sessions.Port != 0 {
+		c.Sessions.Conn.Port = fc.Sessions.Port
+	}
+	setIf(&c.Sessions.Conn.SocketDir, fc.Sessions.SocketDir)
+	setIf(&c.Sessions.Conn.Database, fc.Sessions.Database)
+	setIfDuration(&c.Sessions.Conn.Timeout, fc.Sessions.Timeout)
+	setIf(&c.Audit.Path, fc.Audit.Path)
+	if fc.Audit.MaxSize != "" {
+		size, err := parseSize(fc.Audit.MaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid audit max_size: %w", err)
+		}
+		c.Audit.MaxSize = size
+	}
+	if fc.Audit.MaxFiles != nil {
+		c.Audit.MaxFiles = *fc.Audit.MaxFiles
+	}
+	if fc.Audit.Fsync != "" {
+		policy, err := parseFsyncPolicy(fc.Audit.Fsync)
+		if err != nil {
+			return err
+		}
+		c.Audit.Fsync = policy
+	}
+	setIf(&c.Audit.KeyFile, fc.Audit.KeyPath)
+	setIf(&c.Audit.SigningKey, fc.Audit.SigningKey)
+	if fc.Audit.CheckpointEvery != 0 {
+		c.Audit.CheckpointEvery = fc.Audit.CheckpointEvery
+	}
+	setIf(&c.Metrics.Textfile, fc.Metrics.Textfile)
+	setIf(&c.Metrics.Path, fc.Metrics.Path)
+	setIf(&c.Tracing.Endpoint, fc.Tracing.Endpoint)
+	setIf(&c.Tracing.File, fc.Tracing.File)
+	setIf(&c.Daemon.Socket, fc.Daemon.Socket)
+	if fc.Daemon.Fallback != nil {
+		c.Daemon.Fallback = *fc.Daemon.Fallback
+	}
+	setIfDuration(&c.Daemon.Timeout, fc.Daemon.Timeout)
+	if len(fc.Daemon.AllowedUsers) > 0 {
+		c.Daemon.AllowedUsers = fc.Daemon.AllowedUsers
+	}
+	setIf(&c.Daemon.MetricsListen, fc.Daemon.MetricsListen)
+	if fc.Logging.Level != "" {
+		level, err := parseLogLevel(fc.Logging.Level)
+		if err != nil {
+			return err
+		}
+		c.LogLevel = level
+	}
+	return nil
+}
+
+func setIf(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func setIfDuration(dst *time.Duration, v time.Duration) {
+	if v != 0 {
+		*dst = v
+	}
+}
+
+// resolveNode expands environment variables in scalar values and replaces
+// <key>_file entries by <key> with the contents of the file
+func resolveNode(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		var err error
+		n.Value = envRef.ReplaceAllStringFunc(n.Value, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			v, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("%d:%d: environment variable %s is not set", n.Line, n.Column, name)
+			}
+			return v
+		})
+		return err
+	case yaml.MappingNode:
+		seen := map[string]bool{}
+		for i := 0; i < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if err := resolveNode(value); err != nil {
+				return err
+			}
+			if name, ok := strings.CutSuffix(key.Value, "_file"); ok && value.Kind == yaml.ScalarNode {
+				secret, err := os.ReadFile(value.Value)
+				if err != nil {
+					return fmt.Errorf("%d:%d: %s: %w", key.Line, key.Column, key.Value, err)
+				}
+				key.Value = name
+				value.Value = strings.TrimRight(string(secret), "\r\n")
+				value.Tag = "!!str"
+				value.Style = yaml.DoubleQuotedStyle
+			}
+			if seen[key.Value] {
+				return fmt.Errorf("%d:%d: %s is set more than once", key.Line, key.Column, key.Value)
+			}
+			seen[key.Value] = true
+		}
+	case yaml.SequenceNode, yaml.DocumentNode:
+		for _, c := range n.Content {
+			if err := resolveNode(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkKnownKeys walks the node alongside the type it is decoded into and
+// reports the position of the first key the type has no field for
+func checkKnownKeys(n *yaml.Node, t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && n.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			if name != "" && name != "-" {
+				fields[name] = t.Field(i).Type
+			}
+		}
+		for i := 0; i < len(n.Content); i += 2 {
+			key := n.Content[i]
+			ft, ok := fields[key.Value]
+			if !ok {
+				if path == "" {
+					return fmt.Errorf("%d:%d: unknown key %q", key.Line, key.Column, key.Value)
+				}
+				return fmt.Errorf("%d:%d: unknown key %q in %s", key.Line, key.Column, key.Value, path)
+			}
+			if err := checkKnownKeys(n.Content[i+1], ft, joinKey(path, key.Value)); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Slice && n.Kind == yaml.SequenceNode:
+		for i, item := range n.Content {
+			if err := checkKnownKeys(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case t.Kind() == reflect.Map && n.Kind == yaml.MappingNode:
+		for i := 0; i < len(n.Content); i += 2 {
+			if err := checkKnownKeys(n.Content[i+1], t.Elem(), joinKey(path, n.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	}
+	// type mismatches are reported by the decoder
+	return nil
+}
+
+func joinKey(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// daemonConfig configures gatekeeperd, and how the PAM module reaches it
+type daemonConfig struct {
+	// path of the unix socket gatekeeperd listens on, when set the PAM module forwards logins to it
+	Socket string
+	// evaluate logins in-process when gatekeeperd can't be reached, instead of failing them
+	Fallback bool
+	// deadline for a login forwarded to gatekeeperd
+	Timeout time.Duration
+	// users, by name or uid, that may connect to gatekeeperd besides root and the user it runs as
+	AllowedUsers []string
+	// address gatekeeperd serves the metrics on at /metrics, such as 127.0.0.1:9464. Empty to not serve them.
+	MetricsListen string
+}
+
+const defaultConfigPath = "/etc/jit-gatekeeper/config.yaml"
+
+// Requests and responses between the PAM module and gatekeeperd are JSON
+// documents, each preceded by its length as a 4 byte big endian integer. A
+// connection carries the requests of a single login, a trust request is
+// usually followed by an authenticate request once the token was prompted for.
+const maxFrameSize = 64 << 10
+
+type daemonOp string
+
+const (
+	opTrust        daemonOp = "trust"
+	opAuthenticate daemonOp = "authenticate"
+)
+
+type daemonRequest struct {
+	Op daemonOp `json:"op"`
+	loginRequest
+}
+
+type daemonResponse struct {
+	// nil when there is no grant, because of Error or the connection is not trusted
+	Grant *grant       `json:"grant,omitempty"`
+	Error *errorRecord `json:"error,omitempty"`
+}
+
+func writeFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", len(data), maxFrameSize)
+	}
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err = w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader, v any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the maximum of %d", size, maxFrameSize)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// peerCred identifies the process on the other end of a unix socket
+type peerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// daemon is gatekeeperd, it evaluates the logins forwarded by the PAM module.
+// Keeping one gatekeeper for all logins lets them share connections to the API and the JWKS.
+type daemon struct {
+	ConfigPath string
+	Log        logFunc
+
+	state atomic.Pointer[daemonState]
+}
+
+// daemonState is everything that is replaced when the config is reloaded
+type daemonState struct {
+	config     *config
+	gatekeeper *gatekeeper
+	allowed    []uint32
+}
+
+func newDaemon(configPath string, log logFunc) (*daemon, error) {
+	d := &daemon{ConfigPath: configPath, Log: log}
+	if err := d.reload(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reload loads the config, the running config is kept when it is invalid
+func (d *daemon) reload() error {
+	cfg, err := configFromArgs([]string{"config=" + d.ConfigPath})
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	gk, err := newGatekeeper(cfg, d.Log)
+	if err != nil {
+		return err
+	}
+	gk.tracer.batch(otlpBatchDelay)
+	allowed, err := resolveUIDs(cfg.Daemon.AllowedUsers)
+	if err != nil {
+		return err
+	}
+	allowed = append(allowed, 0, uint32(os.Geteuid()))
+
+	if old := d.state.Load(); old != nil && old.config.Daemon.Socket != cfg.Daemon.Socket {
+		d.Log(syslog.LOG_WARNING, "daemon socket changed to %s, restart gatekeeperd to listen on it", cfg.Daemon.Socket)
+	}
+	if old := d.state.Load(); old != nil && old.config.Daemon.MetricsListen != cfg.Daemon.MetricsListen {
+		d.Log(syslog.LOG_WARNING, "metrics address changed to %q, restart gatekeeperd to serve them there", cfg.Daemon.MetricsListen)
+	}
+	setLogLevel(cfg.LogLevel)
+	for _, w := range cfg.Warnings {
+		d.Log(syslog.LOG_WARNING, "%s", w)
+	}
+	old := d.state.Swap(&daemonState{config: cfg, gatekeeper: gk, allowed: allowed})
+	if old != nil {
+		old.gatekeeper.close()
+	}
+	return nil
+}
+
+// resolveUIDs looks up the uid of each user, given by name or uid
+func resolveUIDs(users []string) ([]uint32, error) {
+	var uids []uint32
+	for _, name := range users {
+		uid, err := strconv.ParseUint(name, 10, 32)
+		if err != nil {
+			u, lookupErr := user.Lookup(name)
+			if lookupErr != nil {
+				return nil, fmt.Errorf("invalid allowed user %q: %w", name, lookupErr)
+			}
+			if uid, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid uid of allowed user %q: %w", name, err)
+			}
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids, nil
+}
+
+// listen creates the unix socket, replacing the one left behind by a previous run
+func (d *daemon) listen() (*net.UnixListener, error) {
+	path := d.state.Load().config.Daemon.Socket
+	if path == "" {
+		return nil, fmt.Errorf("no daemon socket configured")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// who may connect is decided with SO_PEERCRED, not the file mode
+	if err := os.Chmod(path, 0666); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// serve accepts connections until ctx is done
+func (d *daemon) serve(ctx context.Context, l *net.UnixListener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			d.handle(ctx, conn)
+		}()
+	}
+}
+
+func (d *daemon) handle(ctx context.Context, conn *net.UnixConn) {
+	state := d.state.Load()
+
+	cred, err := peerCredentials(conn)
+	if err != nil {
+		d.Log(syslog.LOG_ERR, "failed to get peer credentials: %v", err)
+		return
+	}
+	if !slices.Contains(state.allowed, cred.UID) {
+		d.Log(syslog.LOG_WARNING, "connection refused: uid %d (pid %d) is not allowed", cred.UID, cred.PID)
+		return
+	}
+
+	for {
+		if err := conn.SetDeadline(time.Now().Add(state.config.Daemon.Timeout)); err != nil {
+			return
+		}
+		var req daemonRequest
+		if err := readFrame(conn, &req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				d.Log(syslog.LOG_WARNING, "failed to read request from pid %d: %v", cred.PID, err)
+			}
+			return
+		}
+
+		// the peer is the Postgres backend, whatever it claims
+		req.PID = int(cred.PID)
+
+		var resp daemonResponse
+		var g *grant
+		switch req.Op {
+		case opTrust:
+			g, err = state.gatekeeper.Trust(ctx, &req.loginRequest)
+		case opAuthenticate:
+			g, err = state.gatekeeper.Authenticate(ctx, &req.loginRequest)
+		default:
+			err = fmt.Errorf("%w: unknown operation %q", errServiceConfig, req.Op)
+		}
+		if err != nil {
+			resp.Error = newErrorRecord(err)
+		} else {
+			resp.Grant = g
+		}
+		if err := writeFrame(conn, &resp); err != nil {
+			d.Log(syslog.LOG_WARNING, "failed to write response to pid %d: %v", cred.PID, err)
+			return
+		}
+	}
+}
+
+// metricsServer serves the metrics of gatekeeperd and every process sharing its metrics store at /metrics
+func (d *daemon) metricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metricsHandler(func() *metrics { return d.state.Load().gatekeeper.metrics }))
+	return &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+}
+
+// runDaemon is gatekeeperd, it serves the PAM module until it is terminated and reloads the config on SIGHUP
+func runDaemon(args []string) int {
+	flags := flag.NewFlagSet("gatekeeperd", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	log := stderrLog
+	d, err := newDaemon(*configPath, log)
+	if err != nil {
+		log(syslog.LOG_ERR, "failed to load config: %v", err)
+		return 1
+	}
+	l, err := d.listen()
+	if err != nil {
+		log(syslog.LOG_ERR, "failed to listen: %v", err)
+		return 1
+	}
+	defer os.Remove(d.state.Load().config.Daemon.Socket)
+
+	if addr := d.state.Load().config.Daemon.MetricsListen; addr != "" {
+		ml, err := net.Listen("tcp", addr)
+		if err != nil {
+			log(syslog.LOG_ERR, "failed to listen for metrics: %v", err)
+			return 1
+		}
+		srv := d.metricsServer()
+		defer srv.Close()
+		go func() {
+			if err := srv.Serve(ml); !errors.Is(err, http.ErrServerClosed) {
+				log(syslog.LOG_ERR, "failed to serve metrics: %v", err)
+			}
+		}()
+		log(syslog.LOG_NOTICE, "serving metrics on http://%s/metrics", ml.Addr())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			if err := d.reload(); err != nil {
+				log(syslog.LOG_ERR, "failed to reload config, keeping the running config: %v", err)
+				continue
+			}
+			log(syslog.LOG_NOTICE, "config reloaded")
+		}
+	}()
+
+	log(syslog.LOG_NOTICE, "listening on %s", l.Addr())
+	err = d.serve(ctx, l)
+	// posts the spans of the last logins
+	d.state.Load().gatekeeper.close()
+	if err != nil {
+		log(syslog.LOG_ERR, "failed to accept connections: %v", err)
+		return 1
+	}
+	return 0
+}
+
+var priorityNames = map[syslog.Priority]string{
+	syslog.LOG_ERR:     "error",
+	syslog.LOG_WARNING: "warning",
+	syslog.LOG_NOTICE:  "notice",
+	syslog.LOG_INFO:    "info",
+	syslog.LOG_DEBUG:   "debug",
+}
+
+// stderrLog is the logFunc of the commands, filtered by the same logLevel as pamSyslog
+func stderrLog(priority syslog.Priority, format string, a ...any) {
+	if !logged(priority) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", priorityNames[priority], strings.TrimSpace(fmt.Sprintf(format, a...)))
+}
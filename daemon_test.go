@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func discardLog(priority syslog.Priority, format string, a ...any) {}
+
+func TestDaemon_frames(t *testing.T) {
+	var buf bytes.Buffer
+	req := &daemonRequest{Op: opAuthenticate, loginRequest: loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "secret"}}
+	assert.NoError(t, writeFrame(&buf, req))
+
+	var got daemonRequest
+	assert.NoError(t, readFrame(&buf, &got))
+	assert.Equal(t, *req, got)
+
+	buf.Reset()
+	buf.Write([]byte{0, 1, 0, 1})
+	assert.ErrorContains(t, readFrame(&buf, &got), "exceeds the maximum")
+}
+
+// startDaemon runs gatekeeperd with the config until the test ends, and returns it with the path of its socket
+func startDaemon(t *testing.T, configYAML string) (*daemon, string) {
+	socket := filepath.Join(t.TempDir(), "gatekeeper.sock")
+	path := writeConfig(t, configYAML+"daemon:\n  socket: "+socket+"\n  timeout: 5s\n")
+
+	d, err := newDaemon(path, discardLog)
+	assert.NoError(t, err)
+	l, err := d.listen()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, d.serve(ctx, l))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return d, socket
+}
+
+func TestDaemon_serve(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(permsHandler))
+	defer api.Close()
+	d, socket := startDaemon(t, "trust_local: true\nmethods: [pat]\napi:\n  url: "+api.URL+"\n")
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	newClient := func(t *testing.T) loginEvaluator {
+		c, err := newLoginEvaluator(&config{Daemon: daemonConfig{Socket: socket, Timeout: 5 * time.Second}}, discardLog)
+		assert.NoError(t, err)
+		t.Cleanup(func() { c.(*daemonClient).Close() })
+		return c
+	}
+
+	t.Run("trusts local connections", func(t *testing.T) {
+		g, err := newClient(t).Trust(ctx, &loginRequest{User: "postgres", Rhost: "[local]"})
+		assert.NoError(t, err)
+		assert.Equal(t, &grant{Role: "postgres", Method: AuthTrust}, g)
+	})
+
+	t.Run("asks for a token from other hosts", func(t *testing.T) {
+		client := newClient(t)
+		req := &loginRequest{User: "postgres", Rhost: "10.0.0.2"}
+		g, err := client.Trust(ctx, req)
+		assert.NoError(t, err)
+		assert.Nil(t, g)
+
+		req.Token = pat
+		g, err = client.Authenticate(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, &grant{Role: "postgres", UserId: validPerms.UserId, Method: AuthPat}, g)
+	})
+
+	t.Run("keeps the error classification", func(t *testing.T) {
+		_, err := newClient(t).Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString"})
+		assert.ErrorIs(t, err, errAuthFailed)
+		assert.ErrorContains(t, err, "no enabled authentication method accepts the token")
+	})
+
+	t.Run("reloads the config", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(d.ConfigPath, []byte("trust_local: false\ndaemon:\n  socket: "+socket+"\n"), 0600))
+		assert.NoError(t, d.reload())
+
+		g, err := newClient(t).Trust(ctx, &loginRequest{User: "postgres", Rhost: "[local]"})
+		assert.NoError(t, err)
+		assert.Nil(t, g)
+
+		// an invalid config is not loaded
+		assert.NoError(t, os.WriteFile(d.ConfigPath, []byte("trust_local: maybe\n"), 0600))
+		assert.Error(t, d.reload())
+		assert.Equal(t, socket, d.state.Load().config.Daemon.Socket)
+	})
+
+	t.Run("refuses peers that are not allowed", func(t *testing.T) {
+		state := *d.state.Load()
+		state.allowed = []uint32{uint32(os.Geteuid()) + 1}
+		d.state.Store(&state)
+
+		_, err := newClient(t).Trust(ctx, &loginRequest{User: "postgres", Rhost: "[local]"})
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+	})
+}
+
+func TestDaemon_fallback(t *testing.T) {
+	ctx := context.Background()
+	req := &loginRequest{User: "postgres", Rhost: "[local]"}
+	cfg := &config{TrustLocal: true, Daemon: daemonConfig{Socket: filepath.Join(t.TempDir(), "missing.sock"), Timeout: time.Second}}
+
+	t.Run("fails when gatekeeperd is unavailable", func(t *testing.T) {
+		client, err := newLoginEvaluator(cfg, discardLog)
+		assert.NoError(t, err)
+		_, err = client.Trust(ctx, req)
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.ErrorContains(t, err, "gatekeeperd unavailable")
+	})
+
+	t.Run("evaluates in-process when enabled", func(t *testing.T) {
+		cfg.Daemon.Fallback = true
+		client, err := newLoginEvaluator(cfg, discardLog)
+		assert.NoError(t, err)
+		g, err := client.Trust(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, AuthTrust, g.Method)
+	})
+}
+
+func TestDaemon_reusesAPIConnections(t *testing.T) {
+	var conns atomic.Int32
+	api := httptest.NewUnstartedServer(http.HandlerFunc(permsHandler))
+	api.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	api.Start()
+	defer api.Close()
+	d, socket := startDaemon(t, "methods: [pat]\napi:\n  url: "+api.URL+"\n")
+	ctx := context.Background()
+	req := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"}
+
+	// every login comes from another backend, with a client of its own
+	for range 5 {
+		client, err := newLoginEvaluator(&config{Daemon: daemonConfig{Socket: socket, Timeout: 5 * time.Second}}, discardLog)
+		assert.NoError(t, err)
+		_, err = client.Authenticate(ctx, req)
+		assert.NoError(t, err)
+		client.(*daemonClient).Close()
+	}
+	assert.Equal(t, int32(1), conns.Load())
+
+	var reused bool
+	traced := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	})
+	_, err := d.state.Load().gatekeeper.Authenticate(traced, req)
+	assert.NoError(t, err)
+	assert.True(t, reused)
+	assert.Equal(t, int32(1), conns.Load())
+}
+
+func TestDaemon_reload(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	path := writeConfig(t, "methods: [pat]\nlogging:\n  level: info\ntracing:\n  endpoint: "+collector.URL+"\n")
+	// filters by the log level, like stderrLog
+	log := func(priority syslog.Priority, format string, a ...any) { _ = logged(priority) }
+	d, err := newDaemon(path, log)
+	assert.NoError(t, err)
+	old := d.state.Load().gatekeeper
+
+	// logins go on while the config is reloaded
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				_, err := d.state.Load().gatekeeper.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString"})
+				assert.Error(t, err)
+				d.Log(syslog.LOG_DEBUG, "login done")
+			}
+		}()
+	}
+	for range 5 {
+		assert.NoError(t, d.reload())
+	}
+	wg.Wait()
+
+	// the replaced gatekeeper no longer batches spans
+	assert.NotSame(t, old, d.state.Load().gatekeeper)
+	old.tracer.mu.Lock()
+	assert.Zero(t, old.tracer.batchDelay)
+	assert.Nil(t, old.tracer.timer)
+	old.tracer.mu.Unlock()
+	d.state.Load().gatekeeper.close()
+}
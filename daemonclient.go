@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/syslog"
+	"net"
+	"time"
+)
+
+// daemonClient forwards logins to gatekeeperd. The requests of a login share
+// one connection, which is closed with Close once the login is decided.
+type daemonClient struct {
+	Socket  string
+	Timeout time.Duration
+	// evaluates logins in-process when gatekeeperd can't be reached, nil to fail them instead
+	Fallback loginEvaluator
+	Log      logFunc
+
+	conn        net.Conn
+	fallingBack bool
+}
+
+// newLoginEvaluator returns what the PAM module decides logins with, gatekeeperd when a socket is configured
+func newLoginEvaluator(cfg *config, log logFunc) (loginEvaluator, error) {
+	if cfg.Daemon.Socket == "" {
+		gk, err := newGatekeeper(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		return gk, nil
+	}
+
+	client := &daemonClient{Socket: cfg.Daemon.Socket, Timeout: cfg.Daemon.Timeout, Log: log}
+	if cfg.Daemon.Fallback {
+		gk, err := newGatekeeper(cfg, log)
+		if err != nil {
+			return nil, err
+		}
+		client.Fallback = gk
+	}
+	return client, nil
+}
+
+func (c *daemonClient) Trust(ctx context.Context, req *loginRequest) (*grant, error) {
+	return c.call(ctx, opTrust, req)
+}
+
+func (c *daemonClient) Authenticate(ctx context.Context, req *loginRequest) (*grant, error) {
+	return c.call(ctx, opAuthenticate, req)
+}
+
+func (c *daemonClient) call(ctx context.Context, op daemonOp, req *loginRequest) (*grant, error) {
+	if c.conn == nil && !c.fallingBack {
+		dialer := net.Dialer{Timeout: c.Timeout}
+		conn, err := dialer.DialContext(ctx, "unix", c.Socket)
+		if err != nil {
+			if c.Fallback == nil {
+				return nil, fmt.Errorf("%w: gatekeeperd unavailable: %w", errAuthInfoUnavailable, err)
+			}
+			c.Log(syslog.LOG_WARNING, "gatekeeperd unavailable, evaluating in-process: %v", err)
+			c.fallingBack = true
+		} else {
+			c.conn = conn
+		}
+	}
+	if c.fallingBack {
+		if op == opTrust {
+			return c.Fallback.Trust(ctx, req)
+		}
+		return c.Fallback.Authenticate(ctx, req)
+	}
+
+	deadline := time.Now().Add(c.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("%w: %w", errAuthInfoUnavailable, err)
+	}
+	if err := writeFrame(c.conn, &daemonRequest{Op: op, loginRequest: *req}); err != nil {
+		return nil, fmt.Errorf("%w: failed to send request to gatekeeperd: %w", errAuthInfoUnavailable, err)
+	}
+	var resp daemonResponse
+	if err := readFrame(c.conn, &resp); err != nil {
+		return nil, fmt.Errorf("%w: failed to read response from gatekeeperd: %w", errAuthInfoUnavailable, err)
+	}
+	// gatekeeperd logs the details, the PAM log only notes the outcome
+	if resp.Error != nil {
+		c.Log(syslog.LOG_WARNING, "gatekeeperd refused %s: %v", req.User, resp.Error)
+		return nil, resp.Error
+	}
+	if resp.Grant != nil {
+		c.Log(syslog.LOG_INFO, "gatekeeperd granted %s: %v", req.User, resp.Grant)
+	}
+	return resp.Grant, nil
+}
+
+func (c *daemonClient) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
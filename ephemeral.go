@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultEphemeralUser     = "postgres"
+	defaultEphemeralDatabase = "postgres"
+	// the comment of every ephemeral role starts with this, followed by its ephemeralRole as JSON
+	ephemeralCommentPrefix = "jit-gatekeeper ephemeral role "
+	// NAMEDATALEN - 1
+	maxIdentifierLength = 63
+)
+
+// ephemeralConfig configures ephemeral roles. A login to <Prefix><user id>
+// creates that role as a member of the role the token is approved for, so the
+// sessions of every user can be told apart in pg_stat_activity and the logs.
+type ephemeralConfig struct {
+	// roles starting with Prefix are ephemeral, empty to disable them
+	Prefix string
+	// connection the roles are managed over, Database names an existing database here
+	Conn passwordConfig
+	// a role with CREATEROLE, over the unix socket peer authentication works without a password
+	User     string
+	Password string
+}
+
+func (c ephemeralConfig) enabled() bool {
+	return c.Prefix != ""
+}
+
+func (c ephemeralConfig) withDefaults() ephemeralConfig {
+	if c.User == "" {
+		c.User = defaultEphemeralUser
+	}
+	if c.Conn.Database == "" {
+		c.Conn.Database = defaultEphemeralDatabase
+	}
+	c.Conn = c.Conn.withDefaults()
+	return c
+}
+
+// isEphemeral reports whether logins to role create it
+func (c ephemeralConfig) isEphemeral(role string) bool {
+	return c.enabled() && len(role) > len(c.Prefix) && strings.HasPrefix(role, c.Prefix)
+}
+
+// roleFor returns the ephemeral role of a user, the only one their token may
+// log in as. Characters Postgres would need quoted become underscores.
+func (c ephemeralConfig) roleFor(userId string) (string, error) {
+	name := c.Prefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r + 'a' - 'A'
+		default:
+			return '_'
+		}
+	}, userId)
+	// longer names are truncated by Postgres, two users could end up with the same role
+	if len(name) > maxIdentifierLength {
+		return "", fmt.Errorf("%w: ephemeral role for user %s would be longer than %d bytes", errPermDenied, userId, maxIdentifierLength)
+	}
+	return name, nil
+}
+
+// ephemeralRole is what the gatekeeper records about an ephemeral role in its comment
+type ephemeralRole struct {
+	Name string `json:"-"`
+	// the user the role was created for, no one else may log in as it until it is dropped
+	UserId string `json:"user_id"`
+	Target string `json:"target"`
+	// zero when the grant doesn't expire
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+func (r *ephemeralRole) comment() string {
+	data, _ := json.Marshal(r)
+	return ephemeralCommentPrefix + string(data)
+}
+
+func (r *ephemeralRole) expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+// parseEphemeralComment parses the comment of a role, ok is false when the gatekeeper didn't create it
+func parseEphemeralComment(name, comment string) (role *ephemeralRole, ok bool) {
+	data, ok := strings.CutPrefix(comment, ephemeralCommentPrefix)
+	if !ok {
+		return nil, false
+	}
+	role = &ephemeralRole{Name: name}
+	if err := json.Unmarshal([]byte(data), role); err != nil {
+		return nil, false
+	}
+	return role, true
+}
+
+// roleState is an existing role, as read from the catalog
+type roleState struct {
+	Comment string
+	// roles it is a member of
+	MemberOf []string
+}
+
+// planEphemeralRole returns the statements that bring the role from its
+// current state, nil when it doesn't exist, to want. Only what differs is
+// changed, so running the plan again does nothing.
+func planEphemeralRole(current *roleState, want *ephemeralRole) ([]string, error) {
+	name := pq.QuoteIdentifier(want.Name)
+	validUntil := "infinity"
+	if !want.ExpiresAt.IsZero() {
+		validUntil = want.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if current == nil {
+		return []string{
+			fmt.Sprintf("CREATE ROLE %s LOGIN INHERIT VALID UNTIL %s", name, pq.QuoteLiteral(validUntil)),
+			fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(want.Target), name),
+			fmt.Sprintf("COMMENT ON ROLE %s IS %s", name, pq.QuoteLiteral(want.comment())),
+		}, nil
+	}
+
+	have, ok := parseEphemeralComment(want.Name, current.Comment)
+	if !ok {
+		// never take over a role someone else created
+		return nil, fmt.Errorf("%w: role %s exists and was not created by the gatekeeper", errPermDenied, want.Name)
+	}
+	if have.UserId != want.UserId {
+		return nil, fmt.Errorf("%w: ephemeral role %s belongs to another user", errPermDenied, want.Name)
+	}
+
+	var statements []string
+	if !have.ExpiresAt.Equal(want.ExpiresAt) {
+		statements = append(statements, fmt.Sprintf("ALTER ROLE %s VALID UNTIL %s", name, pq.QuoteLiteral(validUntil)))
+	}
+	for _, member := range current.MemberOf {
+		if member != want.Target {
+			statements = append(statements, fmt.Sprintf("REVOKE %s FROM %s", pq.QuoteIdentifier(member), name))
+		}
+	}
+	if !slices.Contains(current.MemberOf, want.Target) {
+		statements = append(statements, fmt.Sprintf("GRANT %s TO %s", pq.QuoteIdentifier(want.Target), name))
+	}
+	if have.Target != want.Target || !have.ExpiresAt.Equal(want.ExpiresAt) {
+		statements = append(statements, fmt.Sprintf("COMMENT ON ROLE %s IS %s", name, pq.QuoteLiteral(want.comment())))
+	}
+	return statements, nil
+}
+
+// planDropEphemeralRole returns the statements dropping the role. Objects it
+// owns in the database connected to are handed to its target rather than lost.
+func planDropEphemeralRole(role *ephemeralRole) []string {
+	name := pq.QuoteIdentifier(role.Name)
+	return []string{
+		fmt.Sprintf("REASSIGN OWNED BY %s TO %s", name, pq.QuoteIdentifier(role.Target)),
+		fmt.Sprintf("DROP OWNED BY %s", name),
+		fmt.Sprintf("DROP ROLE IF EXISTS %s", name),
+	}
+}
+
+// roleManager manages ephemeral roles over a privileged connection to the local database
+type roleManager struct {
+	config ephemeralConfig
+	db     *sql.DB
+}
+
+func openRoleManager(cfg ephemeralConfig) (*roleManager, error) {
+	cfg = cfg.withDefaults()
+	connector, err := pq.NewConnector(cfg.Conn.dsn(cfg.User, cfg.Password))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errServiceConfig, err)
+	}
+	return &roleManager{config: cfg, db: sql.OpenDB(connector)}, nil
+}
+
+func (m *roleManager) Close() error {
+	return m.db.Close()
+}
+
+// provision creates or updates the role and returns the statements that changed it
+func (m *roleManager) provision(ctx context.Context, want *ephemeralRole) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.Conn.Timeout)
+	defer cancel()
+
+	var statements []string
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		// concurrent logins to the same role take turns, the second sees what the first did
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", ephemeralCommentPrefix+want.Name); err != nil {
+			return err
+		}
+		current, err := readRoleState(ctx, tx, want.Name)
+		if err != nil {
+			return err
+		}
+		if statements, err = planEphemeralRole(current, want); err != nil {
+			return err
+		}
+		return execAll(ctx, tx, statements)
+	})
+	return statements, classifyRoleError(err)
+}
+
+// drop drops the role and returns the statements that did
+func (m *roleManager) drop(ctx context.Context, role *ephemeralRole) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.Conn.Timeout)
+	defer cancel()
+
+	statements := planDropEphemeralRole(role)
+	err := m.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", ephemeralCommentPrefix+role.Name); err != nil {
+			return err
+		}
+		// a login may have extended the role since it was listed
+		current, err := readRoleState(ctx, tx, role.Name)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			statements = nil
+			return nil
+		}
+		if now, ok := parseEphemeralComment(role.Name, current.Comment); !ok || !now.expired(time.Now()) {
+			statements = nil
+			return nil
+		}
+		return execAll(ctx, tx, statements)
+	})
+	return statements, classifyRoleError(err)
+}
+
+// list returns the ephemeral roles the gatekeeper created
+func (m *roleManager) list(ctx context.Context) ([]*ephemeralRole, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.Conn.Timeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx,
+		"SELECT rolname, coalesce(shobj_description(oid, 'pg_authid'), '') FROM pg_roles WHERE starts_with(rolname, $1) ORDER BY rolname",
+		m.config.Prefix)
+	if err != nil {
+		return nil, classifyRoleError(err)
+	}
+	defer rows.Close()
+	var roles []*ephemeralRole
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, classifyRoleError(err)
+		}
+		if role, ok := parseEphemeralComment(name, comment); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles, classifyRoleError(rows.Err())
+}
+
+func (m *roleManager) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// readRoleState reads the role from the catalog, nil when it doesn't exist
+func readRoleState(ctx context.Context, tx *sql.Tx, name string) (*roleState, error) {
+	var state roleState
+	err := tx.QueryRowContext(ctx,
+		"SELECT coalesce(shobj_description(oid, 'pg_authid'), '') FROM pg_roles WHERE rolname = $1", name).Scan(&state.Comment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx,
+		"SELECT g.rolname FROM pg_auth_members m JOIN pg_roles g ON g.oid = m.roleid JOIN pg_roles u ON u.oid = m.member WHERE u.rolname = $1", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		state.MemberOf = append(state.MemberOf, member)
+	}
+	return &state, rows.Err()
+}
+
+func execAll(ctx context.Context, tx *sql.Tx, statements []string) error {
+	for _, stmt := range statements {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	return nil
+}
+
+// classifyRoleError tells a misconfigured connection apart from a database that can't be reached
+func classifyRoleError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return classify(err, errAuthInfoUnavailable)
+	}
+	switch pqErr.Code.Class() {
+	case "28", "42": // invalid authorization, and syntax errors or insufficient privilege
+		return classify(err, errServiceConfig)
+	default:
+		return classify(err, errAuthInfoUnavailable)
+	}
+}
+
+// auditRoleEvent is a line of the audit log recording a change to an ephemeral role
+type auditRoleEvent struct {
+	chainLink
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Role       string    `json:"role"`
+	Target     string    `json:"target"`
+	UserId     string    `json:"user_id,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitzero"`
+	Statements []string  `json:"statements"`
+	Error      string    `json:"error,omitempty"`
+}
+
+const roleEventType = "ephemeral_role"
+
+func newAuditRoleEvent(action string, role *ephemeralRole, statements []string, err error, now time.Time) *auditRoleEvent {
+	ev := &auditRoleEvent{
+		Type:       roleEventType,
+		Time:       now.UTC(),
+		Action:     action,
+		Role:       role.Name,
+		Target:     role.Target,
+		UserId:     role.UserId,
+		ExpiresAt:  role.ExpiresAt.UTC(),
+		Statements: statements,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// runRoles is gatekeeper roles, cleanup drops the ephemeral roles whose grant has expired
+func runRoles(args []string) int {
+	if len(args) == 0 || args[0] != "cleanup" {
+		fmt.Fprintln(os.Stderr, "usage: gatekeeper roles cleanup [-config path] [-dry-run]")
+		return 2
+	}
+	flags := flag.NewFlagSet("roles cleanup", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	dryRun := flags.Bool("dry-run", false, "list the roles that would be dropped without dropping them")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := configFromArgs([]string{"config=" + *configPath})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	if !cfg.Ephemeral.enabled() {
+		fmt.Fprintln(os.Stderr, "ephemeral roles are not enabled")
+		return 1
+	}
+	m, err := openRoleManager(cfg.Ephemeral)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer m.Close()
+	var audit *auditLog
+	if cfg.Audit.Path != "" {
+		audit = newAuditLog(cfg.Audit)
+	}
+
+	ctx := context.Background()
+	roles, err := m.list(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list roles: %v\n", err)
+		return 1
+	}
+	status, dropped := 0, 0
+	for _, role := range roles {
+		if !role.expired(time.Now()) {
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("would drop %s (target %s, expired %s)\n", role.Name, role.Target, role.ExpiresAt.UTC().Format(time.RFC3339))
+			continue
+		}
+		statements, err := m.drop(ctx, role)
+		if audit != nil && (len(statements) > 0 || err != nil) {
+			if auditErr := audit.write(newAuditRoleEvent("drop", role, statements, err, time.Now())); auditErr != nil {
+				fmt.Fprintf(os.Stderr, "failed to write audit log: %v\n", auditErr)
+				status = 1
+			}
+		}
+		switch {
+		case err != nil:
+			// objects owned in other databases keep the role, they have to be reassigned there first
+			fmt.Fprintf(os.Stderr, "failed to drop %s: %v\n", role.Name, err)
+			status = 1
+		case len(statements) > 0:
+			fmt.Printf("dropped %s (target %s, expired %s)\n", role.Name, role.Target, role.ExpiresAt.UTC().Format(time.RFC3339))
+			dropped++
+		}
+	}
+	if !*dryRun {
+		fmt.Printf("%d expired roles dropped\n", dropped)
+	}
+	return status
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEphemeral_plan(t *testing.T) {
+	expires := time.Date(2025, 7, 23, 18, 0, 0, 0, time.UTC)
+	want := &ephemeralRole{Name: "jit_alice", UserId: "user-1", Target: "postgres", ExpiresAt: expires}
+
+	t.Run("creates a missing role", func(t *testing.T) {
+		statements, err := planEphemeralRole(nil, want)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			`CREATE ROLE "jit_alice" LOGIN INHERIT VALID UNTIL '2025-07-23T18:00:00Z'`,
+			`GRANT "postgres" TO "jit_alice"`,
+			`COMMENT ON ROLE "jit_alice" IS 'jit-gatekeeper ephemeral role {"user_id":"user-1","target":"postgres","expires_at":"2025-07-23T18:00:00Z"}'`,
+		}, statements)
+	})
+
+	t.Run("does nothing when the role is up to date", func(t *testing.T) {
+		statements, err := planEphemeralRole(&roleState{Comment: want.comment(), MemberOf: []string{"postgres"}}, want)
+		assert.NoError(t, err)
+		assert.Empty(t, statements)
+	})
+
+	t.Run("extends the role and restores the membership", func(t *testing.T) {
+		later := *want
+		later.ExpiresAt = expires.Add(time.Hour)
+		statements, err := planEphemeralRole(&roleState{Comment: want.comment()}, &later)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			`ALTER ROLE "jit_alice" VALID UNTIL '2025-07-23T19:00:00Z'`,
+			`GRANT "postgres" TO "jit_alice"`,
+			`COMMENT ON ROLE "jit_alice" IS ` + `'jit-gatekeeper ephemeral role {"user_id":"user-1","target":"postgres","expires_at":"2025-07-23T19:00:00Z"}'`,
+		}, statements)
+	})
+
+	t.Run("moves the role to a new target", func(t *testing.T) {
+		reader := *want
+		reader.Target = "reader"
+		statements, err := planEphemeralRole(&roleState{Comment: want.comment(), MemberOf: []string{"postgres"}}, &reader)
+		assert.NoError(t, err)
+		assert.Equal(t, `REVOKE "postgres" FROM "jit_alice"`, statements[0])
+		assert.Equal(t, `GRANT "reader" TO "jit_alice"`, statements[1])
+		assert.Len(t, statements, 3)
+	})
+
+	t.Run("never takes over roles", func(t *testing.T) {
+		_, err := planEphemeralRole(&roleState{Comment: "created by hand"}, want)
+		assert.ErrorIs(t, err, errPermDenied)
+		assert.ErrorContains(t, err, "role jit_alice exists and was not created by the gatekeeper")
+
+		bob := *want
+		bob.UserId = "user-2"
+		_, err = planEphemeralRole(&roleState{Comment: want.comment()}, &bob)
+		assert.ErrorIs(t, err, errPermDenied)
+		assert.ErrorContains(t, err, "ephemeral role jit_alice belongs to another user")
+	})
+
+	t.Run("quotes names", func(t *testing.T) {
+		statements, err := planEphemeralRole(nil, &ephemeralRole{Name: `jit_a"; DROP ROLE x; --`, UserId: "u", Target: "postgres"})
+		assert.NoError(t, err)
+		assert.Equal(t, `CREATE ROLE "jit_a""; DROP ROLE x; --" LOGIN INHERIT VALID UNTIL 'infinity'`, statements[0])
+		assert.Equal(t, []string{
+			`REASSIGN OWNED BY "jit_alice" TO "postgres"`,
+			`DROP OWNED BY "jit_alice"`,
+			`DROP ROLE IF EXISTS "jit_alice"`,
+		}, planDropEphemeralRole(want))
+	})
+
+	t.Run("parses only its own comments", func(t *testing.T) {
+		role, ok := parseEphemeralComment("jit_alice", want.comment())
+		assert.True(t, ok)
+		assert.Equal(t, want, role)
+		assert.True(t, role.expired(expires))
+		assert.False(t, role.expired(expires.Add(-time.Second)))
+
+		_, ok = parseEphemeralComment("jit_alice", ephemeralCommentPrefix+"{")
+		assert.False(t, ok)
+	})
+}
+
+func TestEphemeral_config(t *testing.T) {
+	c, err := configFromArgs([]string{"ephemeralPrefix=jit_", "ephemeralSocketDir=/var/run/postgresql", "ephemeralTimeout=2s"})
+	assert.NoError(t, err)
+	assert.True(t, c.Ephemeral.isEphemeral("jit_alice"))
+	assert.False(t, c.Ephemeral.isEphemeral("jit_"))
+	assert.False(t, c.Ephemeral.isEphemeral("postgres"))
+	cfg := c.Ephemeral.withDefaults()
+	assert.Equal(t, "postgres", cfg.User)
+	assert.Equal(t, "postgres", cfg.Conn.Database)
+	assert.Equal(t, 2*time.Second, cfg.Conn.Timeout)
+
+	assert.False(t, (&config{}).Ephemeral.isEphemeral("jit_alice"))
+
+	name, err := c.Ephemeral.roleFor("99CF6D1D-7c39-46b4-bc58-688f6dd897ad")
+	assert.NoError(t, err)
+	assert.Equal(t, "jit_99cf6d1d_7c39_46b4_bc58_688f6dd897ad", name)
+	name, err = c.Ephemeral.roleFor("auth0|alice.smith")
+	assert.NoError(t, err)
+	assert.Equal(t, "jit_auth0_alice_smith", name)
+	_, err = c.Ephemeral.roleFor(strings.Repeat("a", 60))
+	assert.ErrorIs(t, err, errPermDenied)
+
+	path := writeConfig(t, `
+ephemeral:
+  prefix: eph_
+  user: gatekeeper
+  password: secret
+  host: db.internal
+  port: 6432
+`)
+	c, err = configFromArgs([]string{"config=" + path})
+	assert.NoError(t, err)
+	assert.Equal(t, ephemeralConfig{Prefix: "eph_", User: "gatekeeper", Password: "secret", Conn: passwordConfig{Host: "db.internal", Port: 6432}}, c.Ephemeral)
+
+	_, err = configFromArgs([]string{"ephemeralPort=x"})
+	assert.ErrorContains(t, err, "invalid ephemeralPort")
+}
+
+func TestEphemeral_approvedRole(t *testing.T) {
+	now := time.Now()
+	later := apiTime{now.Add(time.Hour)}
+	earlier := apiTime{now.Add(-time.Hour)}
+
+	role, err := approvedRole(UserPermissionSet{Roles: []UserRole{{Role: "postgres", ExpiresAt: later}, {Role: "postgres"}, {Role: "reader", ExpiresAt: earlier}}}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres", role.Role)
+	assert.True(t, role.ExpiresAt.IsZero())
+
+	_, err = approvedRole(UserPermissionSet{Roles: []UserRole{{Role: "postgres"}, {Role: "reader"}}}, now)
+	assert.ErrorIs(t, err, errPermDenied)
+	assert.ErrorContains(t, err, "approved for several roles (postgres, reader)")
+
+	_, err = approvedRole(UserPermissionSet{Roles: []UserRole{{Role: "reader", ExpiresAt: earlier}}}, now)
+	assert.ErrorIs(t, err, errCredExpired)
+
+	_, err = approvedRole(UserPermissionSet{}, now)
+	assert.ErrorIs(t, err, errPermDenied)
+}
+
+func TestGatekeeper_ephemeral(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	api := mockServer(&UserPermissionSet{UserId: "user-1", Roles: []UserRole{{Role: "postgres", ExpiresAt: apiTime{expires}}}})
+	defer api.Close()
+
+	// nothing listens here, so provisioning fails the way it does when Postgres is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "ephemeralPrefix=jit_", "ephemeralPort=" + strconv.Itoa(port), "ephemeralTimeout=1s", "audit=" + auditPath})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	g, _, err := gk.authenticateToken(ctx, &loginRequest{User: "jit_user_1", Rhost: "10.0.0.1", Token: pat})
+	assert.NoError(t, err)
+	assert.Equal(t, &grant{Role: "jit_user_1", Target: "postgres", UserId: "user-1", Method: AuthPat, ExpiresAt: expires}, &grant{Role: g.Role, Target: g.Target, UserId: g.UserId, Method: g.Method, ExpiresAt: g.ExpiresAt.Local()})
+	assert.NoError(t, g.check("jit_user_1", time.Now()))
+
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "jit_user_1", Rhost: "10.0.0.1", Token: pat})
+	assert.ErrorIs(t, err, errAuthInfoUnavailable)
+
+	// the failed attempt is audited next to the decision
+	f, err := os.Open(auditPath)
+	assert.NoError(t, err)
+	defer f.Close()
+	var records []map[string]any
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec map[string]any
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, roleEventType, records[0]["type"])
+		assert.Equal(t, "provision", records[0]["action"])
+		assert.Equal(t, "jit_user_1", records[0]["role"])
+		assert.Equal(t, "postgres", records[0]["target"])
+		assert.Contains(t, records[0]["error"], "connection refused")
+		assert.Equal(t, "deny", records[1]["decision"])
+	}
+
+	// the role doesn't exist until the login, so there is no password to check
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "jit_user_1", Rhost: "10.0.0.1", Token: "hunter2"})
+	assert.ErrorIs(t, err, errPermDenied)
+	assert.ErrorContains(t, err, "can't be reached with a password")
+
+	// user-2 is approved as well, but the role bears the name of user-1
+	other := mockServer(&UserPermissionSet{UserId: "user-2", Roles: []UserRole{{Role: "postgres", ExpiresAt: apiTime{expires}}}})
+	defer other.Close()
+	cfg.AuthAPIURL = other.URL
+	gk, err = newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "jit_user_1", Rhost: "10.0.0.2", Token: pat})
+	assert.ErrorIs(t, err, errPermDenied)
+	assert.ErrorContains(t, err, "log in as jit_user_2")
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "jit_anything", Rhost: "10.0.0.2", Token: pat})
+	assert.ErrorIs(t, err, errPermDenied)
+
+	// other roles log in as before
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.1", Token: pat})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by authenticator.Authenticate wrap one of these, so that the
+// PAM module can return a code that stacked PAM configurations can act on.
+var (
+	// the credentials were rejected, the default for anything not covered below (PAM_AUTH_ERR)
+	errAuthFailed = errors.New("authentication failed")
+	// the API, JWKS or local database needed to authenticate could not be reached (PAM_AUTHINFO_UNAVAIL)
+	errAuthInfoUnavailable = errors.New("authentication information unavailable")
+	// the user is authenticated but holds no grant for the requested role (PAM_PERM_DENIED)
+	errPermDenied = errors.New("permission denied")
+	// the token or grant has expired (PAM_CRED_EXPIRED)
+	errCredExpired = errors.New("credentials expired")
+	// the module is misconfigured (PAM_SERVICE_ERR)
+	errServiceConfig = errors.New("invalid configuration")
+	// too many failed logins, the user or host is locked out for a while (PAM_MAXTRIES)
+	errLockedOut = errors.New("locked out")
+	// the token is valid, but its authentication is too weak or too old for the role (PAM_PERM_DENIED)
+	errInsufficientAssurance = errors.New("insufficient authentication assurance")
+)
+
+// authErrors in the order pamCode checks them, the first one an error wraps decides how it is reported
+var authErrors = []error{errServiceConfig, errLockedOut, errAuthInfoUnavailable, errCredExpired, errPermDenied, errInsufficientAssurance, errAuthFailed}
+
+// classify wraps err in kind, unless it already wraps one of the authentication errors
+func classify(err error, kind error) error {
+	if err == nil {
+		return nil
+	}
+	for _, e := range authErrors {
+		if errors.Is(err, e) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
+// errorRecord is an error sent to, or cached for, another process. Kind names the sentinel error it wraps.
+type errorRecord struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+var errorKinds = map[error]string{
+	errAuthFailed:            "auth_failed",
+	errAuthInfoUnavailable:   "authinfo_unavailable",
+	errPermDenied:            "perm_denied",
+	errCredExpired:           "cred_expired",
+	errServiceConfig:         "service_config",
+	errLockedOut:             "locked_out",
+	errInsufficientAssurance: "insufficient_assurance",
+}
+
+func newErrorRecord(err error) *errorRecord {
+	// errors that aren't classified are treated as failed authentication, like pamCode does
+	kind := errorKinds[errAuthFailed]
+	for _, sentinel := range authErrors {
+		if errors.Is(err, sentinel) {
+			kind = errorKinds[sentinel]
+			break
+		}
+	}
+	return &errorRecord{Kind: kind, Message: err.Error()}
+}
+
+func (e *errorRecord) Error() string {
+	return e.Message
+}
+
+func (e *errorRecord) Unwrap() error {
+	for sentinel, kind := range errorKinds {
+		if kind == e.Kind {
+			return sentinel
+		}
+	}
+	return errAuthFailed
+}
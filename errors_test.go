@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorRecord_kind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{errors.New("boom"), "auth_failed"},
+		{fmt.Errorf("%w: no grant", errPermDenied), "perm_denied"},
+		// wrapping several, the one pamCode checks first wins every time
+		{fmt.Errorf("%w: %w: no grant", errAuthFailed, errPermDenied), "perm_denied"},
+		{fmt.Errorf("%w: %w", errInsufficientAssurance, errAuthInfoUnavailable), "authinfo_unavailable"},
+		{errors.Join(errCredExpired, errLockedOut, errServiceConfig), "service_config"},
+	} {
+		for range 20 {
+			assert.Equal(t, tc.want, newErrorRecord(tc.err).Kind, tc.err.Error())
+		}
+		r := newErrorRecord(tc.err)
+		assert.Equal(t, tc.err.Error(), r.Error())
+		for _, sentinel := range authErrors {
+			if errorKinds[sentinel] == tc.want {
+				assert.ErrorIs(t, r, sentinel)
+			}
+		}
+	}
+
+	assert.ErrorIs(t, &errorRecord{Kind: "unknown"}, errAuthFailed)
+}
@@ -0,0 +1,1536 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Policy expressions are a small subset of CEL (https://cel.dev), evaluated
+// in-process. They are parsed and type checked against the declared variables
+// when the policy is loaded, so a typo fails the config rather than a login.
+//
+//	role == 'postgres' ? claims.aal == 'aal2' && rhost in corp_cidrs : true
+//
+// Supported are literals (ints, doubles, strings, r'raw strings', true, false,
+// null and [lists]), the operators ! - * / % + - == != < <= > >= in && || ?:,
+// field selection and indexing, has(x.f), size(), int(), double(), string(),
+// duration('1h'), timestamp('2025-01-01T00:00:00Z'), the string methods
+// startsWith, endsWith, contains and matches, and the timestamp methods
+// getHours, getMinutes, getDayOfWeek (0 is Sunday) and getDate, which take an
+// optional timezone such as 'Europe/Berlin'. `x in networks` checks whether
+// the address x is in one of the named networks.
+
+type exprKind int
+
+const (
+	kindDyn exprKind = iota
+	kindNull
+	kindBool
+	kindInt
+	kindDouble
+	kindString
+	kindTimestamp
+	kindDuration
+	kindList
+	kindMap
+	kindNetworks
+)
+
+// exprType is the static type of an expression. Values of type dyn, such as
+// claims, are only known at runtime and are checked when evaluated.
+type exprType struct {
+	kind exprKind
+	// element type of lists and maps
+	elem *exprType
+	// fields of objects, maps with a fixed set of keys
+	fields map[string]*exprType
+}
+
+var (
+	typeDyn       = &exprType{kind: kindDyn}
+	typeNull      = &exprType{kind: kindNull}
+	typeBool      = &exprType{kind: kindBool}
+	typeInt       = &exprType{kind: kindInt}
+	typeDouble    = &exprType{kind: kindDouble}
+	typeString    = &exprType{kind: kindString}
+	typeTimestamp = &exprType{kind: kindTimestamp}
+	typeDuration  = &exprType{kind: kindDuration}
+	typeNetworks  = &exprType{kind: kindNetworks}
+)
+
+func listOf(elem *exprType) *exprType { return &exprType{kind: kindList, elem: elem} }
+func mapOf(elem *exprType) *exprType  { return &exprType{kind: kindMap, elem: elem} }
+func objectOf(fields map[string]*exprType) *exprType {
+	return &exprType{kind: kindMap, elem: typeDyn, fields: fields}
+}
+
+func (t *exprType) String() string {
+	switch t.kind {
+	case kindNull:
+		return "null"
+	case kindBool:
+		return "bool"
+	case kindInt:
+		return "int"
+	case kindDouble:
+		return "double"
+	case kindString:
+		return "string"
+	case kindTimestamp:
+		return "timestamp"
+	case kindDuration:
+		return "duration"
+	case kindList:
+		return "list(" + t.elem.String() + ")"
+	case kindMap:
+		if t.fields != nil {
+			return "object"
+		}
+		return "map(string, " + t.elem.String() + ")"
+	case kindNetworks:
+		return "networks"
+	default:
+		return "dyn"
+	}
+}
+
+// is reports whether a value of type t may be one of kinds
+func (t *exprType) is(kinds ...exprKind) bool {
+	if t.kind == kindDyn {
+		return true
+	}
+	for _, k := range kinds {
+		if t.kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *exprType) numeric() bool {
+	return t.is(kindInt, kindDouble)
+}
+
+// comparable reports whether values of the types can be compared for equality
+func comparable(a, b *exprType) bool {
+	switch {
+	case a.kind == kindDyn || b.kind == kindDyn || a.kind == kindNull || b.kind == kindNull:
+		return true
+	case a.numeric() && b.numeric():
+		return true
+	case a.kind == kindList && b.kind == kindList:
+		return comparable(a.elem, b.elem)
+	default:
+		return a.kind == b.kind
+	}
+}
+
+// exprEnv declares the variables an expression may reference
+type exprEnv map[string]*exprType
+
+// exprVars holds the values of the variables when evaluating
+type exprVars map[string]any
+
+// compiledExpr is a type checked expression ready to be evaluated
+type compiledExpr struct {
+	Source string
+	typ    *exprType
+	eval   evalFunc
+}
+
+type evalFunc func(vars exprVars) (any, error)
+
+// compileBoolExpr parses and checks an expression that decides a condition
+func compileBoolExpr(src string, env exprEnv) (*compiledExpr, error) {
+	e, err := compileExpr(src, env)
+	if err != nil {
+		return nil, err
+	}
+	if !e.typ.is(kindBool) {
+		return nil, fmt.Errorf("expression %q is of type %v, not bool", src, e.typ)
+	}
+	return e, nil
+}
+
+func compileExpr(src string, env exprEnv) (*compiledExpr, error) {
+	tokens, err := lexExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	p := &exprParser{tokens: tokens}
+	n, err := p.parseExpr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf(p.peek(), "unexpected %s", p.peek())
+	}
+	// operator and member chains are parsed in a loop, but checked and evaluated recursively
+	if err == nil && exprTooDeep(n, maxExprDepth) {
+		err = fmt.Errorf("nested more than %d deep", maxExprDepth)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	c, err := (&exprChecker{env: env}).check(n)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	c.Source = src
+	return c, nil
+}
+
+// evalBool evaluates the expression, errors such as a missing claim are returned rather than treated as false
+func (e *compiledExpr) evalBool(vars exprVars) (bool, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q evaluated to %v, not bool", e.Source, typeName(v))
+	}
+	return b, nil
+}
+
+// lexing
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokInt
+	tokDouble
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind  tokenKind
+	text  string
+	value any
+	// byte offset in the expression
+	pos int
+}
+
+func (t exprToken) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// operators, longest first so that <= is not lexed as <
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]"}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	i := 0
+next:
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) && (src[i] == '_' || unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i]))) {
+				i++
+			}
+			word := src[start:i]
+			if (word == "r" || word == "R") && i < len(src) && (src[i] == '\'' || src[i] == '"') {
+				s, end, err := lexString(src, i, true)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, exprToken{kind: tokString, text: src[start:end], value: s, pos: start})
+				i = end
+				continue
+			}
+			kind := tokIdent
+			if word == "in" {
+				kind = tokOp
+			}
+			tokens = append(tokens, exprToken{kind: kind, text: word, pos: start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.' || src[i] == 'e' || src[i] == 'E') {
+				i++
+			}
+			text := src[start:i]
+			if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+				tokens = append(tokens, exprToken{kind: tokInt, text: text, value: n, pos: start})
+			} else if f, err := strconv.ParseFloat(text, 64); err == nil {
+				tokens = append(tokens, exprToken{kind: tokDouble, text: text, value: f, pos: start})
+			} else {
+				return nil, fmt.Errorf("col %d: invalid number %q", start+1, text)
+			}
+		case c == '\'' || c == '"':
+			s, end, err := lexString(src, i, false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{kind: tokString, text: src[i:end], value: s, pos: i})
+			i = end
+		default:
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					continue next
+				}
+			}
+			return nil, fmt.Errorf("col %d: unexpected character %q", i+1, c)
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, pos: len(src)}), nil
+}
+
+// lexString reads the string literal starting with the quote at src[start], and returns it with the offset after it
+func lexString(src string, start int, raw bool) (string, int, error) {
+	quote := src[start]
+	var b strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && !raw && i+1 < len(src):
+			i++
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '\'', '"':
+				b.WriteByte(src[i])
+			default:
+				return "", 0, fmt.Errorf("col %d: invalid escape \\%c", i, src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("col %d: unterminated string", start+1)
+}
+
+// parsing
+
+// exprNode is a node of the syntax tree
+type exprNode struct {
+	// "literal", "ident", "list", "select", "index", "call", "?:", or a unary or binary operator
+	op  string
+	pos int
+	// value of literals
+	value any
+	// name of identifiers, selected fields and called functions
+	name string
+	// receiver of selections, indexing and method calls, nil for global functions
+	target *exprNode
+	// operands, arguments and list elements
+	args []*exprNode
+}
+
+// maxExprDepth caps how deeply expressions nest, so that parsing, checking and
+// evaluating them cannot exhaust the stack of the process hosting the module
+const maxExprDepth = 250
+
+type exprParser struct {
+	tokens []exprToken
+	i      int
+	// how deeply parseExpr and parseUnary are nested
+	depth int
+}
+
+// enter counts a level of recursion, the caller defers p.depth--
+func (p *exprParser) enter() error {
+	p.depth++
+	if p.depth > maxExprDepth {
+		return p.errorf(p.peek(), "nested more than %d deep", maxExprDepth)
+	}
+	return nil
+}
+
+// exprTooDeep reports whether the tree is deeper than limit, without recursing further than that
+func exprTooDeep(n *exprNode, limit int) bool {
+	if n == nil {
+		return false
+	}
+	if limit == 0 {
+		return true
+	}
+	if exprTooDeep(n.target, limit-1) {
+		return true
+	}
+	for _, a := range n.args {
+		if exprTooDeep(a, limit-1) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token when it is one of the operators
+func (p *exprParser) accept(ops ...string) (exprToken, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return p.next(), true
+		}
+	}
+	return t, false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return p.errorf(p.peek(), "expected %q, found %s", op, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(t exprToken, format string, a ...any) error {
+	return fmt.Errorf("col %d: %s", t.pos+1, fmt.Sprintf(format, a...))
+}
+
+func (p *exprParser) parseExpr() (*exprNode, error) {
+	defer func() { p.depth-- }()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := p.accept("?")
+	if !ok {
+		return cond, nil
+	}
+	then, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	els, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &exprNode{op: "?:", pos: t.pos, args: []*exprNode{cond, then, els}}, nil
+}
+
+// binary operators by precedence, loosest first
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (*exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.accept(exprPrecedence[level]...)
+		if !ok {
+			return x, nil
+		}
+		y, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &exprNode{op: t.text, pos: t.pos, args: []*exprNode{x, y}}
+	}
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	defer func() { p.depth-- }()
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	if t, ok := p.accept("!", "-"); ok {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: t.text, pos: t.pos, args: []*exprNode{x}}, nil
+	}
+	return p.parseMember()
+}
+
+func (p *exprParser) parseMember() (*exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if t, ok := p.accept("."); ok {
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, p.errorf(name, "expected a field name, found %s", name)
+			}
+			if _, ok := p.accept("("); ok {
+				args, err := p.parseList(")")
+				if err != nil {
+					return nil, err
+				}
+				x = &exprNode{op: "call", pos: name.pos, name: name.text, target: x, args: args}
+				continue
+			}
+			x = &exprNode{op: "select", pos: t.pos, name: name.text, target: x}
+		} else if t, ok := p.accept("["); ok {
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &exprNode{op: "index", pos: t.pos, target: x, args: []*exprNode{index}}
+		} else {
+			return x, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokInt, tokDouble, tokString:
+		return &exprNode{op: "literal", pos: t.pos, value: t.value}, nil
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return &exprNode{op: "literal", pos: t.pos, value: t.text == "true"}, nil
+		case "null":
+			return &exprNode{op: "literal", pos: t.pos}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{op: "call", pos: t.pos, name: t.text, args: args}, nil
+		}
+		return &exprNode{op: "ident", pos: t.pos, name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		case "[":
+			elems, err := p.parseList("]")
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{op: "list", pos: t.pos, args: elems}, nil
+		}
+	}
+	return nil, p.errorf(t, "unexpected %s", t)
+}
+
+// parseList parses comma separated expressions up to the closing token
+func (p *exprParser) parseList(closing string) ([]*exprNode, error) {
+	var list []*exprNode
+	if _, ok := p.accept(closing); ok {
+		return list, nil
+	}
+	for {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, x)
+		if _, ok := p.accept(closing); ok {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// checking, which also builds the function evaluating the node
+
+type exprChecker struct {
+	env exprEnv
+}
+
+func (c *exprChecker) errorf(n *exprNode, format string, a ...any) error {
+	return fmt.Errorf("col %d: %s", n.pos+1, fmt.Sprintf(format, a...))
+}
+
+func (c *exprChecker) check(n *exprNode) (*compiledExpr, error) {
+	switch n.op {
+	case "literal":
+		v := n.value
+		return &compiledExpr{typ: typeOfValue(v), eval: func(exprVars) (any, error) { return v, nil }}, nil
+	case "ident":
+		typ, ok := c.env[n.name]
+		if !ok {
+			return nil, c.errorf(n, "undeclared reference to %q", n.name)
+		}
+		name := n.name
+		return &compiledExpr{typ: typ, eval: func(vars exprVars) (any, error) { return vars[name], nil }}, nil
+	case "list":
+		return c.checkList(n)
+	case "select":
+		return c.checkSelect(n)
+	case "index":
+		return c.checkIndex(n)
+	case "call":
+		return c.checkCall(n)
+	case "?:":
+		return c.checkConditional(n)
+	case "!", "-":
+		if len(n.args) == 1 {
+			return c.checkUnary(n)
+		}
+	}
+	return c.checkBinary(n)
+}
+
+func (c *exprChecker) checkAll(nodes []*exprNode) ([]*compiledExpr, error) {
+	compiled := make([]*compiledExpr, len(nodes))
+	for i, n := range nodes {
+		var err error
+		if compiled[i], err = c.check(n); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+func (c *exprChecker) checkList(n *exprNode) (*compiledExpr, error) {
+	elems, err := c.checkAll(n.args)
+	if err != nil {
+		return nil, err
+	}
+	elem := typeDyn
+	for i, e := range elems {
+		if i == 0 {
+			elem = e.typ
+		} else if e.typ.kind != elem.kind {
+			elem = typeDyn
+		}
+	}
+	return &compiledExpr{typ: listOf(elem), eval: func(vars exprVars) (any, error) {
+		list := make([]any, len(elems))
+		for i, e := range elems {
+			v, err := e.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}}, nil
+}
+
+func (c *exprChecker) checkSelect(n *exprNode) (*compiledExpr, error) {
+	target, err := c.check(n.target)
+	if err != nil {
+		return nil, err
+	}
+	typ, err := c.fieldType(n, target.typ)
+	if err != nil {
+		return nil, err
+	}
+	field := n.name
+	return &compiledExpr{typ: typ, eval: func(vars exprVars) (any, error) {
+		v, err := target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("no field %q on %v", field, typeName(v))
+		}
+		fv, ok := m[field]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", field)
+		}
+		return fv, nil
+	}}, nil
+}
+
+// fieldType is the type of the field of a value of type t
+func (c *exprChecker) fieldType(n *exprNode, t *exprType) (*exprType, error) {
+	switch {
+	case t.kind == kindDyn:
+		return typeDyn, nil
+	case t.kind == kindMap && t.fields != nil:
+		ft, ok := t.fields[n.name]
+		if !ok {
+			return nil, c.errorf(n, "undefined field %q", n.name)
+		}
+		return ft, nil
+	case t.kind == kindMap:
+		return t.elem, nil
+	default:
+		return nil, c.errorf(n, "type %v has no fields", t)
+	}
+}
+
+func (c *exprChecker) checkIndex(n *exprNode) (*compiledExpr, error) {
+	target, err := c.check(n.target)
+	if err != nil {
+		return nil, err
+	}
+	index, err := c.check(n.args[0])
+	if err != nil {
+		return nil, err
+	}
+	var typ *exprType
+	switch {
+	case target.typ.kind == kindDyn:
+		typ = typeDyn
+	case target.typ.kind == kindList && index.typ.is(kindInt):
+		typ = target.typ.elem
+	case target.typ.kind == kindMap && index.typ.is(kindString):
+		typ = target.typ.elem
+	default:
+		return nil, c.errorf(n, "cannot index %v with %v", target.typ, index.typ)
+	}
+	return &compiledExpr{typ: typ, eval: func(vars exprVars) (any, error) {
+		v, err := target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		i, err := index.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case []any:
+			n, ok := i.(int64)
+			if !ok {
+				return nil, fmt.Errorf("cannot index list with %v", typeName(i))
+			}
+			if n < 0 || n >= int64(len(v)) {
+				return nil, fmt.Errorf("index %d out of range", n)
+			}
+			return v[n], nil
+		case map[string]any:
+			key, ok := i.(string)
+			if !ok {
+				return nil, fmt.Errorf("cannot index map with %v", typeName(i))
+			}
+			fv, ok := v[key]
+			if !ok {
+				return nil, fmt.Errorf("no such key: %s", key)
+			}
+			return fv, nil
+		default:
+			return nil, fmt.Errorf("cannot index %v", typeName(v))
+		}
+	}}, nil
+}
+
+func (c *exprChecker) checkConditional(n *exprNode) (*compiledExpr, error) {
+	args, err := c.checkAll(n.args)
+	if err != nil {
+		return nil, err
+	}
+	cond, then, els := args[0], args[1], args[2]
+	if !cond.typ.is(kindBool) {
+		return nil, c.errorf(n.args[0], "condition is of type %v, not bool", cond.typ)
+	}
+	typ := then.typ
+	if then.typ.kind != els.typ.kind {
+		typ = typeDyn
+	}
+	return &compiledExpr{typ: typ, eval: func(vars exprVars) (any, error) {
+		v, err := cond.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("condition evaluated to %v, not bool", typeName(v))
+		}
+		if b {
+			return then.eval(vars)
+		}
+		return els.eval(vars)
+	}}, nil
+}
+
+func (c *exprChecker) checkUnary(n *exprNode) (*compiledExpr, error) {
+	x, err := c.check(n.args[0])
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		if !x.typ.is(kindBool) {
+			return nil, c.errorf(n, "operator ! does not apply to %v", x.typ)
+		}
+		return &compiledExpr{typ: typeBool, eval: func(vars exprVars) (any, error) {
+			v, err := x.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			b, ok := v.(bool)
+			if !ok {
+				return nil, fmt.Errorf("operator ! does not apply to %v", typeName(v))
+			}
+			return !b, nil
+		}}, nil
+	}
+	if !x.typ.is(kindInt, kindDouble, kindDuration) {
+		return nil, c.errorf(n, "operator - does not apply to %v", x.typ)
+	}
+	return &compiledExpr{typ: x.typ, eval: func(vars exprVars) (any, error) {
+		v, err := x.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case int64:
+			return -v, nil
+		case float64:
+			return -v, nil
+		case time.Duration:
+			return -v, nil
+		default:
+			return nil, fmt.Errorf("operator - does not apply to %v", typeName(v))
+		}
+	}}, nil
+}
+
+func (c *exprChecker) checkBinary(n *exprNode) (*compiledExpr, error) {
+	args, err := c.checkAll(n.args)
+	if err != nil {
+		return nil, err
+	}
+	x, y := args[0], args[1]
+	op := n.op
+
+	if op == "&&" || op == "||" {
+		if !x.typ.is(kindBool) || !y.typ.is(kindBool) {
+			return nil, c.errorf(n, "operator %s does not apply to %v and %v", op, x.typ, y.typ)
+		}
+		return &compiledExpr{typ: typeBool, eval: func(vars exprVars) (any, error) {
+			return evalLogical(op, x, y, vars)
+		}}, nil
+	}
+
+	typ, ok := binaryType(op, x.typ, y.typ)
+	if !ok {
+		return nil, c.errorf(n, "operator %s does not apply to %v and %v", op, x.typ, y.typ)
+	}
+	return &compiledExpr{typ: typ, eval: func(vars exprVars) (any, error) {
+		a, err := x.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		b, err := y.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		return evalBinary(op, a, b)
+	}}, nil
+}
+
+// evalLogical evaluates && and ||, the right side is only evaluated when the left doesn't decide
+func evalLogical(op string, x, y *compiledExpr, vars exprVars) (any, error) {
+	a, err := x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	ab, ok := a.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operator %s does not apply to %v", op, typeName(a))
+	}
+	if (op == "&&" && !ab) || (op == "||" && ab) {
+		return ab, nil
+	}
+	b, err := y.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	bb, ok := b.(bool)
+	if !ok {
+		return nil, fmt.Errorf("operator %s does not apply to %v", op, typeName(b))
+	}
+	return bb, nil
+}
+
+// binaryType returns the type of the result of the operator, false when it doesn't apply to the operand types
+func binaryType(op string, x, y *exprType) (*exprType, bool) {
+	dyn := x.kind == kindDyn || y.kind == kindDyn
+	switch op {
+	case "==", "!=":
+		return typeBool, comparable(x, y)
+	case "<", "<=", ">", ">=":
+		ok := dyn || (x.numeric() && y.numeric()) || (x.kind == y.kind && x.is(kindString, kindTimestamp, kindDuration))
+		return typeBool, ok
+	case "in":
+		switch y.kind {
+		case kindDyn:
+			return typeBool, true
+		case kindList:
+			return typeBool, comparable(x, y.elem)
+		case kindMap:
+			return typeBool, x.is(kindString)
+		case kindNetworks:
+			return typeBool, x.is(kindString)
+		}
+		return nil, false
+	}
+
+	if dyn {
+		return typeDyn, true
+	}
+	switch {
+	case x.numeric() && y.numeric() && op != "%" || x.kind == kindInt && y.kind == kindInt:
+		if x.kind == kindDouble || y.kind == kindDouble {
+			return typeDouble, true
+		}
+		return typeInt, true
+	case op == "+" && x.kind == kindString && y.kind == kindString:
+		return typeString, true
+	case op == "+" && x.kind == kindList && y.kind == kindList:
+		return x, true
+	case op == "+" && (x.kind == kindTimestamp && y.kind == kindDuration || x.kind == kindDuration && y.kind == kindTimestamp):
+		return typeTimestamp, true
+	case (op == "+" || op == "-") && x.kind == kindDuration && y.kind == kindDuration:
+		return typeDuration, true
+	case op == "-" && x.kind == kindTimestamp && y.kind == kindDuration:
+		return typeTimestamp, true
+	case op == "-" && x.kind == kindTimestamp && y.kind == kindTimestamp:
+		return typeDuration, true
+	}
+	return nil, false
+}
+
+func evalBinary(op string, a, b any) (any, error) {
+	switch op {
+	case "==":
+		return valuesEqual(a, b), nil
+	case "!=":
+		return !valuesEqual(a, b), nil
+	case "<", "<=", ">", ">=":
+		cmp, err := compareValues(a, b)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "<":
+			return cmp < 0, nil
+		case "<=":
+			return cmp <= 0, nil
+		case ">":
+			return cmp > 0, nil
+		default:
+			return cmp >= 0, nil
+		}
+	case "in":
+		return evalIn(a, b)
+	}
+
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return evalInt(op, a, b)
+		case float64:
+			return evalDouble(op, float64(a), b)
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return evalDouble(op, a, float64(b))
+		case float64:
+			return evalDouble(op, a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok && op == "+" {
+			return a + b, nil
+		}
+	case []any:
+		if b, ok := b.([]any); ok && op == "+" {
+			return append(append([]any{}, a...), b...), nil
+		}
+	case time.Time:
+		switch b := b.(type) {
+		case time.Duration:
+			if op == "+" {
+				return a.Add(b), nil
+			}
+			if op == "-" {
+				return a.Add(-b), nil
+			}
+		case time.Time:
+			if op == "-" {
+				return a.Sub(b), nil
+			}
+		}
+	case time.Duration:
+		switch b := b.(type) {
+		case time.Duration:
+			if op == "+" {
+				return a + b, nil
+			}
+			if op == "-" {
+				return a - b, nil
+			}
+		case time.Time:
+			if op == "+" {
+				return b.Add(a), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("operator %s does not apply to %v and %v", op, typeName(a), typeName(b))
+}
+
+func evalInt(op string, a, b int64) (any, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/", "%":
+		if b == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}
+	return nil, fmt.Errorf("operator %s does not apply to int", op)
+}
+
+func evalDouble(op string, a, b float64) (any, error) {
+	switch op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	}
+	return nil, fmt.Errorf("operator %s does not apply to double", op)
+}
+
+func evalIn(a, b any) (any, error) {
+	switch b := b.(type) {
+	case []any:
+		for _, e := range b {
+			if valuesEqual(a, e) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]any:
+		key, ok := a.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator in does not apply to %v and map", typeName(a))
+		}
+		_, ok = b[key]
+		return ok, nil
+	case []netip.Prefix:
+		s, ok := a.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator in does not apply to %v and networks", typeName(a))
+		}
+		addr, local, err := parseRhost(s)
+		if err != nil || local {
+			// the unix socket and anything that isn't an address is in no network
+			return false, nil
+		}
+		for _, p := range b {
+			if p.Contains(addr) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return nil, fmt.Errorf("operator in does not apply to %v", typeName(b))
+}
+
+func valuesEqual(a, b any) bool {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return a == b
+		case float64:
+			return float64(a) == b
+		}
+		return false
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return a == float64(b)
+		case float64:
+			return a == b
+		}
+		return false
+	case time.Time:
+		bt, ok := b.(time.Time)
+		return ok && a.Equal(bt)
+	case []any:
+		bl, ok := b.([]any)
+		if !ok || len(a) != len(bl) {
+			return false
+		}
+		for i := range a {
+			if !valuesEqual(a[i], bl[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		bm, ok := b.(map[string]any)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+		for k, v := range a {
+			if bv, ok := bm[k]; !ok || !valuesEqual(v, bv) {
+				return false
+			}
+		}
+		return true
+	case nil, bool, string, time.Duration:
+		return a == b
+	default:
+		return false
+	}
+}
+
+func compareValues(a, b any) (int, error) {
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmpOrdered(a, b), nil
+		case float64:
+			return cmpOrdered(float64(a), b), nil
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmpOrdered(a, float64(b)), nil
+		case float64:
+			return cmpOrdered(a, b), nil
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), nil
+		}
+	case time.Duration:
+		if b, ok := b.(time.Duration); ok {
+			return cmpOrdered(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot compare %v and %v", typeName(a), typeName(b))
+}
+
+func cmpOrdered[T int64 | float64 | time.Duration](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// functions
+
+func (c *exprChecker) checkCall(n *exprNode) (*compiledExpr, error) {
+	if n.name == "has" && n.target == nil {
+		return c.checkHas(n)
+	}
+
+	var target *compiledExpr
+	if n.target != nil {
+		var err error
+		if target, err = c.check(n.target); err != nil {
+			return nil, err
+		}
+	}
+	args, err := c.checkAll(n.args)
+	if err != nil {
+		return nil, err
+	}
+	// size(x) is the same as x.size()
+	if target == nil && len(args) == 1 && n.name == "size" {
+		target, args = args[0], nil
+	}
+
+	fn, ok := exprFunctions[n.name]
+	if !ok || (target == nil) != (fn.receiver == nil) {
+		return nil, c.errorf(n, "undeclared function %q", n.name)
+	}
+	if target != nil && !target.typ.is(fn.receiver...) {
+		return nil, c.errorf(n, "function %q does not apply to %v", n.name, target.typ)
+	}
+	if len(args) < len(fn.params) || len(args) > len(fn.params)+len(fn.optional) {
+		return nil, c.errorf(n, "function %q takes %d arguments, %d given", n.name, len(fn.params), len(args))
+	}
+	prepared := make([]any, len(args))
+	for i, a := range args {
+		want := append(fn.params, fn.optional...)[i]
+		if want != kindDyn && !a.typ.is(want) {
+			return nil, c.errorf(n.args[i], "argument %d of %q is of type %v, not %v", i+1, n.name, a.typ, (&exprType{kind: want}))
+		}
+		// arguments known up front are checked and prepared up front, such as a timezone or regular expression
+		if n.args[i].op == "literal" && fn.prepareLiteral != nil {
+			v, err := fn.prepareLiteral(n.args[i].value)
+			if err != nil {
+				return nil, c.errorf(n.args[i], "%v", err)
+			}
+			prepared[i] = v
+		}
+	}
+
+	name := n.name
+	return &compiledExpr{typ: fn.result, eval: func(vars exprVars) (any, error) {
+		var recv any
+		if target != nil {
+			v, err := target.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			recv = v
+		}
+		values := make([]any, len(args))
+		for i, a := range args {
+			if prepared[i] != nil {
+				values[i] = prepared[i]
+				continue
+			}
+			v, err := a.eval(vars)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		v, err := fn.call(recv, values)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		return v, nil
+	}}, nil
+}
+
+// checkHas checks has(x.f), which tests whether x has the field f instead of failing when it doesn't
+func (c *exprChecker) checkHas(n *exprNode) (*compiledExpr, error) {
+	if len(n.args) != 1 || n.args[0].op != "select" {
+		return nil, c.errorf(n, "has() takes a field selection, such as has(claims.aal)")
+	}
+	sel := n.args[0]
+	target, err := c.check(sel.target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.fieldType(sel, target.typ); err != nil {
+		return nil, err
+	}
+	field := sel.name
+	return &compiledExpr{typ: typeBool, eval: func(vars exprVars) (any, error) {
+		v, err := target.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("has: no field %q on %v", field, typeName(v))
+		}
+		_, ok = m[field]
+		return ok, nil
+	}}, nil
+}
+
+type exprFunction struct {
+	// kinds of the receiver of methods, nil for global functions
+	receiver []exprKind
+	params   []exprKind
+	optional []exprKind
+	result   *exprType
+	// checks and prepares an argument given as a literal when the expression
+	// is compiled, such as a regular expression. call is then passed what it
+	// returned instead of the literal.
+	prepareLiteral func(v any) (any, error)
+	call           func(recv any, args []any) (any, error)
+}
+
+var exprFunctions map[string]exprFunction
+
+func init() {
+	stringMethod := func(fn func(s, arg string) bool) exprFunction {
+		return exprFunction{receiver: []exprKind{kindString}, params: []exprKind{kindString}, result: typeBool,
+			call: func(recv any, args []any) (any, error) {
+				s, ok1 := recv.(string)
+				arg, ok2 := args[0].(string)
+				if !ok1 || !ok2 {
+					return nil, fmt.Errorf("does not apply to %v", typeName(recv))
+				}
+				return fn(s, arg), nil
+			}}
+	}
+	timeMethod := func(fn func(t time.Time) int) exprFunction {
+		return exprFunction{receiver: []exprKind{kindTimestamp}, optional: []exprKind{kindString}, result: typeInt,
+			prepareLiteral: func(v any) (any, error) {
+				return time.LoadLocation(v.(string))
+			},
+			call: func(recv any, args []any) (any, error) {
+				t, ok := recv.(time.Time)
+				if !ok {
+					return nil, fmt.Errorf("does not apply to %v", typeName(recv))
+				}
+				if len(args) == 1 {
+					loc, ok := args[0].(*time.Location)
+					if !ok {
+						tz, _ := args[0].(string)
+						var err error
+						if loc, err = time.LoadLocation(tz); err != nil {
+							return nil, err
+						}
+					}
+					t = t.In(loc)
+				} else {
+					t = t.UTC()
+				}
+				return int64(fn(t)), nil
+			}}
+	}
+
+	exprFunctions = map[string]exprFunction{
+		"startsWith": stringMethod(strings.HasPrefix),
+		"endsWith":   stringMethod(strings.HasSuffix),
+		"contains":   stringMethod(strings.Contains),
+		"matches": {
+			receiver: []exprKind{kindString}, params: []exprKind{kindString}, result: typeBool,
+			prepareLiteral: func(v any) (any, error) {
+				return regexp.Compile(v.(string))
+			},
+			call: func(recv any, args []any) (any, error) {
+				s, ok := recv.(string)
+				if !ok {
+					return nil, fmt.Errorf("does not apply to %v", typeName(recv))
+				}
+				switch pattern := args[0].(type) {
+				case *regexp.Regexp:
+					return pattern.MatchString(s), nil
+				case string:
+					return regexp.MatchString(pattern, s)
+				}
+				return nil, fmt.Errorf("does not apply to %v", typeName(args[0]))
+			},
+		},
+		"size": {
+			receiver: []exprKind{kindString, kindList, kindMap}, result: typeInt,
+			call: func(recv any, args []any) (any, error) {
+				switch v := recv.(type) {
+				case string:
+					return int64(len([]rune(v))), nil
+				case []any:
+					return int64(len(v)), nil
+				case map[string]any:
+					return int64(len(v)), nil
+				}
+				return nil, fmt.Errorf("does not apply to %v", typeName(recv))
+			},
+		},
+		"getHours":     timeMethod(func(t time.Time) int { return t.Hour() }),
+		"getMinutes":   timeMethod(func(t time.Time) int { return t.Minute() }),
+		"getDayOfWeek": timeMethod(func(t time.Time) int { return int(t.Weekday()) }),
+		"getDate":      timeMethod(func(t time.Time) int { return t.Day() }),
+		"duration": {
+			params: []exprKind{kindString}, result: typeDuration,
+			prepareLiteral: func(v any) (any, error) {
+				return time.ParseDuration(v.(string))
+			},
+			call: func(_ any, args []any) (any, error) {
+				if d, ok := args[0].(time.Duration); ok {
+					return d, nil
+				}
+				s, _ := args[0].(string)
+				return time.ParseDuration(s)
+			},
+		},
+		"timestamp": {
+			params: []exprKind{kindString}, result: typeTimestamp,
+			prepareLiteral: func(v any) (any, error) {
+				return time.Parse(time.RFC3339, v.(string))
+			},
+			call: func(_ any, args []any) (any, error) {
+				if t, ok := args[0].(time.Time); ok {
+					return t, nil
+				}
+				s, _ := args[0].(string)
+				return time.Parse(time.RFC3339, s)
+			},
+		},
+		"int": {
+			params: []exprKind{kindDyn}, result: typeInt,
+			call: func(_ any, args []any) (any, error) {
+				switch v := args[0].(type) {
+				case int64:
+					return v, nil
+				case float64:
+					if math.IsNaN(v) || math.IsInf(v, 0) {
+						return nil, fmt.Errorf("cannot convert %v to int", v)
+					}
+					return int64(v), nil
+				case string:
+					return strconv.ParseInt(v, 10, 64)
+				case time.Time:
+					return v.Unix(), nil
+				}
+				return nil, fmt.Errorf("cannot convert %v to int", typeName(args[0]))
+			},
+		},
+		"double": {
+			params: []exprKind{kindDyn}, result: typeDouble,
+			call: func(_ any, args []any) (any, error) {
+				switch v := args[0].(type) {
+				case int64:
+					return float64(v), nil
+				case float64:
+					return v, nil
+				case string:
+					return strconv.ParseFloat(v, 64)
+				}
+				return nil, fmt.Errorf("cannot convert %v to double", typeName(args[0]))
+			},
+		},
+		"string": {
+			params: []exprKind{kindDyn}, result: typeString,
+			call: func(_ any, args []any) (any, error) {
+				switch v := args[0].(type) {
+				case string:
+					return v, nil
+				case int64, float64, bool, time.Duration:
+					return fmt.Sprint(v), nil
+				case time.Time:
+					return v.UTC().Format(time.RFC3339), nil
+				}
+				return nil, fmt.Errorf("cannot convert %v to string", typeName(args[0]))
+			},
+		},
+	}
+}
+
+// values
+
+// typeOfValue is the static type of a literal
+func typeOfValue(v any) *exprType {
+	switch v.(type) {
+	case nil:
+		return typeNull
+	case bool:
+		return typeBool
+	case int64:
+		return typeInt
+	case float64:
+		return typeDouble
+	case string:
+		return typeString
+	default:
+		return typeDyn
+	}
+}
+
+// typeName names the type of a runtime value in errors
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case time.Time:
+		return "timestamp"
+	case time.Duration:
+		return "duration"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "map"
+	case []netip.Prefix:
+		return "networks"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+// exprValue converts decoded JSON, such as the claims of a token, to the values expressions work with
+func exprValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	case int:
+		return int64(v)
+	case []any:
+		list := make([]any, len(v))
+		for i, e := range v {
+			list[i] = exprValue(e)
+		}
+		return list
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = exprValue(e)
+		}
+		return m
+	default:
+		return v
+	}
+}
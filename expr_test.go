@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpr_eval(t *testing.T) {
+	env := exprEnv{
+		"role":   typeString,
+		"n":      typeInt,
+		"claims": mapOf(typeDyn),
+		"now":    typeTimestamp,
+		"corp":   typeNetworks,
+		"rhost":  typeString,
+	}
+	vars := exprVars{
+		"role":   "postgres",
+		"n":      int64(7),
+		"claims": exprValue(map[string]any{"aal": "aal2", "exp": json.Number("1700000000"), "amr": []any{map[string]any{"method": "totp"}}, "roles": []any{"a", "b"}}),
+		// a Wednesday, 10:00 in Berlin
+		"now":   time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC),
+		"corp":  []netip.Prefix{netip.MustParsePrefix("10.8.0.0/16")},
+		"rhost": "10.8.1.2",
+	}
+
+	for src, want := range map[string]any{
+		`role == 'postgres'`: true,
+		`role != "postgres"`: false,
+		`role == 'postgres' ? claims.aal == 'aal2' : true`: true,
+		`rhost in corp`: true,
+		`'192.0.2.1' in corp || '[local]' in corp`: false,
+		`n * 2 + 1`:                int64(15),
+		`n / 2 == 3 && n % 2 == 1`: true,
+		`n > 6.5`:                  true,
+		`-n < 0`:                   true,
+		`claims.exp > 1600000000`:  true,
+		`claims['aal'] == 'aal2'`:  true,
+		`claims.amr[0].method in ['totp', 'webauthn']`:                                             true,
+		`'b' in claims.roles && size(claims.roles) == 2`:                                           true,
+		`'aal' in claims && !has(claims.email)`:                                                    true,
+		`role.startsWith('post') && role.endsWith('gres') && role.contains('stg')`:                 true,
+		`role.matches(r'^post\w+$')`:                                                               true,
+		`role.matches(role) && now.getHours(claims.aal == 'aal2' ? 'Europe/Berlin' : 'UTC') == 10`: true,
+		`duration(role == 'postgres' ? '1h' : '2h') == duration('1h')`:                             true,
+		`role + '_' + string(n)`:                                                                   "postgres_7",
+		`size('héllo')`:                                                                            int64(5),
+		`int('42') + int(2.9)`:                                                                     int64(44),
+		`now.getHours() == 8 && now.getHours('Europe/Berlin') == 10`:                               true,
+		`now.getDayOfWeek() == 3 && now.getDate() == 23`:                                           true,
+		`now - timestamp('2025-07-23T07:00:00Z') == duration('1h')`:                                true,
+		`now + duration('30m') > now`:                                                              true,
+		`[1, 2] + [3] == [1, 2, 3]`:                                                                true,
+		`null == null`:                                                                             true,
+		`false && claims.missing == 1`:                                                             false,
+	} {
+		e, err := compileExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		v, err := e.eval(vars)
+		assert.NoError(t, err, src)
+		assert.Equal(t, want, v, src)
+	}
+
+	for src, want := range map[string]string{
+		`claims.missing == 1`:    "no such key: missing",
+		`claims.roles[5] == 'a'`: "index 5 out of range",
+		`n / (n - 7) == 1`:       "division by zero",
+		`claims.aal > 1`:         "cannot compare string and int",
+		`!claims.aal`:            "operator ! does not apply to string",
+	} {
+		e, err := compileExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		_, err = e.eval(vars)
+		assert.ErrorContains(t, err, want, src)
+	}
+}
+
+func TestExpr_compile(t *testing.T) {
+	env := exprEnv{"role": typeString, "n": typeInt, "claims": mapOf(typeDyn), "now": typeTimestamp,
+		"grant": objectOf(map[string]*exprType{"role": typeString})}
+
+	for src, want := range map[string]string{
+		`rol == 'x'`:                   `col 1: undeclared reference to "rol"`,
+		`role == 1`:                    "operator == does not apply to string and int",
+		`role && true`:                 "operator && does not apply to string and bool",
+		`role < 1`:                     "operator < does not apply to string and int",
+		`n.startsWith('a')`:            `function "startsWith" does not apply to int`,
+		`role.frobnicate()`:            `undeclared function "frobnicate"`,
+		`role.matches('[')`:            "missing closing ]",
+		`duration('soon')`:             `invalid duration "soon"`,
+		`now.getHours('Mars/Olympus')`: "unknown time zone Mars/Olympus",
+		`grant.expires == 1`:           `undefined field "expires"`,
+		`role.length`:                  "type string has no fields",
+		`has(role)`:                    "has() takes a field selection",
+		`role == 'x`:                   "unterminated string",
+		`role == 'x' &&`:               "unexpected end of expression",
+		`(role == 'x'`:                 `expected ")"`,
+		`role # 1`:                     "unexpected character '#'",
+		`role == 'x' role`:             `unexpected "role"`,
+		`n ? 1 : 2`:                    "condition is of type int, not bool",
+		`role in n`:                    "operator in does not apply to string and int",
+	} {
+		_, err := compileExpr(src, env)
+		assert.ErrorContains(t, err, want, src)
+	}
+
+	for _, src := range []string{
+		strings.Repeat("(", 1000) + "n" + strings.Repeat(")", 1000),
+		strings.Repeat("!", 1000) + "true",
+		"n" + strings.Repeat(" + 1", 1000),
+		"claims" + strings.Repeat(".a", 1000),
+		strings.Repeat("[", 1000) + strings.Repeat("]", 1000),
+	} {
+		_, err := compileExpr(src, env)
+		assert.ErrorContains(t, err, "nested more than 250 deep", src[:20])
+	}
+	_, err := compileExpr(strings.Repeat("(", 100)+"n"+strings.Repeat(" + 1)", 100), env)
+	assert.NoError(t, err)
+
+	_, err = compileBoolExpr(`n + 1`, env)
+	assert.ErrorContains(t, err, "is of type int, not bool")
+	e, err := compileBoolExpr(`claims.aal`, env)
+	assert.NoError(t, err)
+	_, err = e.evalBool(exprVars{"claims": map[string]any{"aal": "aal2"}})
+	assert.ErrorContains(t, err, "evaluated to string, not bool")
+	assert.True(t, strings.HasPrefix(e.Source, "claims"))
+}
+
+func TestExpr_precedence(t *testing.T) {
+	env := exprEnv{"n": typeInt}
+	vars := exprVars{"n": int64(7)}
+	for src, want := range map[string]any{
+		`1 + 2 * 3`:                    int64(7),
+		`(1 + 2) * 3`:                  int64(9),
+		`10 - 4 - 3`:                   int64(3),
+		`16 / 4 / 2`:                   int64(2),
+		`7 % 4 * 2`:                    int64(6),
+		`-n * 2`:                       int64(-14),
+		`- -n`:                         int64(7),
+		`n + 1 == 8`:                   true,
+		`n < 8 == true`:                true,
+		`1 + 1 in [2]`:                 true,
+		`true || false && false`:       true,
+		`(true || false) && false`:     false,
+		`!false && false`:              false,
+		`!(false && false)`:            true,
+		`n > 5 && n < 10 || n == 0`:    true,
+		`false ? 1 : true ? 2 : 3`:     int64(2),
+		`n == 7 ? n * 2 : n + 1`:       int64(14),
+		`true || n / 0 == 1`:           true,
+		`n > 0 && n < 10 ? 'a' : 'b'`:  "a",
+		`[1, 2][1] + 1`:                int64(3),
+		`'ab'.startsWith('a') && true`: true,
+	} {
+		e, err := compileExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		v, err := e.eval(vars)
+		assert.NoError(t, err, src)
+		assert.Equal(t, want, v, src)
+	}
+
+	// as in CEL, the branch taken when true is not itself a conditional
+	_, err := compileExpr(`true ? false ? 1 : 2 : 3`, env)
+	assert.ErrorContains(t, err, `expected ":", found "?"`)
+}
+
+func TestExpr_has(t *testing.T) {
+	env := exprEnv{"claims": mapOf(typeDyn), "grant": objectOf(map[string]*exprType{"role": typeString, "org": mapOf(typeDyn)})}
+	vars := exprVars{
+		"claims": exprValue(map[string]any{"aal": "aal2", "org": map[string]any{"id": "o1", "team": map[string]any{}}, "email": nil}),
+		"grant":  map[string]any{"role": "postgres", "org": map[string]any{}},
+	}
+
+	for src, want := range map[string]bool{
+		`has(claims.aal)`:                          true,
+		`has(claims.missing)`:                      false,
+		`has(claims.email)`:                        true,
+		`has(claims.org.id)`:                       true,
+		`has(claims.org.name)`:                     false,
+		`has(claims.org.team.lead)`:                false,
+		`has(claims.missing) && claims.missing.x`:  false,
+		`!has(claims.missing) || claims.missing.x`: true,
+		`has(grant.role)`:                          true,
+		`has(grant.org.id)`:                        false,
+	} {
+		e, err := compileBoolExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		v, err := e.evalBool(vars)
+		assert.NoError(t, err, src)
+		assert.Equal(t, want, v, src)
+	}
+
+	// a missing or non-map parent is an error, as in CEL
+	for src, want := range map[string]string{
+		`has(claims.missing.x)`: "no such key: missing",
+		`has(claims.aal.x)`:     `has: no field "x" on string`,
+	} {
+		e, err := compileBoolExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		_, err = e.evalBool(vars)
+		assert.ErrorContains(t, err, want, src)
+	}
+
+	for src, want := range map[string]string{
+		`has(claims)`:         "has() takes a field selection",
+		`has(claims['aal'])`:  "has() takes a field selection",
+		`has(grant.expires)`:  `undefined field "expires"`,
+		`has(grant.role.len)`: "type string has no fields",
+	} {
+		_, err := compileBoolExpr(src, env)
+		assert.ErrorContains(t, err, want, src)
+	}
+}
+
+func TestExpr_dynComparisons(t *testing.T) {
+	env := exprEnv{"claims": mapOf(typeDyn), "now": typeTimestamp}
+	vars := exprVars{
+		"claims": exprValue(map[string]any{"n": json.Number("2"), "half": json.Number("2.5"), "s": "2", "b": true, "none": nil, "list": []any{"2"}, "obj": map[string]any{"a": json.Number("1")}}),
+		"now":    time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC),
+	}
+
+	for src, want := range map[string]bool{
+		// numbers compare across int and double
+		`claims.n == 2`:          true,
+		`claims.n == 2.0`:        true,
+		`claims.half > claims.n`: true,
+		`claims.half < 3`:        true,
+		`claims.n in [1.0, 2.0]`: true,
+		// values of different types are never equal
+		`claims.n == '2'`:              false,
+		`claims.s == 2`:                false,
+		`claims.s != 2`:                true,
+		`claims.b == 1`:                false,
+		`claims.none == null`:          true,
+		`claims.n == null`:             false,
+		`claims.list == ['2']`:         true,
+		`claims.list == [2]`:           false,
+		`claims.obj == claims.obj`:     true,
+		`claims.n in claims.list`:      false,
+		`claims.s in claims.list`:      true,
+		`claims.n == claims.s`:         false,
+		`claims.obj.a == claims.n - 1`: true,
+	} {
+		e, err := compileBoolExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		v, err := e.evalBool(vars)
+		assert.NoError(t, err, src)
+		assert.Equal(t, want, v, src)
+	}
+
+	// but are not ordered
+	for src, want := range map[string]string{
+		`claims.s < 3`:        "cannot compare string and int",
+		`claims.n >= '1'`:     "cannot compare int and string",
+		`claims.none > 1`:     "cannot compare null and int",
+		`claims.b <= true`:    "cannot compare bool and bool",
+		`claims.list > [1]`:   "cannot compare list and list",
+		`claims.s < now`:      "cannot compare string and timestamp",
+		`claims.n + claims.s`: "operator + does not apply to int and string",
+	} {
+		e, err := compileExpr(src, env)
+		if !assert.NoError(t, err, src) {
+			continue
+		}
+		_, err = e.eval(vars)
+		assert.ErrorContains(t, err, want, src)
+	}
+}
+
+// FuzzExpr checks that no expression, however malformed, makes compiling or
+// evaluating panic, and that an expression evaluates to its static type
+func FuzzExpr(f *testing.F) {
+	for _, src := range []string{
+		`role == 'postgres' ? claims.aal == 'aal2' && rhost in corp : true`,
+		`has(claims.org.id) && claims.amr[0].method in ['totp', 'webauthn']`,
+		`n * 2 + 1 > 6.5 || -n % 3 == 1`,
+		`role.matches(r'^post\w+$') && size(role) < 10`,
+		`now.getHours('Europe/Berlin') < 18 && now - duration('1h') > timestamp('2025-01-01T00:00:00Z')`,
+		`int('42') + int(2.9) == 44 && string(n) + "x" != double(n)`,
+		`[1, 2] + [3] == [1, 2, 3] && null == null`,
+		`claims['aal'] != 'aal1' ? (1 / (n - 7)) : 0`,
+		`"unterminated`,
+		`((((`,
+		strings.Repeat("(", 1000) + "n" + strings.Repeat(")", 1000),
+		strings.Repeat("-", 1000) + "n",
+		"n" + strings.Repeat(" * 1", 1000) + " > 0",
+		`role.matches(role) && now.getHours(role) > 0`,
+	} {
+		f.Add(src)
+	}
+	env := exprEnv{"role": typeString, "n": typeInt, "claims": mapOf(typeDyn), "now": typeTimestamp, "corp": typeNetworks, "rhost": typeString}
+	vars := exprVars{
+		"role":   "postgres",
+		"n":      int64(7),
+		"claims": exprValue(map[string]any{"aal": "aal2", "org": map[string]any{"id": "o1"}, "amr": []any{map[string]any{"method": "totp"}}, "n": json.Number("1.5")}),
+		"now":    time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC),
+		"corp":   []netip.Prefix{netip.MustParsePrefix("10.8.0.0/16")},
+		"rhost":  "10.8.1.2",
+	}
+
+	f.Fuzz(func(t *testing.T, src string) {
+		e, err := compileExpr(src, env)
+		if err != nil {
+			return
+		}
+		v, err := e.eval(vars)
+		if err != nil {
+			return
+		}
+		switch e.typ.kind {
+		case kindBool, kindInt, kindDouble, kindString:
+			if got := typeOfValue(v); got.kind != e.typ.kind {
+				t.Errorf("%q is of type %v but evaluated to %v", src, e.typ, typeName(v))
+			}
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// fileStore is a JSON document shared by every process that uses the same
+// path, such as all Postgres backends loading the module. Access is serialised
+// with a flock on <path>.lock, writes replace the file atomically.
+type fileStore[T any] struct {
+	Path string
+	// only use the store once the backends created it. The admin commands set
+	// this, run as root before any login they would create a directory and
+	// lock the backends can't open. A missing store reads as empty.
+	Existing bool
+}
+
+// errNoStore is returned by lockFile when the store does not exist and may not be created
+var errNoStore = errors.New("store does not exist")
+
+// view calls fn with the stored document, or the zero value when there is none yet
+func (s *fileStore[T]) view(fn func(doc *T) error) error {
+	unlock, err := lockFile(s.Path, syscall.LOCK_SH, !s.Existing)
+	if errors.Is(err, errNoStore) {
+		return fn(new(T))
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	doc, err := s.read()
+	if err != nil {
+		return err
+	}
+	return fn(doc)
+}
+
+// update calls fn with the stored document and writes it back when fn succeeds.
+// No other process reads or writes the document until update returns.
+func (s *fileStore[T]) update(fn func(doc *T) error) error {
+	unlock, err := lockFile(s.Path, syscall.LOCK_EX, !s.Existing)
+	if errors.Is(err, errNoStore) {
+		// there is nothing to change, and nowhere to keep a change
+		return fn(new(T))
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	doc, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := fn(doc); err != nil {
+		return err
+	}
+	return s.write(doc)
+}
+
+// lockFile takes a flock on <path>.lock, shared (LOCK_SH) or exclusive (LOCK_EX), and returns the function releasing it.
+// Without create it returns errNoStore when the lock doesn't exist yet.
+func lockFile(path string, how int, create bool) (func(), error) {
+	lock := path + ".lock"
+	var f *os.File
+	var err error
+	if create {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+		f, err = os.OpenFile(lock, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			if err := adoptOwner(f); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to create lock: %w", err)
+			}
+		} else if errors.Is(err, fs.ErrExist) {
+			f, err = os.OpenFile(lock, os.O_RDWR, 0)
+		}
+	} else {
+		f, err = os.OpenFile(lock, os.O_RDWR, 0)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errNoStore
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// adoptOwner gives a file root created the owner of its directory, so that the
+// backends, running as whoever owns the directory, can still open it. It does
+// nothing for other users, their files are owned by them already.
+func adoptOwner(f *os.File) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	fi, err := os.Stat(filepath.Dir(f.Name()))
+	if err != nil {
+		return err
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	return f.Chown(int(st.Uid), int(st.Gid))
+}
+
+func (s *fileStore[T]) read() (*T, error) {
+	doc := new(T)
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return doc, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	if err := json.Unmarshal(data, doc); err != nil {
+		// a damaged store only loses what was in it, it must not lock everyone out
+		return new(T), nil
+	}
+	return doc, nil
+}
+
+func (s *fileStore[T]) write(doc *T) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := adoptOwner(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+	return nil
+}
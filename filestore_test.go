@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore_existing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "run")
+	path := filepath.Join(dir, "store.json")
+	admin := &fileStore[map[string]int]{Path: path, Existing: true}
+
+	// an admin command run before any login leaves nothing behind
+	assert.NoError(t, admin.view(func(doc *map[string]int) error {
+		assert.Empty(t, *doc)
+		return nil
+	}))
+	assert.NoError(t, admin.update(func(doc *map[string]int) error {
+		*doc = map[string]int{"a": 1}
+		return nil
+	}))
+	_, err := os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// once a backend created the store, admin commands use it
+	backend := &fileStore[map[string]int]{Path: path}
+	assert.NoError(t, backend.update(func(doc *map[string]int) error {
+		*doc = map[string]int{"a": 1}
+		return nil
+	}))
+	assert.NoError(t, admin.update(func(doc *map[string]int) error {
+		delete(*doc, "a")
+		return nil
+	}))
+	assert.NoError(t, backend.view(func(doc *map[string]int) error {
+		assert.Empty(t, *doc)
+		return nil
+	}))
+}
+
+func TestFileStore_owner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root hands files to another owner")
+	}
+	// the directory of the backends, running as nobody
+	dir := t.TempDir()
+	assert.NoError(t, os.Chown(dir, 65534, 65534))
+	path := filepath.Join(dir, "store.json")
+
+	assert.NoError(t, (&fileStore[map[string]int]{Path: path}).update(func(doc *map[string]int) error {
+		*doc = map[string]int{"a": 1}
+		return nil
+	}))
+	for _, p := range []string{path, path + ".lock"} {
+		fi, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(65534), fi.Sys().(*syscall.Stat_t).Uid, p)
+	}
+}
@@ -27,6 +27,7 @@
             buildPhase = ''
               runHook preBuild
               go build -buildmode=c-shared -o pam_jit_pg.so
+              go build -o gatekeeperd
               runHook postBuild
             '';
 
@@ -40,6 +41,8 @@
               runHook preInstall
               mkdir -p $out/lib/security
               cp pam_jit_pg.so $out/lib/security/
+              install -Dm755 gatekeeperd $out/bin/gatekeeperd
+              ln -s gatekeeperd $out/bin/gatekeeper
               runHook postInstall
             '';
           };
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"strings"
+	"time"
+)
+
+// loginRequest is a login to decide on, as received from Postgres through PAM
+type loginRequest struct {
+	User  string `json:"user"`
+	Rhost string `json:"rhost"`
+	// empty when only checking whether the connection is trusted
+	Token string `json:"token,omitempty"`
+	// the Postgres backend the login is for, gatekeeperd takes it from the peer credentials
+	PID int `json:"pid,omitempty"`
+}
+
+type logFunc func(priority syslog.Priority, format string, a ...any)
+
+// loginEvaluator decides logins, either in-process (gatekeeper) or by asking gatekeeperd (daemonClient)
+type loginEvaluator interface {
+	// Trust returns the grant for a login from a trusted connection, or nil when a token is needed
+	Trust(ctx context.Context, req *loginRequest) (*grant, error)
+	// Authenticate authenticates the token of the login. Errors wrap one of the sentinel errors in errors.go.
+	Authenticate(ctx context.Context, req *loginRequest) (*grant, error)
+}
+
+// gatekeeper evaluates logins against a config. The PAM module creates one
+// per login, gatekeeperd keeps one for every login until the config is reloaded.
+type gatekeeper struct {
+	config   *config
+	registry registry
+	// nil when decisions are not cached
+	cache *decisionCache
+	// nil when failed logins are not tracked
+	lockouts *lockouts
+	// nil when logins are not recorded per backend
+	sessions *sessionStore
+	// nil when decisions are not audited
+	auditLog *auditLog
+	// nil when no metrics are kept
+	metrics *metrics
+	// nil when not tracing
+	tracer *tracer
+	// nil when there is no local policy
+	policy *policy
+	log    logFunc
+}
+
+func newGatekeeper(cfg *config, log logFunc) (*gatekeeper, error) {
+	r, err := newRegistry(cfg)
+	if err != nil {
+		return nil, err
+	}
+	gk := &gatekeeper{config: cfg, registry: r, log: log}
+	if cfg.Cache.TTL > 0 {
+		gk.cache = newDecisionCache(cfg.Cache)
+	}
+	if cfg.Lockout.enabled() {
+		gk.lockouts = newLockouts(cfg.Lockout)
+	}
+	if cfg.Sessions.Track {
+		gk.sessions = newSessionStore(cfg.Sessions.Path)
+	}
+	if cfg.Audit.Path != "" {
+		gk.auditLog = newAuditLog(cfg.Audit)
+	}
+	if cfg.Metrics.Textfile != "" || cfg.Daemon.MetricsListen != "" {
+		gk.metrics = newMetrics(cfg.Metrics)
+	}
+	if cfg.Tracing.enabled() {
+		gk.tracer = newTracer(cfg.Tracing, log)
+	}
+	if cfg.PolicyPath != "" {
+		if gk.policy, err = loadPolicy(cfg.PolicyPath); err != nil {
+			return nil, err
+		}
+	}
+	return gk, nil
+}
+
+func (gk *gatekeeper) Trust(ctx context.Context, req *loginRequest) (*grant, error) {
+	start := time.Now()
+	ctx, sp := startSpan(withTracer(ctx, gk.tracer), "trust", loginAttributes(req)...)
+	defer gk.flushSpans()
+
+	// if the connection comes from a trusted network, emulate the pg_hba.conf trust setting
+	// and let it in without asking for a token
+	rule, ok := gk.config.trustedBy(req.Rhost, req.User)
+	sp.setAttributes(attr("trusted", ok))
+	if !ok {
+		sp.finish(nil)
+		return nil, nil
+	}
+	if err := gk.checkMethod(ctx, req.User, AuthTrust); err != nil {
+		// the role may not skip authentication, ask for a token as usual
+		gk.log(syslog.LOG_NOTICE, "trusted connection not used: %v", err)
+		sp.finish(nil)
+		return nil, nil
+	}
+	g := &grant{Role: req.User, Method: AuthTrust}
+	if err := gk.checkPolicy(ctx, req, g); err != nil {
+		gk.log(syslog.LOG_NOTICE, "trusted connection not used: %v", err)
+		sp.finish(nil)
+		return nil, nil
+	}
+	gk.log(syslog.LOG_NOTICE, "trusted connection, authentication bypassed: user=%s rhost=%s rule=%v", req.User, req.Rhost, rule)
+	gk.recordSession(req, g, AuthTrust)
+	gk.audit(req, AuthTrust, g, nil, start)
+	gk.count(AuthTrust, g, nil)
+	sp.finish(nil)
+	return g, nil
+}
+
+func (gk *gatekeeper) Authenticate(ctx context.Context, req *loginRequest) (*grant, error) {
+	start := time.Now()
+	ctx = context.WithValue(ctx, metricsKey, gk.metrics)
+	ctx, sp := startSpan(withTracer(ctx, gk.tracer), "authenticate", loginAttributes(req)...)
+	defer gk.flushSpans()
+
+	g, method, err := gk.limitedAuthenticate(ctx, req)
+	if err == nil {
+		gk.recordSession(req, g, method)
+	}
+	gk.audit(req, method, g, err, start)
+	gk.count(method, g, err)
+	sp.setAttributes(attr("auth.method", string(method)))
+	sp.finish(err)
+	return g, err
+}
+
+// limitedAuthenticate refuses logins that are locked out, and tracks and tarpits failures
+func (gk *gatekeeper) limitedAuthenticate(ctx context.Context, req *loginRequest) (*grant, AuthMethod, error) {
+	if gk.lockouts == nil {
+		return gk.authenticate(ctx, req)
+	}
+
+	if err := gk.lockouts.check(req, time.Now()); errors.Is(err, errLockedOut) {
+		gk.log(syslog.LOG_WARNING, "login refused: %v", err)
+		return nil, "", err
+	} else if err != nil {
+		// a broken store must not lock everyone out
+		gk.log(syslog.LOG_ERR, "failed to read lockouts: %v", err)
+	}
+
+	g, method, err := gk.authenticate(ctx, req)
+	if err != nil && !countsAsFailure(err) {
+		return nil, method, err
+	}
+	failures, recordErr := gk.lockouts.record(req, err != nil, time.Now())
+	if recordErr != nil {
+		gk.log(syslog.LOG_ERR, "failed to record login: %v", recordErr)
+	}
+	if err != nil {
+		// slow down guessing, the delay grows with every consecutive failure
+		delay := gk.lockouts.tarpitDelay(failures)
+		gk.log(syslog.LOG_DEBUG, "failure %d of %s from %s, delaying the answer by %v", failures, req.User, req.Rhost, delay)
+		sleepCtx(ctx, delay)
+	}
+	return g, method, err
+}
+
+// authenticate authenticates the token of the login, it also returns the method detected for the token
+func (gk *gatekeeper) authenticate(ctx context.Context, req *loginRequest) (*grant, AuthMethod, error) {
+	g, method, err := gk.authenticateToken(ctx, req)
+	if err != nil {
+		return nil, method, err
+	}
+	// checked on cached grants too, the authentication ages while the grant is cached
+	if err := gk.checkAssurance(ctx, req, g); err != nil {
+		gk.log(syslog.LOG_WARNING, "login refused: %v", err)
+		return nil, method, err
+	}
+	// the local policy applies to cached grants too, they may have been granted outside a time window
+	if err := gk.checkPolicy(ctx, req, g); err != nil {
+		gk.log(syslog.LOG_WARNING, "login refused: %v", err)
+		return nil, method, err
+	}
+	// cached grants too, the role may have been dropped since
+	if g.Target != "" {
+		if err := gk.provisionRole(ctx, g); err != nil {
+			gk.log(syslog.LOG_WARNING, "login refused: %v", err)
+			return nil, method, err
+		}
+	}
+	return g, method, nil
+}
+
+// authenticateToken asks the authenticator for the token, or the decision cache, for a grant
+func (gk *gatekeeper) authenticateToken(ctx context.Context, req *loginRequest) (*grant, AuthMethod, error) {
+	// store the rhost in the context so it can be used for authz decisions later
+	ctx = context.WithValue(ctx, rhostKey, req.Rhost)
+
+	// determine which authenticator to use
+	_, discoverSpan := startSpan(ctx, "discover")
+	auth, err := gk.registry.discover(req.Token)
+	if err == nil {
+		discoverSpan.setAttributes(attr("auth.method", string(auth.Method())))
+	}
+	discoverSpan.finish(err)
+	if err != nil {
+		gk.log(syslog.LOG_WARNING, "failed to discover authenticator: %v", err)
+		return nil, "", err
+	}
+
+	// refuse methods the role may not be reached with, before the token is sent anywhere
+	if err := gk.checkMethod(ctx, req.User, auth.Method()); err != nil {
+		gk.log(syslog.LOG_WARNING, "method rejected: %v", err)
+		return nil, auth.Method(), err
+	}
+
+	useCache := gk.cache != nil && cacheable(auth.Method(), nil)
+	if useCache {
+		d, err := gk.cache.lookup(req, time.Now())
+		if err != nil {
+			gk.log(syslog.LOG_WARNING, "failed to read decision cache: %v", err)
+		} else if d == nil {
+			gk.metrics.inc(metricCache, label("result", "miss"))
+		} else {
+			gk.metrics.inc(metricCache, label("result", "hit"))
+			g, err := d.result()
+			gk.log(syslog.LOG_INFO, "cached decision for %s: grant=%v error=%v", req.User, g, err)
+			return g, auth.Method(), err
+		}
+	}
+
+	// do the actual authentication and authorization
+	// using the first enabled authenticator that recognised the token
+	authCtx, authSpan := startSpan(ctx, "authenticator "+string(auth.Method()), attr("auth.method", string(auth.Method())))
+	g, err := auth.Authenticate(authCtx, &authRequest{User: req.User, Token: req.Token, Ephemeral: gk.config.Ephemeral.isEphemeral(req.User)})
+	authSpan.finish(err)
+	if useCache && cacheable(auth.Method(), err) {
+		if err := gk.cache.add(req, g, err, time.Now()); err != nil {
+			gk.log(syslog.LOG_WARNING, "failed to write decision cache: %v", err)
+		}
+	}
+	if useCache && errors.Is(err, errAuthInfoUnavailable) && gk.config.Cache.degraded(req.User) {
+		if g := gk.degradedGrant(ctx, req, err); g != nil {
+			return g, auth.Method(), nil
+		}
+	}
+	if err != nil {
+		gk.log(syslog.LOG_WARNING, "failed to authenticate: %v", err)
+		return nil, auth.Method(), err
+	}
+	gk.log(syslog.LOG_INFO, "authenticated: %v with grant %v", req.User, g)
+	return g, auth.Method(), nil
+}
+
+// degradedGrant returns the cached grant of the login while the API can't be reached, nil when there is none
+func (gk *gatekeeper) degradedGrant(ctx context.Context, req *loginRequest, authErr error) *grant {
+	_, sp := startSpan(ctx, "degraded_lookup")
+	d, err := gk.cache.lookupStale(req, time.Now())
+	sp.setAttributes(attr("found", d != nil))
+	sp.finish(err)
+	if err != nil {
+		gk.log(syslog.LOG_WARNING, "failed to read decision cache: %v", err)
+		return nil
+	}
+	if d == nil {
+		gk.metrics.inc(metricCache, label("result", "stale_miss"))
+		return nil
+	}
+	gk.metrics.inc(metricCache, label("result", "stale_hit"))
+	g := *d.Grant
+	g.Degraded = authErr.Error()
+	gk.log(syslog.LOG_WARNING, "degraded mode: honouring the cached grant for %s until it expires, %v", req.User, authErr)
+	gk.log(syslog.LOG_INFO, "authenticated: %v with grant %v", req.User, &g)
+	return &g
+}
+
+// checkMethod evaluates the method policy for the role
+func (gk *gatekeeper) checkMethod(ctx context.Context, role string, method AuthMethod) error {
+	_, sp := startSpan(ctx, "check_method", attr("db.user", role), attr("auth.method", string(method)))
+	err := gk.config.checkMethod(role, method)
+	sp.finish(err)
+	return err
+}
+
+// checkAssurance checks the assurance of JWT logins against the rules for the role
+func (gk *gatekeeper) checkAssurance(ctx context.Context, req *loginRequest, g *grant) error {
+	if g.Method != AuthJwt || len(gk.config.RoleAssurance) == 0 {
+		return nil
+	}
+	_, sp := startSpan(ctx, "check_assurance", attr("db.user", req.User))
+	// the token was verified before it was granted, only its claims are needed here
+	p, err := parseJWT(req.Token)
+	if err == nil {
+		sp.setAttributes(attr("jwt.aal", p.Claims.AAL))
+		err = gk.config.checkAssurance(req.User, &p.Claims, time.Now())
+	}
+	sp.finish(err)
+	return classify(err, errInsufficientAssurance)
+}
+
+// provisionRole creates or updates the ephemeral role of the grant, and audits what changed
+func (gk *gatekeeper) provisionRole(ctx context.Context, g *grant) error {
+	if g.UserId == "" {
+		return fmt.Errorf("%w: no user id to bind ephemeral role %s to", errPermDenied, g.Role)
+	}
+	// the name tells users apart, so it can't be one the user picked
+	want, err := gk.config.Ephemeral.roleFor(g.UserId)
+	if err != nil {
+		return err
+	}
+	if g.Role != want {
+		return fmt.Errorf("%w: ephemeral role %s is not the one of user %s, log in as %s", errPermDenied, g.Role, g.UserId, want)
+	}
+	if g.Target == g.Role || gk.config.Ephemeral.isEphemeral(g.Target) {
+		return fmt.Errorf("%w: ephemeral role %s can't be granted the ephemeral role %s", errPermDenied, g.Role, g.Target)
+	}
+	_, sp := startSpan(ctx, "provision_role", attr("db.user", g.Role), attr("db.target", g.Target))
+	m, err := openRoleManager(gk.config.Ephemeral)
+	if err != nil {
+		sp.finish(err)
+		return err
+	}
+	defer m.Close()
+
+	role := &ephemeralRole{Name: g.Role, UserId: g.UserId, Target: g.Target, ExpiresAt: g.ExpiresAt.UTC()}
+	statements, err := m.provision(ctx, role)
+	if len(statements) > 0 && err == nil {
+		gk.log(syslog.LOG_NOTICE, "ephemeral role %s: %s", g.Role, strings.Join(statements, "; "))
+	}
+	if gk.auditLog != nil && (len(statements) > 0 || err != nil) {
+		if auditErr := gk.auditLog.write(newAuditRoleEvent("provision", role, statements, err, time.Now())); auditErr != nil {
+			gk.log(syslog.LOG_ERR, "failed to write audit log: %v", auditErr)
+		}
+	}
+	sp.setAttributes(attr("statements", len(statements)))
+	sp.finish(err)
+	return err
+}
+
+// checkPolicy evaluates the local policy for the granted login, it returns errPermDenied when a rule refuses it
+func (gk *gatekeeper) checkPolicy(ctx context.Context, req *loginRequest, g *grant) error {
+	if gk.policy == nil {
+		return nil
+	}
+	_, sp := startSpan(ctx, "policy")
+	effect, rule, err := gk.policy.evaluate(newPolicyInput(req, g, time.Now()))
+	sp.setAttributes(attr("policy.effect", string(effect)), attr("policy.rule", rule))
+	if err != nil {
+		err = fmt.Errorf("%w: policy rule %q failed: %v", errPermDenied, rule, err)
+		sp.finish(err)
+		return err
+	}
+	gk.log(syslog.LOG_INFO, "policy: %s %s login of %s from %s (rule %q)", effect, g.Method, req.User, req.Rhost, rule)
+	if effect == policyDeny {
+		err := fmt.Errorf("%w: denied by policy rule %q", errPermDenied, rule)
+		sp.finish(err)
+		return err
+	}
+	sp.finish(nil)
+	return nil
+}
+
+// recordSession records who the backend of the login logged in as
+func (gk *gatekeeper) recordSession(req *loginRequest, g *grant, method AuthMethod) {
+	if gk.sessions == nil {
+		return
+	}
+	// a session that can't be recorded isn't reaped, but that is no reason to refuse it
+	if err := gk.sessions.record(req, g, method, time.Now()); err != nil {
+		gk.log(syslog.LOG_ERR, "failed to record session: %v", err)
+	}
+}
+
+// audit writes the decision on the login to the audit log
+func (gk *gatekeeper) audit(req *loginRequest, method AuthMethod, g *grant, err error, start time.Time) {
+	if gk.auditLog == nil {
+		return
+	}
+	ev := newAuditEvent(req, method, g, err, start, time.Now())
+	fingerprint, err := gk.auditLog.fingerprint(req.Token)
+	if err != nil {
+		gk.log(syslog.LOG_ERR, "failed to fingerprint token: %v", err)
+	}
+	ev.TokenFingerprint = fingerprint
+	if err := gk.auditLog.write(ev); err != nil {
+		gk.log(syslog.LOG_ERR, "failed to write audit log: %v", err)
+	}
+}
+
+// count counts the decision on the login and adds it, with everything observed while deciding it, to the metrics
+func (gk *gatekeeper) count(method AuthMethod, g *grant, err error) {
+	if gk.metrics == nil {
+		return
+	}
+	result := "allow"
+	if err != nil {
+		result = newErrorRecord(err).Kind
+	} else if g.Degraded != "" {
+		result = "allow_degraded"
+	}
+	if method == "" {
+		// refused before the token was looked at
+		method = "none"
+	}
+	gk.metrics.inc(metricDecisions, label("method", string(method)), label("result", result))
+	if err := gk.metrics.flush(); err != nil {
+		gk.log(syslog.LOG_ERR, "failed to write metrics: %v", err)
+	}
+}
+
+// close lets go of the connections and timers the gatekeeper keeps between
+// logins, for gatekeeperd replacing it on reload. Logins still running on it
+// finish all the same.
+func (gk *gatekeeper) close() {
+	for _, a := range gk.registry {
+		if c, ok := a.(interface{ closeIdleConnections() }); ok {
+			c.closeIdleConnections()
+		}
+	}
+	gk.tracer.close()
+}
+
+// flushSpans exports the spans of the login, without waiting for the collector
+func (gk *gatekeeper) flushSpans() {
+	if err := gk.tracer.flush(); err != nil {
+		gk.log(syslog.LOG_WARNING, "%v", err)
+	}
+}
+
+func loginAttributes(req *loginRequest) []attribute {
+	attributes := []attribute{attr("db.user", req.User), attr("client.address", req.Rhost)}
+	if req.PID != 0 {
+		attributes = append(attributes, attr("process.pid", req.PID))
+	}
+	return attributes
+}
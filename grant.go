@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// name the validated grant is stored under with pam_set_data
+const grantDataName = "pam_jit_pg_grant"
+
+var errGrantExpired = errors.New("grant expired")
+
+// grant is the outcome of a successful authentication, it is handed from
+// pam_sm_authenticate to pam_sm_acct_mgmt through the PAM handle
+type grant struct {
+	// the approval from the API, or the jti of the JWT. Empty when there is none.
+	Id     string     `json:"id,omitempty"`
+	Role   string     `json:"role"`
+	UserId string     `json:"user_id,omitempty"`
+	Method AuthMethod `json:"method"`
+	// zero when the grant does not expire, eg. password logins
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// the role an ephemeral Role is made a member of, empty for other logins
+	Target string `json:"target,omitempty"`
+	// why the API was not asked, set when a cached grant was honoured while it couldn't be reached
+	Degraded string `json:"degraded,omitempty"`
+}
+
+// check validates that the grant is for the requested user and has not yet expired
+func (g *grant) check(username string, now time.Time) error {
+	if g.Role != username {
+		return fmt.Errorf("grant is for %s, not %s", g.Role, username)
+	}
+	if !g.ExpiresAt.IsZero() && !now.Before(g.ExpiresAt) {
+		return fmt.Errorf("%w at %s", errGrantExpired, g.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (g *grant) String() string {
+	s := fmt.Sprintf("role=%s method=%s", g.Role, g.Method)
+	if g.Target != "" {
+		s += " target=" + g.Target
+	}
+	if g.UserId != "" {
+		s += " user_id=" + g.UserId
+	}
+	if g.Id != "" {
+		s += " grant_id=" + g.Id
+	}
+	if !g.ExpiresAt.IsZero() {
+		s += " expires_at=" + g.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	if g.Degraded != "" {
+		s += " degraded"
+	}
+	return s
+}
+
+// apiTime is a timestamp returned by the API. These are milliseconds since the
+// epoch, encoded as a JSON string or number. RFC3339 strings are accepted as well.
+type apiTime struct {
+	time.Time
+}
+
+func (t *apiTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		// not a string, should be a number
+		s = string(b)
+	}
+	if s == "" {
+		return nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t.Time = time.UnixMilli(ms)
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %q", s)
+	}
+	t.Time = parsed
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrant_check(t *testing.T) {
+	now := time.Now()
+
+	t.Run("grant without expiry is valid", func(t *testing.T) {
+		g := &grant{Role: "postgres", Method: AuthPassword}
+		assert.NoError(t, g.check("postgres", now))
+	})
+
+	t.Run("grant before expiry is valid", func(t *testing.T) {
+		g := &grant{Role: "postgres", ExpiresAt: now.Add(time.Minute)}
+		assert.NoError(t, g.check("postgres", now))
+	})
+
+	t.Run("expired grant fails", func(t *testing.T) {
+		g := &grant{Role: "postgres", ExpiresAt: now.Add(-time.Minute)}
+		assert.ErrorIs(t, g.check("postgres", now), errGrantExpired)
+	})
+
+	t.Run("grant for another role fails", func(t *testing.T) {
+		g := &grant{Role: "supabase_read_only_user", ExpiresAt: now.Add(time.Minute)}
+		err := g.check("postgres", now)
+		assert.ErrorContains(t, err, "grant is for supabase_read_only_user, not postgres")
+		assert.NotErrorIs(t, err, errGrantExpired)
+	})
+
+	t.Run("survives round trip through PAM data", func(t *testing.T) {
+		g := &grant{Role: "postgres", UserId: "99cf6d1d-7c39-46b4-bc58-688f6dd897ad", Method: AuthJwt, ExpiresAt: now.Add(time.Minute).Truncate(time.Second)}
+		data, err := json.Marshal(g)
+		assert.NoError(t, err)
+		var decoded grant
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.True(t, g.ExpiresAt.Equal(decoded.ExpiresAt))
+		decoded.ExpiresAt = g.ExpiresAt
+		assert.Equal(t, *g, decoded)
+	})
+}
+
+func TestGrant_apiTime(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		json string
+		want time.Time
+	}{
+		{"millis as string", `"1753280418791"`, time.UnixMilli(1753280418791)},
+		{"millis as number", `1753280418791`, time.UnixMilli(1753280418791)},
+		{"RFC3339", `"2025-07-23T14:20:18Z"`, time.Date(2025, 7, 23, 14, 20, 18, 0, time.UTC)},
+		{"null", `null`, time.Time{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got apiTime
+			assert.NoError(t, json.Unmarshal([]byte(tc.json), &got))
+			assert.True(t, tc.want.Equal(got.Time))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		var got apiTime
+		assert.Error(t, json.Unmarshal([]byte(`"tomorrow"`), &got))
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// idle connections to the API kept for later logins, gatekeeperd shares them between all of its logins
+const (
+	apiIdleConnTimeout     = 90 * time.Second
+	apiMaxIdleConnsPerHost = 16
+)
+
+// httpClientConfig configures the client used to reach the API
+type httpClientConfig struct {
+	// overall deadline for a request, including reading the response body
+	Timeout time.Duration
+	// deadline for establishing the TCP connection
+	ConnectTimeout time.Duration
+	// deadline for the TLS handshake
+	TLSHandshakeTimeout time.Duration
+
+	// path to a PEM bundle of CAs trusted for the API, instead of the system roots
+	CABundle string
+	// paths to the PEM certificate and key the gatekeeper authenticates itself to the API with
+	ClientCert string
+	ClientKey  string
+	// base64 encoded SHA-256 digests of a SubjectPublicKeyInfo in the API's certificate chain
+	Pins []string
+
+	// URL of the proxy to use, empty to take it from the environment or "none" to connect directly
+	Proxy string
+
+	// retries of requests that failed transiently, each attempt gets the full Timeout
+	Retry retryPolicy
+}
+
+// client builds the http.Client described by the config. It keeps its own
+// connections, build it once and reuse it so that they are.
+func (c *httpClientConfig) client() (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.ClientCert != "" || c.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.Pins) > 0 {
+		pins := c.Pins
+		// runs after the regular chain verification, pinning never replaces it
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, cert := range chain {
+					digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+					if slices.Contains(pins, base64.StdEncoding.EncodeToString(digest[:])) {
+						return nil
+					}
+				}
+			}
+			return fmt.Errorf("no certificate in the chain of %s matches a pinned public key", cs.ServerName)
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch c.Proxy {
+	case "":
+	case "none":
+		proxy = nil
+	default:
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	return &http.Client{
+		Timeout: c.Timeout,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			DialContext:         (&net.Dialer{Timeout: c.ConnectTimeout}).DialContext,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: c.TLSHandshakeTimeout,
+			ForceAttemptHTTP2:   true,
+			IdleConnTimeout:     apiIdleConnTimeout,
+			MaxIdleConnsPerHost: apiMaxIdleConnsPerHost,
+		},
+	}, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var validPerms = &UserPermissionSet{UserId: "99cf6d1d-7c39-46b4-bc58-688f6dd897ad", Role: UserRole{Role: "postgres"}}
+
+func permsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(validPerms)
+}
+
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return path
+}
+
+// newTestClientCert creates a CA and a client certificate signed by it, returning
+// the CA pool and the paths of the client certificate and key
+func newTestClientCert(t *testing.T) (*x509.CertPool, string, string) {
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "gatekeeper"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, writePEM(t, dir, "client.pem", "CERTIFICATE", der), writePEM(t, dir, "client-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func authenticateWith(ctx context.Context, apiURL string, client httpClientConfig) error {
+	ctx = context.WithValue(ctx, rhostKey, "10.0.0.2")
+	token := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+	r, err := newRegistry(&config{AuthAPIURL: apiURL, APIClient: client})
+	if err != nil {
+		return err
+	}
+	auth, err := r.discover(token)
+	if err != nil {
+		return err
+	}
+	_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+	return err
+}
+
+func TestHTTPClient_TLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(permsHandler))
+	defer server.Close()
+	caBundle := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	ctx := context.Background()
+
+	t.Run("rejects unknown CA", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{Proxy: "none"})
+		assert.ErrorContains(t, err, "certificate")
+	})
+
+	t.Run("trusts custom CA bundle", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, Proxy: "none"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fails on missing CA bundle", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: "/nonexistent/ca.pem"})
+		assert.ErrorContains(t, err, "failed to read CA bundle")
+	})
+
+	t.Run("accepts matching pin", func(t *testing.T) {
+		pins := []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", spkiPin(server.Certificate())}
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, Pins: pins, Proxy: "none"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("rejects when no pin matches", func(t *testing.T) {
+		pins := []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, Pins: pins, Proxy: "none"})
+		assert.ErrorContains(t, err, "matches a pinned public key")
+	})
+}
+
+func TestHTTPClient_mTLS(t *testing.T) {
+	clientCAs, clientCert, clientKey := newTestClientCert(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(permsHandler))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caBundle := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	ctx := context.Background()
+
+	t.Run("fails without client certificate", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, Proxy: "none"})
+		assert.Error(t, err)
+	})
+
+	t.Run("authenticates with client certificate", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, ClientCert: clientCert, ClientKey: clientKey, Proxy: "none"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fails on unreadable client key", func(t *testing.T) {
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, ClientCert: clientCert, ClientKey: "/nonexistent/key.pem"})
+		assert.ErrorContains(t, err, "failed to load client certificate")
+	})
+}
+
+func TestHTTPClient_deadlines(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	caBundle := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+
+	t.Run("respects context deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := authenticateWith(ctx, server.URL, httpClientConfig{CABundle: caBundle, Proxy: "none"})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("respects overall timeout", func(t *testing.T) {
+		start := time.Now()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{CABundle: caBundle, Timeout: 50 * time.Millisecond, Proxy: "none"})
+		assert.ErrorContains(t, err, "Client.Timeout exceeded")
+		assert.Less(t, time.Since(start), 5*time.Second)
+	})
+}
+
+func TestHTTPClient_proxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		permsHandler(w, r)
+	}))
+	defer proxy.Close()
+
+	err := authenticateWith(context.Background(), "http://jit-api.invalid/v1/authorize", httpClientConfig{Proxy: proxy.URL})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://jit-api.invalid/v1/authorize", proxied)
+}
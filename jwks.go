@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how long a fetched JWKS is used before it is refreshed
+const jwksTTL = 15 * time.Minute
+
+// least time between fetches of the JWKS for a kid it doesn't have, tokens
+// with made up kids would otherwise turn every login into a fetch
+const jwksMinRefetch = time.Minute
+
+// upper bound on the size of a JWKS document
+const jwksMaxSize = 1 << 20
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKey converts the JWK into a public key usable for signature verification
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) ([]byte, error) {
+		return base64.RawURLEncoding.DecodeString(s)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported EC curve: %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		// parse the uncompressed point encoding with crypto/ecdh so the on-curve checks are done for us
+		point := append([]byte{4}, append(leftPad(x, 32), leftPad(y, 32)...)...)
+		if _, err := ecdh.P256().NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("invalid EC key: %w", err)
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve: %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Ed25519 key: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key length: %d", len(x))
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %q", k.Kty)
+	}
+}
+
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// jwksCache fetches the JWKS and keeps a copy on disk. Every Postgres backend is
+// a new process, so the on-disk copy is what saves us from fetching the JWKS on
+// each login, and what keeps logins working while the JWKS endpoint is down.
+// gatekeeperd shares one jwksCache between all of its logins.
+type jwksCache struct {
+	URL  string
+	Path string
+
+	// built once from the API client settings, clientErr fails the fetches when they are invalid
+	client    *http.Client
+	clientErr error
+
+	mu        sync.Mutex
+	set       *jwkSet
+	fetchedAt time.Time
+	// when the JWKS was last asked for, whether or not that succeeded
+	attemptedAt time.Time
+	// the fetch in progress, logins needing a fresh copy meanwhile wait for it rather than fetching again
+	inflight *jwksFetch
+}
+
+type jwksFetch struct {
+	done chan struct{}
+	set  *jwkSet
+	err  error
+}
+
+// newJWKSCache fetches the JWKS with the settings of the API client, the
+// same CA bundle, proxy, client certificate, pins and deadlines apply
+func newJWKSCache(url, path string, client httpClientConfig) *jwksCache {
+	c := &jwksCache{URL: url, Path: path}
+	c.client, c.clientErr = client.client()
+	return c
+}
+
+func (c *jwksCache) closeIdleConnections() {
+	if c.client != nil {
+		c.client.CloseIdleConnections()
+	}
+}
+
+// Key returns the public key with the given kid, refreshing the JWKS when the
+// cached copy is stale or does not contain the key (the issuer may have rotated
+// keys). A cached copy is refreshed at most once per jwksMinRefetch and used
+// in between, so an unknown kid or a JWKS endpoint that is down doesn't turn
+// every login into a fetch. The on-disk copy and <Path>.attempt tell backends
+// when another one last fetched it.
+func (c *jwksCache) Key(ctx context.Context, kid, alg string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	if c.set == nil {
+		if set, modTime, err := c.readCache(); err == nil {
+			c.set, c.fetchedAt = set, modTime
+		}
+	}
+	set := c.set
+	due := set == nil || time.Since(c.fetchedAt) >= jwksTTL ||
+		(!set.has(kid) && time.Since(c.fetchedAt) >= jwksMinRefetch)
+	if due && set != nil {
+		if at := c.lastAttempt(); at.After(c.attemptedAt) {
+			c.attemptedAt = at
+		}
+	}
+	stale := set == nil || (due && time.Since(c.attemptedAt) >= jwksMinRefetch)
+	c.mu.Unlock()
+
+	if stale {
+		fetched, err := c.refresh(ctx)
+		switch {
+		case err == nil:
+			set = fetched
+		case set == nil:
+			return nil, fmt.Errorf("%w: failed to fetch jwks: %w", errAuthInfoUnavailable, err)
+		}
+		// fall back to the stale copy if the JWKS endpoint is unavailable
+	}
+	return set.key(kid, alg)
+}
+
+// refresh fetches the JWKS, or waits for the fetch already in progress
+func (c *jwksCache) refresh(ctx context.Context) (*jwkSet, error) {
+	c.mu.Lock()
+	if f := c.inflight; f != nil {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.set, f.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	f := &jwksFetch{done: make(chan struct{})}
+	c.inflight = f
+	now := time.Now()
+	c.attemptedAt = now
+	c.mu.Unlock()
+	// only spares other backends a fetch, failing to write it is not fatal
+	_ = c.markAttempt(now)
+
+	f.set, f.err = c.fetch(ctx)
+	c.mu.Lock()
+	if f.err == nil {
+		c.set, c.fetchedAt = f.set, time.Now()
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+	close(f.done)
+
+	if f.err == nil {
+		// the cache is only an optimisation, failing to write it is not fatal
+		_ = c.writeCache(f.set)
+	}
+	return f.set, f.err
+}
+
+func (s *jwkSet) has(kid string) bool {
+	for _, k := range s.Keys {
+		if k.Kid == kid {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jwkSet) key(kid, alg string) (crypto.PublicKey, error) {
+	for _, k := range s.Keys {
+		if k.Kid != kid {
+			continue
+		}
+		if k.Use != "" && k.Use != "sig" {
+			return nil, fmt.Errorf("jwk %q is not a signing key", kid)
+		}
+		if k.Alg != "" && k.Alg != alg {
+			return nil, fmt.Errorf("jwk %q is for %s, token uses %s", kid, k.Alg, alg)
+		}
+		return k.publicKey()
+	}
+	return nil, fmt.Errorf("no jwk found for kid %q", kid)
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (*jwkSet, error) {
+	if c.clientErr != nil {
+		return nil, classify(c.clientErr, errServiceConfig)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed with status: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	var set jwkSet
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("malformed jwks: %w", err)
+	}
+	return &set, nil
+}
+
+func (c *jwksCache) readCache() (*jwkSet, time.Time, error) {
+	if c.Path == "" {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	f, err := os.Open(c.Path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var set jwkSet
+	if err := json.NewDecoder(io.LimitReader(f, jwksMaxSize)).Decode(&set); err != nil {
+		return nil, time.Time{}, err
+	}
+	return &set, info.ModTime(), nil
+}
+
+// lastAttempt returns when a backend last fetched the JWKS, zero when unknown
+func (c *jwksCache) lastAttempt() time.Time {
+	if c.Path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(c.Path + ".attempt")
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// markAttempt records when the JWKS was fetched in the mtime of <Path>.attempt
+func (c *jwksCache) markAttempt(at time.Time) error {
+	if c.Path == "" {
+		return nil
+	}
+	path := c.Path + ".attempt"
+	err := os.Chtimes(path, at, at)
+	if errors.Is(err, os.ErrNotExist) {
+		if err = os.WriteFile(path, nil, 0600); err == nil {
+			err = os.Chtimes(path, at, at)
+		}
+	}
+	return err
+}
+
+// writeCache atomically replaces the cache file, so concurrent backends never read a partial write
+func (c *jwksCache) writeCache(set *jwkSet) error {
+	if c.Path == "" {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.Path), ".jwks-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := json.NewEncoder(tmp).Encode(set); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.Path)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// allowed clock skew between the token issuer and this host
+const jwtLeeway = 60 * time.Second
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// numericDate is a JWT NumericDate, seconds since the epoch which may be fractional
+type numericDate int64
+
+func (n *numericDate) UnmarshalJSON(b []byte) error {
+	var f float64
+	if err := json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("invalid numeric date: %w", err)
+	}
+	*n = numericDate(f)
+	return nil
+}
+
+func (n numericDate) Time() time.Time {
+	return time.Unix(int64(n), 0)
+}
+
+type jwtClaims struct {
+	Id        string       `json:"jti"`
+	Issuer    string       `json:"iss"`
+	Subject   string       `json:"sub"`
+	Email     string       `json:"email"`
+	ExpiresAt *numericDate `json:"exp"`
+	NotBefore *numericDate `json:"nbf"`
+	IssuedAt  *numericDate `json:"iat"`
+	// authenticator assurance level and the methods used to reach it, as issued by Supabase Auth
+	AAL string     `json:"aal"`
+	AMR []amrEntry `json:"amr"`
+
+	// Raw holds every claim in the token, including the ones decoded above
+	Raw map[string]any `json:"-"`
+}
+
+// emailVerified reports whether the issuer verified the email claim. Some
+// issuers send email_verified as a string.
+func (c *jwtClaims) emailVerified() bool {
+	v := c.Raw["email_verified"]
+	return v == true || v == "true"
+}
+
+// parsedJWT is a JWT split into its parts. The signature has not been checked.
+type parsedJWT struct {
+	Header       jwtHeader
+	Claims       jwtClaims
+	SigningInput []byte
+	Signature    []byte
+}
+
+// parseJWT decodes a compact serialised JWT without validating it
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt: expected 3 parts, got %d", len(parts))
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %w", err)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %w", err)
+	}
+
+	p := &parsedJWT{
+		SigningInput: []byte(parts[0] + "." + parts[1]),
+		Signature:    signature,
+	}
+	if err := json.Unmarshal(headerJSON, &p.Header); err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %w", err)
+	}
+	if err := json.Unmarshal(claimsJSON, &p.Claims); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(claimsJSON))
+	dec.UseNumber()
+	if err := dec.Decode(&p.Claims.Raw); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %w", err)
+	}
+	return p, nil
+}
+
+// verifySignature checks the signature of the token with the supplied public key.
+// Only asymmetric algorithms are supported, shared secrets never leave the issuer.
+func (p *parsedJWT) verifySignature(key crypto.PublicKey) error {
+	digest := sha256.Sum256(p.SigningInput)
+
+	switch p.Header.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type %T cannot verify RS256", key)
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], p.Signature)
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type %T cannot verify ES256", key)
+		}
+		if len(p.Signature) != 64 {
+			return fmt.Errorf("invalid ES256 signature length: %d", len(p.Signature))
+		}
+		r := new(big.Int).SetBytes(p.Signature[:32])
+		s := new(big.Int).SetBytes(p.Signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("key type %T cannot verify EdDSA", key)
+		}
+		if !ed25519.Verify(pub, p.SigningInput, p.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported jwt algorithm: %q", p.Header.Alg)
+	}
+}
+
+// validate checks the time based claims and, when configured, the issuer
+func (c *jwtClaims) validate(now time.Time, issuer string) error {
+	if c.ExpiresAt == nil {
+		return fmt.Errorf("jwt has no exp claim")
+	}
+	if now.After(c.ExpiresAt.Time().Add(jwtLeeway)) {
+		return fmt.Errorf("%w: jwt expired at %s", errCredExpired, c.ExpiresAt.Time().UTC().Format(time.RFC3339))
+	}
+	if c.NotBefore != nil && now.Add(jwtLeeway).Before(c.NotBefore.Time()) {
+		return fmt.Errorf("jwt not valid before %s", c.NotBefore.Time().UTC().Format(time.RFC3339))
+	}
+	if c.IssuedAt != nil && now.Add(jwtLeeway).Before(c.IssuedAt.Time()) {
+		return fmt.Errorf("jwt issued in the future")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected jwt issuer: %q", c.Issuer)
+	}
+	return nil
+}
+
+// jwtVerifier verifies JWTs offline using a JWKS and maps the identity in the
+// token to the Postgres roles it may assume using a local mappings file.
+type jwtVerifier struct {
+	Keys         *jwksCache
+	Issuer       string
+	MappingsPath string
+}
+
+func newJWTVerifier(config *config) *jwtVerifier {
+	return &jwtVerifier{
+		Keys:         newJWKSCache(config.JWKSURL, config.JWKSCachePath, config.APIClient),
+		Issuer:       config.JWTIssuer,
+		MappingsPath: config.MappingsPath,
+	}
+}
+
+// Verify checks the signature and claims of the token and returns the claims
+func (v *jwtVerifier) Verify(ctx context.Context, token string) (*jwtClaims, error) {
+	p, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, err := v.Keys.Key(ctx, p.Header.Kid, p.Header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verifySignature(key); err != nil {
+		return nil, fmt.Errorf("jwt signature verification failed: %w", err)
+	}
+	if err := p.Claims.validate(time.Now(), v.Issuer); err != nil {
+		return nil, err
+	}
+	return &p.Claims, nil
+}
+
+// Authenticate verifies the token and checks that the identity it carries may assume the requested role.
+// The grant lasts as long as the token does.
+func (v *jwtVerifier) Authenticate(ctx context.Context, req *authRequest) (*grant, error) {
+	username := req.User
+	if username == "" {
+		return nil, fmt.Errorf("%w: empty username", errAuthFailed)
+	}
+	claims, err := v.Verify(ctx, req.Token)
+	if err != nil {
+		return nil, classify(err, errAuthFailed)
+	}
+	mappings, err := loadRoleMappings(v.MappingsPath)
+	if err != nil {
+		return nil, classify(err, errServiceConfig)
+	}
+	if req.Ephemeral {
+		// an identity may be mapped by both email and sub
+		roles := slices.Compact(slices.Sorted(slices.Values(mappings.rolesFor(claims))))
+		if len(roles) != 1 {
+			return nil, fmt.Errorf("%w: mapped to %d roles, an ephemeral role needs exactly one", errPermDenied, len(roles))
+		}
+		return &grant{
+			Id:        claims.Id,
+			Role:      username,
+			Target:    roles[0],
+			UserId:    claims.Subject,
+			Method:    AuthJwt,
+			ExpiresAt: claims.ExpiresAt.Time(),
+		}, nil
+	}
+	if !slices.Contains(mappings.rolesFor(claims), username) {
+		return nil, fmt.Errorf("%w: not permitted to assume %s", errPermDenied, username)
+	}
+	return &grant{
+		Id:        claims.Id,
+		Role:      username,
+		UserId:    claims.Subject,
+		Method:    AuthJwt,
+		ExpiresAt: claims.ExpiresAt.Time(),
+	}, nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMappings = `users:
+  - email: Someone@Example.com
+    roles: [postgres]
+  - sub: ff921d19-945f-44b3-b786-1915b6eb1d0e
+    roles: [supabase_read_only_user]
+`
+
+// testSigner signs JWTs with a generated key and publishes the matching JWK
+type testSigner struct {
+	kid    string
+	alg    string
+	key    crypto.Signer
+	public jwk
+}
+
+func newTestSigner(t *testing.T, alg string) *testSigner {
+	b64 := base64.RawURLEncoding.EncodeToString
+	s := &testSigner{kid: alg + "-key", alg: alg}
+
+	switch alg {
+	case "RS256":
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		s.key = k
+		s.public = jwk{Kty: "RSA", N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes())}
+	case "ES256":
+		k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		s.key = k
+		s.public = jwk{Kty: "EC", Crv: "P-256", X: b64(k.X.FillBytes(make([]byte, 32))), Y: b64(k.Y.FillBytes(make([]byte, 32)))}
+	case "EdDSA":
+		pub, k, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		s.key = k
+		s.public = jwk{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}
+	}
+	s.public.Kid = s.kid
+	s.public.Alg = alg
+	s.public.Use = "sig"
+	return s
+}
+
+func (s *testSigner) sign(t *testing.T, claims map[string]any) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, err := json.Marshal(jwtHeader{Alg: s.alg, Kid: s.kid, Typ: "JWT"})
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	input := b64(header) + "." + b64(payload)
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, ss, serr := ecdsa.Sign(rand.Reader, k, digest[:])
+		err = serr
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	}
+	assert.NoError(t, err)
+	return input + "." + b64(sig)
+}
+
+func jwksServer(signers ...*testSigner) *httptest.Server {
+	set := jwkSet{}
+	for _, s := range signers {
+		set.Keys = append(set.Keys, s.public)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(set); err != nil {
+			return
+		}
+	}))
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":   "https://auth.example.com/auth/v1",
+		"sub":   "ff921d19-945f-44b3-b786-1915b6eb1d0e",
+		"email": "someone@example.com",
+		// as a string, like some issuers send it
+		"email_verified": "true",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestAuthenticate_JWKS(t *testing.T) {
+	signers := []*testSigner{newTestSigner(t, "RS256"), newTestSigner(t, "ES256"), newTestSigner(t, "EdDSA")}
+	server := jwksServer(signers...)
+	defer server.Close()
+
+	mappings := filepath.Join(t.TempDir(), "users.yaml")
+	assert.NoError(t, os.WriteFile(mappings, []byte(testMappings), 0600))
+
+	c := &config{
+		AuthAPIURL:   "https://mocked.api",
+		JWKSURL:      server.URL,
+		JWTIssuer:    "https://auth.example.com/auth/v1",
+		MappingsPath: mappings,
+	}
+	ctx := context.Background()
+
+	for _, s := range signers {
+		t.Run("verifies "+s.alg+" token and maps email to role", func(t *testing.T) {
+			token := s.sign(t, validClaims())
+			auth, err := mustRegistry(t, c).discover(token)
+			assert.NoError(t, err)
+			assert.Equal(t, AuthJwt, auth.Method())
+			_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+			assert.NoError(t, err)
+		})
+	}
+
+	t.Run("maps sub to role", func(t *testing.T) {
+		claims := validClaims()
+		claims["jti"] = "0b1c9e2f-token"
+		token := signers[0].sign(t, claims)
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		g, err := auth.Authenticate(ctx, &authRequest{User: "supabase_read_only_user", Token: token})
+		assert.NoError(t, err)
+		assert.Equal(t, "0b1c9e2f-token", g.Id)
+	})
+
+	t.Run("maps email only once verified", func(t *testing.T) {
+		claims := validClaims()
+		claims["sub"] = "someone-else"
+		for _, verified := range []any{nil, false, "false"} {
+			claims["email_verified"] = verified
+			if verified == nil {
+				delete(claims, "email_verified")
+			}
+			token := signers[0].sign(t, claims)
+			auth, err := mustRegistry(t, c).discover(token)
+			assert.NoError(t, err)
+			_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+			assert.ErrorIs(t, err, errPermDenied, verified)
+		}
+
+		// unless the mappings say the issuer only puts verified emails in tokens
+		unverified := filepath.Join(t.TempDir(), "users.yaml")
+		assert.NoError(t, os.WriteFile(unverified, []byte("unverified_emails: true\n"+testMappings), 0600))
+		c := *c
+		c.MappingsPath = unverified
+		token := signers[0].sign(t, claims)
+		auth, err := mustRegistry(t, &c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.NoError(t, err)
+	})
+
+	t.Run("fails for unmapped role", func(t *testing.T) {
+		token := signers[0].sign(t, validClaims())
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "supabase_admin", Token: token})
+		assert.ErrorContains(t, err, "not permitted to assume supabase_admin")
+		assert.ErrorIs(t, err, errPermDenied)
+	})
+
+	t.Run("fails for expired token", func(t *testing.T) {
+		claims := validClaims()
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+		token := signers[0].sign(t, claims)
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorContains(t, err, "jwt expired")
+		assert.ErrorIs(t, err, errCredExpired)
+	})
+
+	t.Run("fails for token not yet valid", func(t *testing.T) {
+		claims := validClaims()
+		claims["nbf"] = time.Now().Add(time.Hour).Unix()
+		token := signers[0].sign(t, claims)
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorContains(t, err, "jwt not valid before")
+	})
+
+	t.Run("fails for wrong issuer", func(t *testing.T) {
+		claims := validClaims()
+		claims["iss"] = "https://evil.example.com"
+		token := signers[0].sign(t, claims)
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorContains(t, err, "unexpected jwt issuer")
+	})
+
+	t.Run("fails for token signed by unknown key", func(t *testing.T) {
+		other := newTestSigner(t, "RS256")
+		other.kid = signers[0].kid
+		token := other.sign(t, validClaims())
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorContains(t, err, "jwt signature verification failed")
+		assert.ErrorIs(t, err, errAuthFailed)
+	})
+
+	t.Run("fails for alg not matching key", func(t *testing.T) {
+		other := newTestSigner(t, "EdDSA")
+		other.kid = signers[0].kid
+		token := other.sign(t, validClaims())
+		auth, err := mustRegistry(t, c).discover(token)
+		assert.NoError(t, err)
+		_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+		assert.ErrorContains(t, err, "token uses EdDSA")
+	})
+}
+
+func TestAuthenticate_JWKSCache(t *testing.T) {
+	signer := newTestSigner(t, "ES256")
+	server := jwksServer(signer)
+
+	dir := t.TempDir()
+	mappings := filepath.Join(dir, "users.yaml")
+	assert.NoError(t, os.WriteFile(mappings, []byte(testMappings), 0600))
+
+	c := &config{
+		JWKSURL:       server.URL,
+		JWKSCachePath: filepath.Join(dir, "jwks.json"),
+		MappingsPath:  mappings,
+	}
+	ctx := context.Background()
+	token := signer.sign(t, validClaims())
+
+	auth, err := mustRegistry(t, c).discover(token)
+	assert.NoError(t, err)
+	_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+	assert.NoError(t, err)
+	assert.FileExists(t, c.JWKSCachePath)
+
+	// JWKS endpoint down, a new process relies on the cached copy
+	server.Close()
+	auth, err = mustRegistry(t, c).discover(token)
+	assert.NoError(t, err)
+	_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+	assert.NoError(t, err)
+
+	// without a cache there is nothing to fall back to
+	c.JWKSCachePath = ""
+	auth, err = mustRegistry(t, c).discover(token)
+	assert.NoError(t, err)
+	_, err = auth.Authenticate(ctx, &authRequest{User: "postgres", Token: token})
+	assert.ErrorContains(t, err, "failed to fetch jwks")
+	assert.ErrorIs(t, err, errAuthInfoUnavailable)
+}
+
+func TestJWKSCache_concurrent(t *testing.T) {
+	signer := newTestSigner(t, "ES256")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		// long enough for every login to miss the cache
+		time.Sleep(50 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{signer.public}})
+	}))
+	defer server.Close()
+
+	// gatekeeperd verifies all of its logins with the same cache
+	cache := newJWKSCache(server.URL, filepath.Join(t.TempDir(), "jwks.json"), httpClientConfig{Proxy: "none"})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.Key(context.Background(), signer.public.Kid, "ES256")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches.Load())
+}
+
+func TestJWKSCache_unknownKid(t *testing.T) {
+	signer := newTestSigner(t, "ES256")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{signer.public}})
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	cache := newJWKSCache(server.URL, path, httpClientConfig{Proxy: "none"})
+	_, err := cache.Key(ctx, signer.public.Kid, "ES256")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// the JWKS was just fetched, made up kids are failed from it
+	for range 5 {
+		_, err = cache.Key(ctx, "made-up", "ES256")
+		assert.ErrorContains(t, err, `no jwk found for kid "made-up"`)
+	}
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// so are they in other backends, which learn when it was fetched from the copy on disk
+	_, err = newJWKSCache(server.URL, path, httpClientConfig{Proxy: "none"}).Key(ctx, "made-up", "ES256")
+	assert.ErrorContains(t, err, "no jwk found")
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// a key rotated in is picked up once the interval has passed, and only once per interval
+	cache.fetchedAt = cache.fetchedAt.Add(-jwksMinRefetch)
+	cache.attemptedAt = cache.attemptedAt.Add(-jwksMinRefetch)
+	assert.NoError(t, cache.markAttempt(cache.attemptedAt))
+	_, err = cache.Key(ctx, "made-up", "ES256")
+	assert.ErrorContains(t, err, "no jwk found")
+	assert.Equal(t, int32(2), fetches.Load())
+	_, err = cache.Key(ctx, "made-up", "ES256")
+	assert.ErrorContains(t, err, "no jwk found")
+	assert.Equal(t, int32(2), fetches.Load())
+}
+
+func TestJWKSCache_expiredWhileDown(t *testing.T) {
+	signer := newTestSigner(t, "ES256")
+	var fetches atomic.Int32
+	var down atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{signer.public}})
+	}))
+	defer server.Close()
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+
+	cache := newJWKSCache(server.URL, path, httpClientConfig{Proxy: "none"})
+	_, err := cache.Key(ctx, signer.public.Kid, "ES256")
+	assert.NoError(t, err)
+
+	// the copy expires while the JWKS endpoint is down
+	down.Store(true)
+	expired := time.Now().Add(-jwksTTL)
+	assert.NoError(t, os.Chtimes(path, expired, expired))
+	cache.fetchedAt = expired
+	cache.attemptedAt = expired
+	assert.NoError(t, cache.markAttempt(expired))
+
+	// one login tries to refresh it, the others use the stale copy meanwhile
+	for range 5 {
+		_, err = cache.Key(ctx, signer.public.Kid, "ES256")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), fetches.Load())
+	// in other backends too
+	_, err = newJWKSCache(server.URL, path, httpClientConfig{Proxy: "none"}).Key(ctx, signer.public.Kid, "ES256")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// and it is tried again after the interval
+	cache.attemptedAt = cache.attemptedAt.Add(-jwksMinRefetch)
+	assert.NoError(t, cache.markAttempt(cache.attemptedAt))
+	down.Store(false)
+	_, err = cache.Key(ctx, signer.public.Kid, "ES256")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), fetches.Load())
+}
+
+func TestJWKSCache_client(t *testing.T) {
+	signer := newTestSigner(t, "ES256")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwkSet{Keys: []jwk{signer.public}})
+	}))
+	defer server.Close()
+	caBundle := writePEM(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	key := func(client httpClientConfig) error {
+		_, err := newJWKSCache(server.URL, filepath.Join(t.TempDir(), "jwks.json"), client).Key(context.Background(), signer.public.Kid, "ES256")
+		return err
+	}
+
+	// the JWKS is fetched with the settings of the API client
+	assert.ErrorContains(t, key(httpClientConfig{Proxy: "none"}), "certificate")
+	assert.NoError(t, key(httpClientConfig{CABundle: caBundle, Proxy: "none"}))
+	assert.NoError(t, key(httpClientConfig{CABundle: caBundle, Pins: []string{spkiPin(server.Certificate())}, Proxy: "none"}))
+	assert.ErrorContains(t, key(httpClientConfig{CABundle: caBundle, Pins: []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, Proxy: "none"}), "matches a pinned public key")
+
+	err := key(httpClientConfig{CABundle: "/nonexistent/ca.pem"})
+	assert.ErrorIs(t, err, errServiceConfig)
+	assert.ErrorContains(t, err, "failed to read CA bundle")
+}
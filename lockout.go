@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultLockoutBase      = 30 * time.Second
+	defaultLockoutMax       = time.Hour
+	defaultLockoutWindow    = 15 * time.Minute
+	defaultTarpitMax        = 5 * time.Second
+	defaultLockoutStorePath = "/run/jit-gatekeeper/lockouts.json"
+)
+
+// lockoutConfig configures how failed logins slow down and lock out whoever is guessing tokens or passwords
+type lockoutConfig struct {
+	// failed logins of a user from a rhost before both are locked out, 0 to not lock out users
+	Threshold int
+	// failed logins from a rhost, of any user, before it is locked out, 0 to not lock out hosts
+	RhostThreshold int
+	// duration of the first lockout, doubled for every following lockout up to Max
+	Base time.Duration
+	Max  time.Duration
+	// failures older than this are forgotten, and so are past lockouts once no failure happened for as long
+	Window time.Duration
+	// delay before a failed login is answered, doubled for every consecutive failure up to TarpitMax. 0 disables it.
+	Tarpit    time.Duration
+	TarpitMax time.Duration
+	// path of the store the counters are kept in
+	Path string
+}
+
+func (c lockoutConfig) enabled() bool {
+	return c.Threshold > 0 || c.RhostThreshold > 0 || c.Tarpit > 0
+}
+
+// lockoutRecord counts the recent failures of a user from a rhost, or of a rhost when User is empty
+type lockoutRecord struct {
+	User        string    `json:"user,omitempty"`
+	Rhost       string    `json:"rhost"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	// number of times locked out, sets the duration of the next lockout
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"locked_until,omitzero"`
+}
+
+func (r *lockoutRecord) String() string {
+	if r.User == "" {
+		return "rhost " + r.Rhost
+	}
+	return "user " + r.User + " from " + r.Rhost
+}
+
+func (r *lockoutRecord) locked(now time.Time) bool {
+	return now.Before(r.LockedUntil)
+}
+
+// lockouts tracks failed logins in a store shared by every process
+type lockouts struct {
+	config lockoutConfig
+	store  *fileStore[map[string]*lockoutRecord]
+}
+
+func newLockouts(cfg lockoutConfig) *lockouts {
+	return &lockouts{config: cfg, store: &fileStore[map[string]*lockoutRecord]{Path: cfg.Path}}
+}
+
+func lockoutKeys(req *loginRequest) (userKey, hostKey string) {
+	return req.Rhost + "\x00" + req.User, req.Rhost
+}
+
+// check returns errLockedOut when the user or the rhost of the login is locked out
+func (l *lockouts) check(req *loginRequest, now time.Time) error {
+	userKey, hostKey := lockoutKeys(req)
+	return l.store.view(func(records *map[string]*lockoutRecord) error {
+		for _, key := range []string{userKey, hostKey} {
+			if r, ok := (*records)[key]; ok && r.locked(now) {
+				return fmt.Errorf("%w: %v until %s", errLockedOut, r, r.LockedUntil.UTC().Format(time.RFC3339))
+			}
+		}
+		return nil
+	})
+}
+
+// countsAsFailure reports whether the outcome of a login looks like guessing,
+// being refused a role or the API being down does not.
+func countsAsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, e := range []error{errPermDenied, errCredExpired, errAuthInfoUnavailable, errServiceConfig, errLockedOut, errInsufficientAssurance} {
+		if errors.Is(err, e) {
+			return false
+		}
+	}
+	return true
+}
+
+// record counts the outcome of the login and returns the number of
+// consecutive failures of the user from the rhost, 0 after a success
+func (l *lockouts) record(req *loginRequest, failed bool, now time.Time) (int, error) {
+	userKey, hostKey := lockoutKeys(req)
+	failures := 0
+	err := l.store.update(func(records *map[string]*lockoutRecord) error {
+		if *records == nil {
+			*records = map[string]*lockoutRecord{}
+		}
+		l.prune(*records, now)
+
+		if !failed {
+			delete(*records, userKey)
+			return nil
+		}
+		user := l.fail(*records, userKey, &lockoutRecord{User: req.User, Rhost: req.Rhost}, l.config.Threshold, now)
+		l.fail(*records, hostKey, &lockoutRecord{Rhost: req.Rhost}, l.config.RhostThreshold, now)
+		failures = user.Failures
+		return nil
+	})
+	return failures, err
+}
+
+func (l *lockouts) fail(records map[string]*lockoutRecord, key string, empty *lockoutRecord, threshold int, now time.Time) *lockoutRecord {
+	r, ok := records[key]
+	if !ok {
+		r = empty
+		records[key] = r
+	}
+	r.Failures++
+	r.LastFailure = now
+	if threshold > 0 && r.Failures%threshold == 0 {
+		r.LockedUntil = now.Add(l.lockoutDuration(r.Lockouts))
+		r.Lockouts++
+	}
+	return r
+}
+
+// lockoutDuration is Base doubled for every earlier lockout, capped at Max
+func (l *lockouts) lockoutDuration(lockouts int) time.Duration {
+	d := l.config.Base
+	for range lockouts {
+		if d >= l.config.Max/2 {
+			return l.config.Max
+		}
+		d *= 2
+	}
+	return min(d, l.config.Max)
+}
+
+// tarpitDelay is how long a login is held before its failure is returned
+func (l *lockouts) tarpitDelay(failures int) time.Duration {
+	if l.config.Tarpit <= 0 || failures == 0 {
+		return 0
+	}
+	d := l.config.Tarpit
+	for range failures - 1 {
+		if d >= l.config.TarpitMax/2 {
+			return l.config.TarpitMax
+		}
+		d *= 2
+	}
+	return min(d, l.config.TarpitMax)
+}
+
+// prune forgets records that are not locked and had no failure within the window
+func (l *lockouts) prune(records map[string]*lockoutRecord, now time.Time) {
+	for key, r := range records {
+		if !r.locked(now) && now.Sub(r.LastFailure) >= l.config.Window {
+			delete(records, key)
+		}
+	}
+}
+
+func (l *lockouts) list(now time.Time) ([]*lockoutRecord, error) {
+	var list []*lockoutRecord
+	err := l.store.view(func(records *map[string]*lockoutRecord) error {
+		for _, r := range *records {
+			if r.locked(now) || now.Sub(r.LastFailure) < l.config.Window {
+				list = append(list, r)
+			}
+		}
+		return nil
+	})
+	slices.SortFunc(list, func(a, b *lockoutRecord) int {
+		return strings.Compare(a.Rhost+"\x00"+a.User, b.Rhost+"\x00"+b.User)
+	})
+	return list, err
+}
+
+// clear drops the records matching user and rhost, empty to match any, and returns how many were dropped
+func (l *lockouts) clear(user, rhost string) (int, error) {
+	cleared := 0
+	err := l.store.update(func(records *map[string]*lockoutRecord) error {
+		for key, r := range *records {
+			if (user == "" || r.User == user) && (rhost == "" || r.Rhost == rhost) {
+				delete(*records, key)
+				cleared++
+			}
+		}
+		return nil
+	})
+	return cleared, err
+}
+
+// sleepCtx waits for d, or until ctx is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// runLockout is gatekeeper lockout, it lists the users and hosts with recent failures and clears them
+func runLockout(args []string) int {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "clear") {
+		fmt.Fprintln(os.Stderr, "usage: gatekeeper lockout list|clear [-config path] [-user role] [-rhost host]")
+		return 2
+	}
+	flags := flag.NewFlagSet("lockout "+args[0], flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	user := flags.String("user", "", "only clear the records of this role")
+	rhost := flags.String("rhost", "", "only clear the records of this host")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	cfg, err := configFromArgs([]string{"config=" + *configPath})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	l := newLockouts(cfg.Lockout)
+	l.store.Existing = true
+
+	if args[0] == "clear" {
+		cleared, err := l.clear(*user, *rhost)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to clear lockouts: %v\n", err)
+			return 1
+		}
+		fmt.Printf("cleared %d lockout records\n", cleared)
+		return 0
+	}
+
+	now := time.Now()
+	records, err := l.list(now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list lockouts: %v\n", err)
+		return 1
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RHOST\tUSER\tFAILURES\tLAST FAILURE\tLOCKED UNTIL")
+	for _, r := range records {
+		user, until := r.User, "-"
+		if user == "" {
+			user = "*"
+		}
+		if r.locked(now) {
+			until = r.LockedUntil.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", r.Rhost, user, r.Failures, r.LastFailure.UTC().Format(time.RFC3339), until)
+	}
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLockouts(t *testing.T, threshold, rhostThreshold int) *lockouts {
+	return newLockouts(lockoutConfig{
+		Threshold:      threshold,
+		RhostThreshold: rhostThreshold,
+		Base:           30 * time.Second,
+		Max:            2 * time.Minute,
+		Window:         15 * time.Minute,
+		Tarpit:         100 * time.Millisecond,
+		TarpitMax:      time.Second,
+		Path:           filepath.Join(t.TempDir(), "lockouts.json"),
+	})
+}
+
+func TestLockout_backoff(t *testing.T) {
+	l := newTestLockouts(t, 3, 0)
+	for i, want := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 2 * time.Minute, 2 * time.Minute} {
+		assert.Equal(t, want, l.lockoutDuration(i), i)
+	}
+	for failures, want := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		assert.Equal(t, want, l.tarpitDelay(failures), failures)
+	}
+	assert.Equal(t, time.Second, l.tarpitDelay(100))
+}
+
+func TestLockout_record(t *testing.T) {
+	now := time.Now()
+	req := &loginRequest{User: "postgres", Rhost: "10.0.0.2"}
+
+	fail := func(t *testing.T, l *lockouts, req *loginRequest, n int) int {
+		failures := 0
+		for range n {
+			var err error
+			failures, err = l.record(req, true, now)
+			assert.NoError(t, err)
+		}
+		return failures
+	}
+
+	t.Run("locks out the user from the rhost at the threshold", func(t *testing.T) {
+		l := newTestLockouts(t, 3, 0)
+		assert.Equal(t, 2, fail(t, l, req, 2))
+		assert.NoError(t, l.check(req, now))
+
+		assert.Equal(t, 3, fail(t, l, req, 1))
+		err := l.check(req, now)
+		assert.ErrorIs(t, err, errLockedOut)
+		assert.ErrorContains(t, err, "user postgres from 10.0.0.2 until")
+
+		// other users and hosts are not affected
+		assert.NoError(t, l.check(&loginRequest{User: "app_user", Rhost: req.Rhost}, now))
+		assert.NoError(t, l.check(&loginRequest{User: req.User, Rhost: "10.0.0.3"}, now))
+
+		assert.NoError(t, l.check(req, now.Add(30*time.Second)))
+	})
+
+	t.Run("doubles every following lockout", func(t *testing.T) {
+		l := newTestLockouts(t, 2, 0)
+		fail(t, l, req, 2)
+		fail(t, l, req, 2)
+		assert.ErrorIs(t, l.check(req, now.Add(59*time.Second)), errLockedOut)
+		assert.NoError(t, l.check(req, now.Add(time.Minute)))
+	})
+
+	t.Run("locks out the rhost across users", func(t *testing.T) {
+		l := newTestLockouts(t, 0, 3)
+		for i := range 3 {
+			fail(t, l, &loginRequest{User: "user" + strconv.Itoa(i), Rhost: req.Rhost}, 1)
+		}
+		err := l.check(&loginRequest{User: "app_user", Rhost: req.Rhost}, now)
+		assert.ErrorIs(t, err, errLockedOut)
+		assert.ErrorContains(t, err, "rhost 10.0.0.2 until")
+	})
+
+	t.Run("success resets the user's failures", func(t *testing.T) {
+		l := newTestLockouts(t, 3, 0)
+		fail(t, l, req, 2)
+		failures, err := l.record(req, false, now)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, failures)
+		assert.Equal(t, 1, fail(t, l, req, 1))
+	})
+
+	t.Run("forgets failures outside the window", func(t *testing.T) {
+		l := newTestLockouts(t, 3, 0)
+		fail(t, l, req, 2)
+		failures, err := l.record(req, true, now.Add(15*time.Minute))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, failures)
+	})
+
+	t.Run("lists and clears", func(t *testing.T) {
+		l := newTestLockouts(t, 3, 5)
+		fail(t, l, req, 3)
+		fail(t, l, &loginRequest{User: "app_user", Rhost: "10.0.0.3"}, 1)
+
+		records, err := l.list(now)
+		assert.NoError(t, err)
+		assert.Len(t, records, 4)
+		assert.Equal(t, "", records[0].User)
+		assert.Equal(t, "10.0.0.2", records[0].Rhost)
+		assert.Equal(t, 3, records[0].Failures)
+		assert.True(t, now.Equal(records[0].LastFailure))
+		assert.Equal(t, "postgres", records[1].User)
+		assert.True(t, records[1].locked(now))
+
+		cleared, err := l.clear("postgres", "")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, cleared)
+		assert.NoError(t, l.check(req, now))
+
+		cleared, err = l.clear("", "10.0.0.3")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, cleared)
+	})
+
+	t.Run("counts only guessing as failure", func(t *testing.T) {
+		assert.True(t, countsAsFailure(fmt.Errorf("%w: invalid password", errAuthFailed)))
+		assert.False(t, countsAsFailure(nil))
+		assert.False(t, countsAsFailure(fmt.Errorf("%w: not permitted to assume postgres", errPermDenied)))
+		assert.False(t, countsAsFailure(fmt.Errorf("%w: failed with status: 503", errAuthInfoUnavailable)))
+	})
+}
+
+func TestLockout_gatekeeper(t *testing.T) {
+	host, port := fakePostgres(t, "28P01", "password authentication failed")
+	cfg, err := configFromArgs([]string{
+		"methods=password",
+		"passwordHost=" + host,
+		"passwordPort=" + strconv.Itoa(port),
+		"lockoutThreshold=2",
+		"tarpit=20ms",
+		"lockoutPath=" + filepath.Join(t.TempDir(), "lockouts.json"),
+	})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	req := &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "guess"}
+
+	start := time.Now()
+	_, err = gk.Authenticate(ctx, req)
+	assert.ErrorIs(t, err, errAuthFailed)
+	_, err = gk.Authenticate(ctx, req)
+	assert.ErrorIs(t, err, errAuthFailed)
+	// tarpitted for 20ms and 40ms
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+
+	_, err = gk.Authenticate(ctx, req)
+	assert.ErrorIs(t, err, errLockedOut)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// roleMappings maps identities from locally verified JWTs to the Postgres roles they may assume
+//
+//	users:
+//	  - email: someone@example.com
+//	    roles: [postgres, supabase_read_only_user]
+//	  - sub: ff921d19-945f-44b3-b786-1915b6eb1d0e
+//	    roles: [supabase_read_only_user]
+type roleMappings struct {
+	// match emails of tokens without email_verified, for issuers that only
+	// put verified emails in their tokens
+	UnverifiedEmails bool          `yaml:"unverified_emails"`
+	Users            []userMapping `yaml:"users"`
+}
+
+type userMapping struct {
+	// match on the email claim, compared case-insensitively. The token must
+	// have email_verified set, anyone could otherwise sign up with the email
+	// of someone else at an issuer that doesn't verify them.
+	Email string `yaml:"email"`
+	// match on the sub claim
+	Sub   string   `yaml:"sub"`
+	Roles []string `yaml:"roles"`
+}
+
+func loadRoleMappings(path string) (*roleMappings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mappings: %w", err)
+	}
+	defer f.Close()
+
+	var m roleMappings
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse mappings %s: %w", path, err)
+	}
+
+	for i, u := range m.Users {
+		if (u.Email == "") == (u.Sub == "") {
+			return nil, fmt.Errorf("mappings %s: user %d must set exactly one of email or sub", path, i)
+		}
+	}
+	return &m, nil
+}
+
+// rolesFor returns every role granted to the identity in the claims
+func (m *roleMappings) rolesFor(claims *jwtClaims) []string {
+	var roles []string
+	email := claims.Email
+	if !m.UnverifiedEmails && !claims.emailVerified() {
+		email = ""
+	}
+	for _, u := range m.Users {
+		if u.Email != "" && email != "" && strings.EqualFold(u.Email, email) {
+			roles = append(roles, u.Roles...)
+		}
+		if u.Sub != "" && u.Sub == claims.Subject {
+			roles = append(roles, u.Roles...)
+		}
+	}
+	return roles
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// roleMethodRule limits the authentication methods that can be used to reach
+// the roles matching one of Roles. Roles may be globs, such as service_*.
+type roleMethodRule struct {
+	Roles   []string
+	Methods []AuthMethod
+}
+
+func (r roleMethodRule) String() string {
+	methods := make([]string, len(r.Methods))
+	for i, m := range r.Methods {
+		methods[i] = string(m)
+	}
+	return strings.Join(r.Roles, ",") + " methods=" + strings.Join(methods, ",")
+}
+
+func (r roleMethodRule) matches(role string) bool {
+	return matchRole(r.Roles, role)
+}
+
+// matchRole reports whether role matches one of the globs. Role lists take
+// path.Match globs wherever they appear in the config, checked with
+// parseRolePatterns when parsed.
+func matchRole(patterns []string, role string) bool {
+	for _, pattern := range patterns {
+		// patterns are checked when parsed, so errors can't happen here
+		if ok, _ := path.Match(pattern, role); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRolePatterns checks the globs of a role list
+func parseRolePatterns(roles []string) ([]string, error) {
+	for _, pattern := range roles {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid role pattern %q: %w", pattern, err)
+		}
+	}
+	return roles, nil
+}
+
+// checkMethod returns errPermDenied when role may not be reached with method.
+// The first rule matching the role decides, roles no rule matches may use any enabled method.
+func (c *config) checkMethod(role string, method AuthMethod) error {
+	for _, r := range c.RoleMethods {
+		if !r.matches(role) {
+			continue
+		}
+		if slices.Contains(r.Methods, method) {
+			return nil
+		}
+		return fmt.Errorf("%w: authentication method %s is not permitted for role %s (rule %v)", errPermDenied, method, role, r)
+	}
+	return nil
+}
+
+// parseRoleMethods parses the roleMethods argument, rules are separated by
+// semicolons and list the roles and the methods permitted for them, eg.
+//
+//	postgres,supabase_admin=pat,jwt;service_*=password
+func parseRoleMethods(arg string) ([]roleMethodRule, error) {
+	var rules []roleMethodRule
+	for _, s := range strings.Split(arg, ";") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		roles, methods, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed roleMethods rule: %v", s)
+		}
+		rule, err := newRoleMethodRule(splitList(roles), splitList(methods))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func newRoleMethodRule(roles, methods []string) (roleMethodRule, error) {
+	if len(roles) == 0 {
+		return roleMethodRule{}, fmt.Errorf("roleMethods rule without roles")
+	}
+	if _, err := parseRolePatterns(roles); err != nil {
+		return roleMethodRule{}, err
+	}
+	rule := roleMethodRule{Roles: roles}
+	for _, name := range methods {
+		m := AuthMethod(name)
+		// trust is not an authenticator, but trusted connections can be limited too
+		if _, ok := authenticatorFactories[m]; !ok && m != AuthTrust {
+			return roleMethodRule{}, fmt.Errorf("unknown authentication method: %v", name)
+		}
+		if !slices.Contains(rule.Methods, m) {
+			rule.Methods = append(rule.Methods, m)
+		}
+	}
+	return rule, nil
+}
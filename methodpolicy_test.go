@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_checkMethod(t *testing.T) {
+	c, err := configFromArgs([]string{"roleMethods=postgres,supabase_admin=pat,jwt;service_*=password"})
+	assert.NoError(t, err)
+
+	t.Run("permits listed methods", func(t *testing.T) {
+		assert.NoError(t, c.checkMethod("postgres", AuthPat))
+		assert.NoError(t, c.checkMethod("supabase_admin", AuthJwt))
+		assert.NoError(t, c.checkMethod("service_storage", AuthPassword))
+	})
+
+	t.Run("rejects other methods and names them", func(t *testing.T) {
+		err := c.checkMethod("postgres", AuthPassword)
+		assert.ErrorIs(t, err, errPermDenied)
+		assert.ErrorContains(t, err, "authentication method password is not permitted for role postgres")
+
+		err = c.checkMethod("service_storage", AuthJwt)
+		assert.ErrorIs(t, err, errPermDenied)
+		assert.ErrorContains(t, err, "authentication method jwt is not permitted for role service_storage")
+
+		assert.ErrorIs(t, c.checkMethod("postgres", AuthTrust), errPermDenied)
+	})
+
+	t.Run("roles without a rule may use any method", func(t *testing.T) {
+		assert.NoError(t, c.checkMethod("app_user", AuthPassword))
+		assert.NoError(t, c.checkMethod("app_user", AuthTrust))
+	})
+
+	t.Run("first matching rule decides", func(t *testing.T) {
+		c, err := configFromArgs([]string{"roleMethods=service_admin=pat;service_*=password"})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, c.checkMethod("service_admin", AuthPassword), errPermDenied)
+		assert.NoError(t, c.checkMethod("service_other", AuthPassword))
+	})
+
+	t.Run("loads rules from the config file", func(t *testing.T) {
+		path := writeConfig(t, `
+role_methods:
+  - roles: [postgres]
+    methods: [pat, jwt]
+  - roles: ["service_*"]
+    methods: [password, trust]
+`)
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		assert.ErrorIs(t, c.checkMethod("postgres", AuthPassword), errPermDenied)
+		assert.NoError(t, c.checkMethod("service_storage", AuthTrust))
+	})
+
+	t.Run("rejects malformed rules", func(t *testing.T) {
+		_, err := configFromArgs([]string{"roleMethods=postgres"})
+		assert.ErrorContains(t, err, "malformed roleMethods rule: postgres")
+
+		_, err = configFromArgs([]string{"roleMethods=postgres=kerberos"})
+		assert.ErrorContains(t, err, "unknown authentication method: kerberos")
+
+		_, err = configFromArgs([]string{"roleMethods=service_[=password"})
+		assert.ErrorContains(t, err, `invalid role pattern "service_["`)
+	})
+}
+
+func TestMatchRole(t *testing.T) {
+	patterns, err := parseRolePatterns([]string{"postgres", "app_*", "reader_?"})
+	assert.NoError(t, err)
+	for role, want := range map[string]bool{
+		"postgres":   true,
+		"app_":       true,
+		"app_orders": true,
+		"reader_1":   true,
+		"reader_12":  false,
+		"postgres2":  false,
+		"":           false,
+	} {
+		assert.Equal(t, want, matchRole(patterns, role), role)
+	}
+	assert.False(t, matchRole(nil, "postgres"))
+
+	_, err = parseRolePatterns([]string{"app_*", "app_["})
+	assert.ErrorContains(t, err, `invalid role pattern "app_["`)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	defaultMetricsPath = "/run/jit-gatekeeper/metrics.json"
+	// name of the file written to the textfile directory, node-exporter reads every *.prom file there
+	metricsTextfileName = "jit_gatekeeper.prom"
+)
+
+// metricsConfig configures the metrics, which are added up across all processes in a shared store
+type metricsConfig struct {
+	// directory of the node-exporter textfile collector, empty to not write the metrics there
+	Textfile string
+	// path of the store the metrics are kept in
+	Path string
+}
+
+// metricFamily describes a metric, histograms are observed in seconds
+type metricFamily struct {
+	name      string
+	help      string
+	histogram bool
+}
+
+var (
+	metricDecisions         = metricFamily{name: "jit_gatekeeper_decisions_total", help: "Login decisions by authentication method and result."}
+	metricCache             = metricFamily{name: "jit_gatekeeper_cache_lookups_total", help: "Decision cache lookups by result."}
+	metricAPIStatus         = metricFamily{name: "jit_gatekeeper_api_responses_total", help: "Responses of the API by status code, error when no response was received."}
+	metricAPILatency        = metricFamily{name: "jit_gatekeeper_api_request_duration_seconds", help: "Time taken by requests to the API.", histogram: true}
+	metricAPIRetries        = metricFamily{name: "jit_gatekeeper_api_retries_total", help: "Requests to the API made again after a transient failure."}
+	metricBreakerRejections = metricFamily{name: "jit_gatekeeper_api_breaker_rejections_total", help: "Logins failed without asking the API because the circuit breaker was open."}
+	metricPasswordLatency   = metricFamily{name: "jit_gatekeeper_password_check_duration_seconds", help: "Time taken to check a password against the local database.", histogram: true}
+
+	// in the order they are written out
+	metricFamilies = []metricFamily{metricDecisions, metricCache, metricAPIStatus, metricAPILatency, metricAPIRetries, metricBreakerRejections, metricPasswordLatency}
+)
+
+// upper bounds of the histogram buckets, in seconds
+var metricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	// observations per bucket of metricBuckets, not cumulative
+	Buckets []uint64 `json:"buckets"`
+	Sum     float64  `json:"sum"`
+	Count   uint64   `json:"count"`
+}
+
+func (h *histogram) observe(seconds float64) {
+	if len(h.Buckets) != len(metricBuckets) {
+		h.Buckets = make([]uint64, len(metricBuckets))
+	}
+	if i, _ := slices.BinarySearch(metricBuckets, seconds); i < len(metricBuckets) {
+		h.Buckets[i]++
+	}
+	h.Sum += seconds
+	h.Count++
+}
+
+func (h *histogram) add(o *histogram) {
+	if len(o.Buckets) != len(metricBuckets) {
+		return
+	}
+	if len(h.Buckets) != len(metricBuckets) {
+		h.Buckets = make([]uint64, len(metricBuckets))
+	}
+	for i, n := range o.Buckets {
+		h.Buckets[i] += n
+	}
+	h.Sum += o.Sum
+	h.Count += o.Count
+}
+
+// metricSet holds the series of every metric, by metric name and then by labels as written out, such as method="pat",result="allow"
+type metricSet struct {
+	Counters   map[string]map[string]float64    `json:"counters"`
+	Histograms map[string]map[string]*histogram `json:"histograms"`
+}
+
+func (s *metricSet) counters(name string) map[string]float64 {
+	if s.Counters == nil {
+		s.Counters = map[string]map[string]float64{}
+	}
+	if s.Counters[name] == nil {
+		s.Counters[name] = map[string]float64{}
+	}
+	return s.Counters[name]
+}
+
+func (s *metricSet) histogram(name, labels string) *histogram {
+	if s.Histograms == nil {
+		s.Histograms = map[string]map[string]*histogram{}
+	}
+	if s.Histograms[name] == nil {
+		s.Histograms[name] = map[string]*histogram{}
+	}
+	h := s.Histograms[name][labels]
+	if h == nil {
+		h = &histogram{}
+		s.Histograms[name][labels] = h
+	}
+	return h
+}
+
+// add adds the series of o to s
+func (s *metricSet) add(o *metricSet) {
+	for name, series := range o.Counters {
+		for labels, v := range series {
+			s.counters(name)[labels] += v
+		}
+	}
+	for name, series := range o.Histograms {
+		for labels, h := range series {
+			s.histogram(name, labels).add(h)
+		}
+	}
+}
+
+// writeText writes the metrics in the Prometheus text format
+func (s *metricSet) writeText(w io.Writer) error {
+	var b bytes.Buffer
+	for _, family := range metricFamilies {
+		kind := "counter"
+		if family.histogram {
+			kind = "histogram"
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, kind)
+
+		if !family.histogram {
+			series := s.Counters[family.name]
+			for _, labels := range slices.Sorted(maps.Keys(series)) {
+				fmt.Fprintf(&b, "%s%s %s\n", family.name, braced(labels), formatValue(series[labels]))
+			}
+			continue
+		}
+		series := s.Histograms[family.name]
+		for _, labels := range slices.Sorted(maps.Keys(series)) {
+			h := series[labels]
+			cumulative := uint64(0)
+			for i, le := range metricBuckets {
+				if i < len(h.Buckets) {
+					cumulative += h.Buckets[i]
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", family.name, braced(joinLabels(labels, label("le", formatValue(le)))), cumulative)
+			}
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", family.name, braced(joinLabels(labels, label("le", "+Inf"))), h.Count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", family.name, braced(labels), formatValue(h.Sum))
+			fmt.Fprintf(&b, "%s_count%s %d\n", family.name, braced(labels), h.Count)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label formats a label as written out, name="value"
+func label(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func joinLabels(labels ...string) string {
+	return strings.Join(slices.DeleteFunc(labels, func(l string) bool { return l == "" }), ",")
+}
+
+func braced(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metrics collects the observations of a process and adds them to the store
+// shared with every other process using the same path, so the metrics cover
+// all Postgres backends. Methods are safe to call on a nil *metrics.
+type metrics struct {
+	config metricsConfig
+	store  *fileStore[metricSet]
+
+	mu      sync.Mutex
+	pending metricSet
+}
+
+func newMetrics(cfg metricsConfig) *metrics {
+	return &metrics{config: cfg, store: &fileStore[metricSet]{Path: cfg.Path}}
+}
+
+// metricsFrom returns the metrics stored in the context, nil when there are none
+func metricsFrom(ctx context.Context) *metrics {
+	m, _ := ctx.Value(metricsKey).(*metrics)
+	return m
+}
+
+func (m *metrics) inc(family metricFamily, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending.counters(family.name)[joinLabels(labels...)]++
+}
+
+func (m *metrics) observe(family metricFamily, seconds float64, labels ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending.histogram(family.name, joinLabels(labels...)).observe(seconds)
+}
+
+// flush adds the pending observations to the store and writes the textfile
+func (m *metrics) flush() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	pending := m.pending
+	m.pending = metricSet{}
+	m.mu.Unlock()
+	if pending.Counters == nil && pending.Histograms == nil {
+		return nil
+	}
+
+	// the textfile is written under the lock too, so an older total never replaces a newer one
+	unlock, err := lockFile(m.config.Path, syscall.LOCK_EX, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	set, err := m.store.read()
+	if err != nil {
+		return err
+	}
+	set.add(&pending)
+	if err := m.store.write(set); err != nil {
+		return err
+	}
+	if m.config.Textfile == "" {
+		return nil
+	}
+	return writeTextfile(filepath.Join(m.config.Textfile, metricsTextfileName), set)
+}
+
+// snapshot returns the metrics of every process
+func (m *metrics) snapshot() (*metricSet, error) {
+	var set *metricSet
+	err := m.store.view(func(doc *metricSet) error {
+		set = doc
+		return nil
+	})
+	return set, err
+}
+
+// writeTextfile replaces the file atomically, node-exporter must never read half of it
+func writeTextfile(path string, set *metricSet) error {
+	var b bytes.Buffer
+	if err := set.writeText(&b); err != nil {
+		return err
+	}
+	// node-exporter only reads files ending in .prom
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	// node-exporter usually runs as another user
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write textfile: %w", err)
+	}
+	return nil
+}
+
+// metricsHandler serves the metrics of every process in the Prometheus text format
+func metricsHandler(current func() *metrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := current()
+		if m == nil {
+			http.Error(w, "metrics are disabled", http.StatusNotFound)
+			return
+		}
+		set, err := m.snapshot()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = set.writeText(w)
+	})
+}
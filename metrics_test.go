@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics_text(t *testing.T) {
+	var set metricSet
+	set.counters(metricDecisions.name)[joinLabels(label("method", "pat"), label("result", "allow"))] = 3
+	h := set.histogram(metricAPILatency.name, "")
+	h.observe(0.02)
+	h.observe(0.3)
+	h.observe(30)
+
+	var b bytes.Buffer
+	assert.NoError(t, set.writeText(&b))
+	text := b.String()
+	assert.Contains(t, text, "# TYPE jit_gatekeeper_decisions_total counter\n")
+	assert.Contains(t, text, `jit_gatekeeper_decisions_total{method="pat",result="allow"} 3`+"\n")
+	assert.Contains(t, text, "# TYPE jit_gatekeeper_api_request_duration_seconds histogram\n")
+	assert.Contains(t, text, `jit_gatekeeper_api_request_duration_seconds_bucket{le="0.01"} 0`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_api_request_duration_seconds_bucket{le="0.025"} 1`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_api_request_duration_seconds_bucket{le="10"} 2`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_api_request_duration_seconds_bucket{le="+Inf"} 3`+"\n")
+	assert.Contains(t, text, "jit_gatekeeper_api_request_duration_seconds_sum 30.32\n")
+	assert.Contains(t, text, "jit_gatekeeper_api_request_duration_seconds_count 3\n")
+
+	assert.Equal(t, `path="a\"b\\c"`, label("path", `a"b\c`))
+}
+
+func TestMetrics_gatekeeper(t *testing.T) {
+	status := http.StatusOK
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		permsHandler(w, r)
+	}))
+	defer api.Close()
+	dir := t.TempDir()
+	textfile := t.TempDir()
+	args := []string{
+		"apiUrl=" + api.URL,
+		"cacheTtl=1m",
+		"cachePath=" + filepath.Join(dir, "decisions.json"),
+		"metricsTextfile=" + textfile,
+		"metricsPath=" + filepath.Join(dir, "metrics.json"),
+	}
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	// every login is a separate process, with its own gatekeeper
+	login := func(token string) {
+		cfg, err := configFromArgs(args)
+		assert.NoError(t, err)
+		gk, err := newGatekeeper(cfg, discardLog)
+		assert.NoError(t, err)
+		_, _ = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: token})
+	}
+	login(pat)
+	login(pat)
+	status = http.StatusServiceUnavailable
+	login("sbp_0002223336d4dddd54e60cfa33441499b182bbbb")
+
+	data, err := os.ReadFile(filepath.Join(textfile, metricsTextfileName))
+	assert.NoError(t, err)
+	text := string(data)
+	assert.Contains(t, text, `jit_gatekeeper_decisions_total{method="pat",result="allow"} 2`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_decisions_total{method="pat",result="authinfo_unavailable"} 1`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_cache_lookups_total{result="hit"} 1`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_cache_lookups_total{result="miss"} 2`+"\n")
+	assert.Contains(t, text, `jit_gatekeeper_api_responses_total{code="200"} 1`+"\n")
+	// a 503 is retried twice by default
+	assert.Contains(t, text, `jit_gatekeeper_api_responses_total{code="503"} 3`+"\n")
+	assert.Contains(t, text, "jit_gatekeeper_api_retries_total 2\n")
+	assert.Contains(t, text, "jit_gatekeeper_api_request_duration_seconds_count 4\n")
+
+	fi, err := os.Stat(filepath.Join(textfile, metricsTextfileName))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	entries, err := os.ReadDir(textfile)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestMetrics_password(t *testing.T) {
+	host, port := fakePostgres(t, "28P01", "password authentication failed")
+	dir := t.TempDir()
+	cfg, err := configFromArgs([]string{
+		"methods=password",
+		"passwordHost=" + host,
+		"passwordPort=" + strconv.Itoa(port),
+		"metricsTextfile=" + dir,
+		"metricsPath=" + filepath.Join(dir, "metrics.json"),
+	})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	_, err = gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "guess"})
+	assert.ErrorIs(t, err, errAuthFailed)
+
+	data, err := os.ReadFile(filepath.Join(dir, metricsTextfileName))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `jit_gatekeeper_decisions_total{method="password",result="auth_failed"} 1`+"\n")
+	assert.Contains(t, string(data), "jit_gatekeeper_password_check_duration_seconds_count 1\n")
+}
+
+func TestMetrics_daemon(t *testing.T) {
+	store := filepath.Join(t.TempDir(), "metrics.json")
+	serve := func(configYAML string) *httptest.ResponseRecorder {
+		d, err := newDaemon(writeConfig(t, "trust_local: true\nmetrics:\n  path: "+store+"\n"+configYAML), discardLog)
+		assert.NoError(t, err)
+		_, err = d.state.Load().gatekeeper.Trust(context.Background(), &loginRequest{User: "postgres", Rhost: "[local]"})
+		assert.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		d.metricsServer().Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec
+	}
+
+	// the endpoint is only served when it is configured
+	rec := serve("")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = serve("daemon:\n  metrics_listen: 127.0.0.1:9464\n")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "version=0.0.4")
+	assert.Contains(t, rec.Body.String(), `jit_gatekeeper_decisions_total{method="trust",result="allow"} 1`+"\n")
+}
@@ -1,5 +1,7 @@
 
+#include <stdlib.h>
 #include <security/pam_appl.h>
+#include <security/pam_modules.h>
 
 #ifdef __linux__
 #include <security/pam_ext.h>
@@ -48,3 +50,13 @@ void pam_syslog_str(pam_handle_t *pamh, int priority, const char *str) {
   pam_syslog(pamh, priority, "%s", str);
 #endif
 }
+
+// pam_free_data is the pam_set_data cleanup for strings allocated with C.CString
+static void pam_free_data(pam_handle_t *pamh, void *data, int error_status) {
+  free(data);
+}
+
+// pam_set_data_str stores str under name, PAM frees str when the handle is ended
+int pam_set_data_str(pam_handle_t *pamh, const char *name, char *str) {
+  return pam_set_data(pamh, name, str, pam_free_data);
+}
@@ -14,13 +14,20 @@ package main
 
 char* argv_i(const char **argv, int i);
 void pam_syslog_str(pam_handle_t *pamh, int priority, const char *str);
+int pam_set_data_str(pam_handle_t *pamh, const char *name, char *str);
 */
 import "C"
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/syslog"
+	"os"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -28,9 +35,31 @@ type key int
 
 const (
 	rhostKey key = iota
+	metricsKey
+	tracerKey
+	spanKey
 )
 
+// least severe priority written to syslog, set from the config once parsed.
+// gatekeeperd sets it on reload while logins are being logged.
+var logLevel atomic.Int32
+
+func init() {
+	setLogLevel(syslog.LOG_DEBUG)
+}
+
+func setLogLevel(priority syslog.Priority) {
+	logLevel.Store(int32(priority))
+}
+
+// logged reports whether messages of the priority are written
+func logged(priority syslog.Priority) bool {
+	return int32(priority) <= logLevel.Load()
+}
+
+// main is never run in the PAM module, built as an executable this package is gatekeeperd
 func main() {
+	os.Exit(runCommand(os.Args))
 }
 
 //export pam_sm_authenticate_go
@@ -48,10 +77,33 @@ func pam_sm_authenticate_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv
 		pamSyslog(pamh, syslog.LOG_ERR, "failed to parse config: %v", err)
 		return C.PAM_SERVICE_ERR
 	}
+	setLogLevel(cfg.LogLevel)
 
 	// Validate config
-	if cfg.AuthAPIURL == "" {
-		pamSyslog(pamh, syslog.LOG_WARNING, "no apiUrl set, only password auth will work")
+	if err := cfg.validate(); err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "invalid config: %v", err)
+		return C.PAM_SERVICE_ERR
+	}
+	for _, w := range cfg.Warnings {
+		pamSyslog(pamh, syslog.LOG_WARNING, "%s", w)
+	}
+	if cfg.AuthAPIURL == "" && cfg.JWKSURL == "" {
+		pamSyslog(pamh, syslog.LOG_WARNING, "no apiUrl or jwks set, only password auth will work")
+	} else if cfg.AuthAPIURL == "" {
+		pamSyslog(pamh, syslog.LOG_WARNING, "no apiUrl set, only password and JWT auth will work")
+	}
+
+	// logins are decided in-process, or by gatekeeperd when daemonSocket is set
+	log := func(priority syslog.Priority, format string, a ...any) {
+		pamSyslog(pamh, priority, format, a...)
+	}
+	evaluator, err := newLoginEvaluator(cfg, log)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "invalid config: %v", err)
+		return pamCode(err)
+	}
+	if closer, ok := evaluator.(io.Closer); ok {
+		defer closer.Close()
 	}
 
 	// get the remote host from PAM_RHOST
@@ -60,21 +112,9 @@ func pam_sm_authenticate_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv
 		pamSyslog(pamh, syslog.LOG_ERR, "failed to get rhost: %v", pamStrError(pamh, errnum))
 		return errnum
 	}
-
-	// store the rhost in the context so it can be used for
-	// authz decisions later
 	rhost := C.GoString(cRhost)
-	ctx = context.WithValue(ctx, rhostKey, rhost)
 
 	pamSyslog(pamh, syslog.LOG_INFO, "connection from %s", rhost)
-	// if localhost connection and configuration is to trust localhost
-	// emmulate the pg_hba.conf setting
-	// host all all 127.0.0.1/32 trust
-	// host all all ::1/0 trust
-	// if cfg.TrustLocal && (rhost == "127.0.0.1" || rhost == "::1") {
-	// 	pamSyslog(pamh, syslog.LOG_INFO, "local connection trusted")
-	// 	return c.PAM_SUCCESS
-	// }
 
 	// Get (or prompt for) user
 	var cUser *C.char
@@ -88,29 +128,34 @@ func pam_sm_authenticate_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv
 		pamSyslog(pamh, syslog.LOG_WARNING, "empty user")
 		return C.PAM_USER_UNKNOWN
 	}
+	req := &loginRequest{User: user, Rhost: rhost, PID: os.Getpid()}
 
-	// Get (or prompt for) password (token)
-	var cToken *C.char
-	if errnum := C.pam_get_authtok(pamh, C.PAM_AUTHTOK, &cToken, nil); errnum != C.PAM_SUCCESS {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to get token: %v", pamStrError(pamh, errnum))
-		return errnum
+	// trusted connections are let in without asking for a token
+	g, err := evaluator.Trust(ctx, req)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_WARNING, "failed to check trust: %v", err)
+		return pamCode(err)
 	}
-	token := C.GoString(cToken)
 
-	// determine which authenticator to use
-	auth, err := discoverAuthenticator(ctx, cfg, token)
-	if err != nil {
-		pamSyslog(pamh, syslog.LOG_ERR, "failed to discover authenticator: %v", err)
-		return C.PAM_AUTH_ERR
+	if g == nil {
+		// Get (or prompt for) password (token)
+		var cToken *C.char
+		if errnum := C.pam_get_authtok(pamh, C.PAM_AUTHTOK, &cToken, nil); errnum != C.PAM_SUCCESS {
+			pamSyslog(pamh, syslog.LOG_ERR, "failed to get token: %v", pamStrError(pamh, errnum))
+			return errnum
+		}
+		req.Token = C.GoString(cToken)
+
+		if g, err = evaluator.Authenticate(ctx, req); err != nil {
+			return pamCode(err)
+		}
 	}
 
-	// do the actual authentication and authorization
-	// this will use the correct authenticator automatically, either password or PAT/JWT against an api
-	if err := auth.Authenticate(ctx, user, token); err != nil {
-		pamSyslog(pamh, syslog.LOG_WARNING, "failed to authenticate: %v", err)
-		return C.PAM_AUTH_ERR
+	// keep the grant for pam_sm_acct_mgmt_go
+	if err := setGrant(pamh, g); err != nil {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to store grant: %v", err)
+		return C.PAM_SYSTEM_ERR
 	}
-	pamSyslog(pamh, syslog.LOG_INFO, "authenticated: %v", user)
 	return C.PAM_SUCCESS
 }
 
@@ -138,18 +183,92 @@ func pam_sm_acct_mgmt_go(pamh *C.pam_handle_t, flags C.int, argc C.int, argv **C
 	// This function performs the task of establishing whether the user
 	// is permitted to gain access at this time. It should be understood
 	// that the user has previously been validated by an authentication module.
-	// We assume that pam_sm_authenticate_go has been called and done
-	// the authentication.
-	// Because token expiration checks happen in pam_sm_acct_mgmt_go, we do not
-	// need to do another expiration check here (there shouldn't be a multi-minute delay between calls)
+	// pam_sm_authenticate_go stores the grant it validated on the handle,
+	// without one we fail closed, as authentication was not done by us.
+	var cUser *C.char
+	if errnum := C.pam_get_user(pamh, &cUser, nil); errnum != C.PAM_SUCCESS {
+		pamSyslog(pamh, syslog.LOG_ERR, "failed to get user: %v", pamStrError(pamh, errnum))
+		return errnum
+	}
+	user := C.GoString(cUser)
+
+	g, err := getGrant(pamh)
+	if err != nil {
+		pamSyslog(pamh, syslog.LOG_WARNING, "no grant for %s: %v", user, err)
+		return C.PAM_PERM_DENIED
+	}
+
+	if err := g.check(user, time.Now()); err != nil {
+		pamSyslog(pamh, syslog.LOG_WARNING, "account check failed: %v", err)
+		if errors.Is(err, errGrantExpired) {
+			return C.PAM_ACCT_EXPIRED
+		}
+		return C.PAM_PERM_DENIED
+	}
 	return C.PAM_SUCCESS
 }
 
+// setGrant stores the grant on the PAM handle, PAM owns the memory afterwards
+func setGrant(pamh *C.pam_handle_t, g *grant) error {
+	data, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	cName := C.CString(grantDataName)
+	defer C.free(unsafe.Pointer(cName))
+
+	cData := C.CString(string(data))
+	if errnum := C.pam_set_data_str(pamh, cName, cData); errnum != C.PAM_SUCCESS {
+		C.free(unsafe.Pointer(cData))
+		return fmt.Errorf("%s", pamStrError(pamh, errnum))
+	}
+	return nil
+}
+
+// getGrant reads the grant stored by setGrant
+func getGrant(pamh *C.pam_handle_t) (*grant, error) {
+	cName := C.CString(grantDataName)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cData *C.char
+	if errnum := C.pam_get_data(pamh, cName, (*unsafe.Pointer)(unsafe.Pointer(&cData))); errnum != C.PAM_SUCCESS {
+		return nil, fmt.Errorf("%s", pamStrError(pamh, errnum))
+	}
+
+	var g grant
+	if err := json.Unmarshal([]byte(C.GoString(cData)), &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// pamCode maps an error from authenticator.Authenticate to the PAM return code
+// that describes it, so stacked PAM configurations can react to the failure
+func pamCode(err error) C.int {
+	switch {
+	case errors.Is(err, errServiceConfig):
+		return C.PAM_SERVICE_ERR
+	case errors.Is(err, errLockedOut):
+		return C.PAM_MAXTRIES
+	case errors.Is(err, errAuthInfoUnavailable):
+		return C.PAM_AUTHINFO_UNAVAIL
+	case errors.Is(err, errCredExpired):
+		return C.PAM_CRED_EXPIRED
+	case errors.Is(err, errPermDenied), errors.Is(err, errInsufficientAssurance):
+		return C.PAM_PERM_DENIED
+	default:
+		return C.PAM_AUTH_ERR
+	}
+}
+
 func pamStrError(pamh *C.pam_handle_t, errnum C.int) string {
 	return C.GoString(C.pam_strerror(pamh, errnum))
 }
 
 func pamSyslog(pamh *C.pam_handle_t, priority syslog.Priority, format string, a ...interface{}) {
+	if !logged(priority) {
+		return
+	}
 	cstr := C.CString(fmt.Sprintf(format, a...))
 	defer C.free(unsafe.Pointer(cstr))
 
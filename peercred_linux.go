@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials reads the credentials of the process on the other end of conn with SO_PEERCRED
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, credErr
+	}
+	return &peerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
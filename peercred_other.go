@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials is only implemented on Linux, elsewhere gatekeeperd refuses every connection
+func peerCredentials(conn *net.UnixConn) (*peerCred, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on this platform")
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// policy further restricts the logins the API or another authenticator
+// granted. Deny rules take precedence over allow rules, the first matching deny
+// rule refuses the login. Otherwise the first matching allow rule admits it,
+// and when no rule matches Default decides.
+//
+//	default: allow
+//	rules:
+//	  - name: no superuser JIT from outside the VPN
+//	    effect: deny
+//	    roles: [postgres, supabase_admin]
+//	    except:
+//	      cidrs: [10.8.0.0/16, local]
+//	  - name: app roles during office hours
+//	    effect: deny
+//	    roles: [app_*]
+//	    except:
+//	      time: {days: [mon, tue, wed, thu, fri], from: "08:00", to: "18:00", timezone: Europe/Berlin}
+//	  - name: only MFA sessions
+//	    effect: deny
+//	    methods: [jwt]
+//	    except:
+//	      claims: {aal: aal2}
+//
+// Conditions the fields can't express are written as expressions, see expr.go,
+// which may test the networks declared in the policy by name.
+//
+//	networks:
+//	  corp_cidrs: [10.8.0.0/16, 192.168.10.0/24]
+//	rules:
+//	  - name: superuser only with MFA from the office
+//	    effect: deny
+//	    expr: "role == 'postgres' && !(has(claims.aal) && claims.aal == 'aal2' && rhost in corp_cidrs)"
+type policy struct {
+	Default policyEffect
+	Rules   []policyRule
+	// named networks expressions can test addresses against
+	Networks map[string][]netip.Prefix
+}
+
+type policyEffect string
+
+const (
+	policyAllow policyEffect = "allow"
+	policyDeny  policyEffect = "deny"
+)
+
+// policyRule matches a login when every condition of Match holds, unless every condition of Except holds as well
+type policyRule struct {
+	Name   string
+	Effect policyEffect
+	Match  policyMatch
+	// nil when there are no exceptions
+	Except *policyMatch
+}
+
+// policyMatch holds the conditions of a rule, conditions that are not set match any login
+type policyMatch struct {
+	// globs, such as app_*
+	Roles []string
+	// the login comes from one of Prefixes, or over the unix socket when Local is set
+	Prefixes []netip.Prefix
+	Local    bool
+	Methods  []AuthMethod
+	UserIDs  []string
+	// claims of the JWT and the values accepted for each, by dotted path such as app_metadata.provider
+	Claims map[string][]string
+	// nil for any time
+	Time *timeWindow
+	// nil unless the condition is an expression
+	Expr *compiledExpr
+}
+
+// timeWindow is a daily window of time in a timezone, From and To are offsets from midnight.
+// The window wraps past midnight when To is before From.
+type timeWindow struct {
+	// empty for every day
+	Days     []time.Weekday
+	From, To time.Duration
+	Location *time.Location
+}
+
+// policyInput is what rules are evaluated against
+type policyInput struct {
+	Role   string
+	Rhost  string
+	Method AuthMethod
+	UserId string
+	// nil unless the login used a JWT
+	Claims map[string]any
+	// the grant as the authenticator, such as the API, returned it
+	Grant grant
+	Time  time.Time
+}
+
+// newPolicyInput describes a granted login to the policy
+func newPolicyInput(req *loginRequest, g *grant, now time.Time) *policyInput {
+	in := &policyInput{Role: req.User, Rhost: req.Rhost, Method: g.Method, UserId: g.UserId, Grant: *g, Time: now}
+	if g.Method == AuthJwt {
+		// the token was verified before it was granted, only its claims are needed here
+		if p, err := parseJWT(req.Token); err == nil {
+			in.Claims = p.Claims.Raw
+		}
+	}
+	return in
+}
+
+// evaluate returns the effect of the policy on the login and the name of the
+// rule deciding it. A rule whose expression fails, such as on a claim the token
+// doesn't have, denies the login along with the error.
+func (p *policy) evaluate(in *policyInput) (policyEffect, string, error) {
+	vars := in.exprVars(p.Networks)
+	for _, effect := range []policyEffect{policyDeny, policyAllow} {
+		for _, r := range p.Rules {
+			if r.Effect != effect {
+				continue
+			}
+			ok, err := r.matches(in, vars)
+			if err != nil {
+				return policyDeny, r.Name, err
+			}
+			if ok {
+				return effect, r.Name, nil
+			}
+		}
+	}
+	return p.Default, "default", nil
+}
+
+func (r *policyRule) matches(in *policyInput, vars exprVars) (bool, error) {
+	ok, err := r.Match.matches(in, vars)
+	if err != nil || !ok || r.Except == nil {
+		return ok, err
+	}
+	except, err := r.Except.matches(in, vars)
+	return !except, err
+}
+
+func (m *policyMatch) matches(in *policyInput, vars exprVars) (bool, error) {
+	if !m.matchesFields(in) {
+		return false, nil
+	}
+	if m.Expr == nil {
+		return true, nil
+	}
+	return m.Expr.evalBool(vars)
+}
+
+func (m *policyMatch) matchesFields(in *policyInput) bool {
+	if len(m.Roles) > 0 && !matchRole(m.Roles, in.Role) {
+		return false
+	}
+	if len(m.Prefixes) > 0 || m.Local {
+		addr, local, err := parseRhost(in.Rhost)
+		if err != nil {
+			return false
+		}
+		if !(local && m.Local) && !slices.ContainsFunc(m.Prefixes, func(p netip.Prefix) bool { return !local && p.Contains(addr) }) {
+			return false
+		}
+	}
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, in.Method) {
+		return false
+	}
+	if len(m.UserIDs) > 0 && !slices.Contains(m.UserIDs, in.UserId) {
+		return false
+	}
+	for name, accepted := range m.Claims {
+		if !claimMatches(lookupClaim(in.Claims, name), accepted) {
+			return false
+		}
+	}
+	return m.Time == nil || m.Time.contains(in.Time)
+}
+
+// policyExprEnv declares the variables of policy expressions, the networks of the policy among them
+func policyExprEnv(networks map[string][]netip.Prefix) exprEnv {
+	env := exprEnv{
+		"role":    typeString,
+		"rhost":   typeString,
+		"method":  typeString,
+		"user_id": typeString,
+		"claims":  mapOf(typeDyn),
+		// expires_at is missing when the grant doesn't expire
+		"grant": objectOf(map[string]*exprType{
+			"role": typeString, "user_id": typeString, "method": typeString, "target": typeString, "expires_at": typeTimestamp,
+		}),
+		"now": typeTimestamp,
+	}
+	for name := range networks {
+		env[name] = typeNetworks
+	}
+	return env
+}
+
+// exprVars returns the values of the variables declared by policyExprEnv
+func (in *policyInput) exprVars(networks map[string][]netip.Prefix) exprVars {
+	claims, _ := exprValue(in.Claims).(map[string]any)
+	if claims == nil {
+		claims = map[string]any{}
+	}
+	g := map[string]any{"role": in.Grant.Role, "user_id": in.Grant.UserId, "method": string(in.Grant.Method), "target": in.Grant.Target}
+	if !in.Grant.ExpiresAt.IsZero() {
+		g["expires_at"] = in.Grant.ExpiresAt
+	}
+	vars := exprVars{
+		"role":    in.Role,
+		"rhost":   in.Rhost,
+		"method":  string(in.Method),
+		"user_id": in.UserId,
+		"claims":  claims,
+		"grant":   g,
+		"now":     in.Time,
+	}
+	for name, prefixes := range networks {
+		vars[name] = prefixes
+	}
+	return vars
+}
+
+// lookupClaim returns the claim at the dotted path, nil when there is none.
+// Paths continue into arrays, amr.method is the method of every element of amr.
+func lookupClaim(claims map[string]any, name string) any {
+	var v any = claims
+	keys := strings.Split(name, ".")
+	for i, key := range keys {
+		switch obj := v.(type) {
+		case map[string]any:
+			v = obj[key]
+		case []any:
+			var values []any
+			for _, e := range obj {
+				if m, ok := e.(map[string]any); ok {
+					values = append(values, lookupClaim(m, strings.Join(keys[i:], ".")))
+				}
+			}
+			return values
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// claimMatches reports whether the claim, or any element when it is an array, is one of the accepted values
+func claimMatches(claim any, accepted []string) bool {
+	switch v := claim.(type) {
+	case nil:
+		return false
+	case []any:
+		return slices.ContainsFunc(v, func(e any) bool { return claimMatches(e, accepted) })
+	case string:
+		return slices.Contains(accepted, v)
+	case json.Number, bool:
+		return slices.Contains(accepted, fmt.Sprint(v))
+	default:
+		// objects never match a value
+		return false
+	}
+}
+
+func (w *timeWindow) contains(t time.Time) bool {
+	t = t.In(w.Location)
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.Location)
+	offset := t.Sub(midnight)
+	day := t.Weekday()
+	if w.To <= w.From {
+		// past midnight the window belongs to the day it started on
+		if offset < w.To {
+			return w.onDay((day + 6) % 7)
+		}
+		return offset >= w.From && w.onDay(day)
+	}
+	return offset >= w.From && offset < w.To && w.onDay(day)
+}
+
+func (w *timeWindow) onDay(day time.Weekday) bool {
+	return len(w.Days) == 0 || slices.Contains(w.Days, day)
+}
+
+// policyFile is the layout of the policy file
+type policyFile struct {
+	Default  string                `yaml:"default"`
+	Networks map[string]stringList `yaml:"networks"`
+	Rules    []policyRuleFile      `yaml:"rules"`
+}
+
+type policyRuleFile struct {
+	Name            string `yaml:"name"`
+	Effect          string `yaml:"effect"`
+	policyMatchFile `yaml:",inline"`
+	Except          *policyMatchFile `yaml:"except"`
+}
+
+type policyMatchFile struct {
+	Roles   []string              `yaml:"roles"`
+	CIDRs   []string              `yaml:"cidrs"`
+	Methods []string              `yaml:"methods"`
+	UserIDs []string              `yaml:"user_ids"`
+	Claims  map[string]stringList `yaml:"claims"`
+	Time    *timeWindowFile       `yaml:"time"`
+	Expr    string                `yaml:"expr"`
+}
+
+type timeWindowFile struct {
+	Days     []string `yaml:"days"`
+	From     string   `yaml:"from"`
+	To       string   `yaml:"to"`
+	Timezone string   `yaml:"timezone"`
+}
+
+// stringList is a list of strings, or a single string
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*l = stringList{n.Value}
+		return nil
+	}
+	var list []string
+	if err := n.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// loadPolicy reads the policy file, every rule is checked so that mistakes show up when the config is loaded
+func loadPolicy(filename string) (*policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy: %w", err)
+	}
+	defer f.Close()
+
+	var pf policyFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("failed to parse policy %s: %w", filename, err)
+	}
+
+	p := &policy{Default: policyAllow}
+	if pf.Default != "" {
+		if p.Default, err = parsePolicyEffect(pf.Default); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", filename, err)
+		}
+	}
+	if len(pf.Networks) > 0 {
+		p.Networks = map[string][]netip.Prefix{}
+		for name, cidrs := range pf.Networks {
+			if _, ok := policyExprEnv(nil)[name]; ok {
+				return nil, fmt.Errorf("policy %s: network %q has the name of a variable", filename, name)
+			}
+			prefixes, err := parseCIDRs(strings.Join(cidrs, ","))
+			if err != nil {
+				return nil, fmt.Errorf("policy %s: network %q: %w", filename, name, err)
+			}
+			p.Networks[name] = prefixes
+		}
+	}
+	env := policyExprEnv(p.Networks)
+	for i, rf := range pf.Rules {
+		r, err := rf.compile(env)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: rule %d: %w", filename, i, err)
+		}
+		if slices.ContainsFunc(p.Rules, func(other policyRule) bool { return other.Name == r.Name }) {
+			return nil, fmt.Errorf("policy %s: rule %d: duplicate name %q", filename, i, r.Name)
+		}
+		p.Rules = append(p.Rules, r)
+	}
+	return p, nil
+}
+
+func parsePolicyEffect(s string) (policyEffect, error) {
+	switch effect := policyEffect(s); effect {
+	case policyAllow, policyDeny:
+		return effect, nil
+	default:
+		return "", fmt.Errorf("unknown effect: %v", s)
+	}
+}
+
+func (rf *policyRuleFile) compile(env exprEnv) (policyRule, error) {
+	if rf.Name == "" {
+		return policyRule{}, fmt.Errorf("rule without name")
+	}
+	effect, err := parsePolicyEffect(rf.Effect)
+	if err != nil {
+		return policyRule{}, err
+	}
+	r := policyRule{Name: rf.Name, Effect: effect}
+	if r.Match, err = rf.policyMatchFile.compile(env); err != nil {
+		return policyRule{}, err
+	}
+	if rf.Except != nil {
+		except, err := rf.Except.compile(env)
+		if err != nil {
+			return policyRule{}, fmt.Errorf("except: %w", err)
+		}
+		r.Except = &except
+	}
+	return r, nil
+}
+
+func (mf *policyMatchFile) compile(env exprEnv) (policyMatch, error) {
+	m := policyMatch{Roles: mf.Roles, UserIDs: mf.UserIDs}
+	if _, err := parseRolePatterns(mf.Roles); err != nil {
+		return policyMatch{}, err
+	}
+	for _, cidr := range mf.CIDRs {
+		if cidr == "local" {
+			m.Local = true
+			continue
+		}
+		prefixes, err := parseCIDRs(cidr)
+		if err != nil {
+			return policyMatch{}, err
+		}
+		m.Prefixes = append(m.Prefixes, prefixes...)
+	}
+	for _, name := range mf.Methods {
+		method := AuthMethod(name)
+		if _, ok := authenticatorFactories[method]; !ok && method != AuthTrust {
+			return policyMatch{}, fmt.Errorf("unknown authentication method: %v", name)
+		}
+		m.Methods = append(m.Methods, method)
+	}
+	if len(mf.Claims) > 0 {
+		m.Claims = map[string][]string{}
+		for name, values := range mf.Claims {
+			m.Claims[name] = []string(values)
+		}
+	}
+	if mf.Time != nil {
+		w, err := mf.Time.compile()
+		if err != nil {
+			return policyMatch{}, fmt.Errorf("time: %w", err)
+		}
+		m.Time = w
+	}
+	if mf.Expr != "" {
+		e, err := compileBoolExpr(mf.Expr, env)
+		if err != nil {
+			return policyMatch{}, err
+		}
+		m.Expr = e
+	}
+	return m, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (wf *timeWindowFile) compile() (*timeWindow, error) {
+	w := &timeWindow{Location: time.UTC}
+	for _, name := range wf.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day: %v", name)
+		}
+		w.Days = append(w.Days, day)
+	}
+	var err error
+	if w.From, err = parseClock(wf.From); err != nil {
+		return nil, err
+	}
+	if wf.To == "" {
+		wf.To = "24:00"
+	}
+	if w.To, err = parseClock(wf.To); err != nil {
+		return nil, err
+	}
+	if wf.Timezone != "" {
+		if w.Location, err = time.LoadLocation(wf.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day as HH:MM, empty for midnight
+func parseClock(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+rules:
+  - name: no superuser JIT from outside the VPN
+    effect: deny
+    roles: [postgres, supabase_admin]
+    except:
+      cidrs: [10.8.0.0/16, local]
+  - name: app roles during office hours
+    effect: deny
+    roles: [app_*]
+    except:
+      time: {days: [mon, tue, wed, thu, fri], from: "08:00", to: "18:00", timezone: Europe/Berlin}
+  - name: only MFA sessions
+    effect: deny
+    methods: [jwt]
+    except:
+      claims: {aal: aal2, amr.method: [totp, webauthn]}
+  - name: banned user
+    effect: deny
+    user_ids: [bad-user]
+  - name: allow everyone else
+    effect: allow
+`
+
+func TestPolicy_evaluate(t *testing.T) {
+	p, err := loadPolicy(writeConfig(t, testPolicy))
+	assert.NoError(t, err)
+
+	// a Wednesday, 10:00 in Berlin
+	office := time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC)
+	mfa := map[string]any{"aal": "aal2", "amr": []any{map[string]any{"method": "totp"}}}
+
+	for name, tc := range map[string]struct {
+		in     policyInput
+		effect policyEffect
+		rule   string
+	}{
+		"superuser from the VPN": {
+			in:     policyInput{Role: "postgres", Rhost: "10.8.1.2", Method: AuthPat, Time: office},
+			effect: policyAllow, rule: "allow everyone else",
+		},
+		"superuser over the unix socket": {
+			in:     policyInput{Role: "postgres", Rhost: "[local]", Method: AuthPassword, Time: office},
+			effect: policyAllow, rule: "allow everyone else",
+		},
+		"superuser from outside the VPN": {
+			in:     policyInput{Role: "supabase_admin", Rhost: "192.0.2.1", Method: AuthPat, Time: office},
+			effect: policyDeny, rule: "no superuser JIT from outside the VPN",
+		},
+		"app role in office hours": {
+			in:     policyInput{Role: "app_reporting", Rhost: "192.0.2.1", Method: AuthPat, Time: office},
+			effect: policyAllow, rule: "allow everyone else",
+		},
+		"app role after hours": {
+			in:     policyInput{Role: "app_reporting", Rhost: "192.0.2.1", Method: AuthPat, Time: office.Add(9 * time.Hour)},
+			effect: policyDeny, rule: "app roles during office hours",
+		},
+		"app role on the weekend": {
+			in:     policyInput{Role: "app_reporting", Rhost: "192.0.2.1", Method: AuthPat, Time: office.Add(72 * time.Hour)},
+			effect: policyDeny, rule: "app roles during office hours",
+		},
+		"jwt with mfa": {
+			in:     policyInput{Role: "reader", Rhost: "192.0.2.1", Method: AuthJwt, Claims: mfa, Time: office},
+			effect: policyAllow, rule: "allow everyone else",
+		},
+		"jwt without mfa": {
+			in:     policyInput{Role: "reader", Rhost: "192.0.2.1", Method: AuthJwt, Claims: map[string]any{"aal": "aal1"}, Time: office},
+			effect: policyDeny, rule: "only MFA sessions",
+		},
+		"deny takes precedence over allow": {
+			in:     policyInput{Role: "reader", Rhost: "192.0.2.1", Method: AuthPat, UserId: "bad-user", Time: office},
+			effect: policyDeny, rule: "banned user",
+		},
+	} {
+		effect, rule, err := p.evaluate(&tc.in)
+		assert.NoError(t, err, name)
+		assert.Equal(t, tc.effect, effect, name)
+		assert.Equal(t, tc.rule, rule, name)
+	}
+
+	p, err = loadPolicy(writeConfig(t, "default: deny\nrules:\n  - name: readers\n    effect: allow\n    roles: [reader]\n"))
+	assert.NoError(t, err)
+	effect, rule, err := p.evaluate(&policyInput{Role: "postgres", Time: office})
+	assert.NoError(t, err)
+	assert.Equal(t, policyDeny, effect)
+	assert.Equal(t, "default", rule)
+}
+
+func TestPolicy_timeWindow(t *testing.T) {
+	w, err := (&timeWindowFile{Days: []string{"fri"}, From: "22:00", To: "06:00"}).compile()
+	assert.NoError(t, err)
+	friday := time.Date(2025, 7, 25, 0, 0, 0, 0, time.UTC)
+	assert.False(t, w.contains(friday.Add(21*time.Hour)))
+	assert.True(t, w.contains(friday.Add(23*time.Hour)))
+	// the window started on friday
+	assert.True(t, w.contains(friday.Add(29*time.Hour)))
+	assert.False(t, w.contains(friday.Add(31*time.Hour)))
+	assert.False(t, w.contains(friday.Add(-2*time.Hour)))
+}
+
+func TestPolicy_load(t *testing.T) {
+	for policy, want := range map[string]string{
+		"rules:\n  - name: a\n    effect: maybe\n":                                "rule 0: unknown effect: maybe",
+		"rules:\n  - effect: deny\n":                                              "rule 0: rule without name",
+		"rules:\n  - name: a\n    effect: deny\n    cidrs: [10.0.0.0/33]\n":       "invalid cidr",
+		"rules:\n  - name: a\n    effect: deny\n    methods: [kerberos]\n":        "unknown authentication method: kerberos",
+		"rules:\n  - name: a\n    effect: deny\n    roles: ['[']\n":               "invalid role pattern",
+		"rules:\n  - name: a\n    effect: deny\n    time: {from: '25:00'}\n":      "time: invalid time of day",
+		"rules:\n  - name: a\n    effect: deny\n    time: {days: [someday]}\n":    "unknown day: someday",
+		"rules:\n  - name: a\n    effect: deny\n  - name: a\n    effect: allow\n": "rule 1: duplicate name",
+		"rules:\n  - name: a\n    effect: deny\n    rhost: 10.0.0.1\n":            "field rhost not found",
+		"rules:\n  - name: a\n    effect: deny\n    expr: rol == 'x'\n":           `undeclared reference to "rol"`,
+		"rules:\n  - name: a\n    effect: deny\n    expr: role\n":                 "of type string, not bool",
+		"networks: {role: [10.0.0.0/8]}\n":                                        `network "role" has the name of a variable`,
+		"networks: {corp: [10.0.0.0/33]}\n":                                       "invalid cidr",
+	} {
+		_, err := loadPolicy(writeConfig(t, policy))
+		assert.ErrorContains(t, err, want, policy)
+	}
+}
+
+func TestPolicy_expr(t *testing.T) {
+	p, err := loadPolicy(writeConfig(t, `
+networks:
+  corp_cidrs: [10.8.0.0/16, 192.168.10.0/24]
+rules:
+  - name: superuser only with MFA from the office
+    effect: deny
+    expr: "role == 'postgres' && !(has(claims.aal) && claims.aal == 'aal2' && rhost in corp_cidrs)"
+  - name: grants expiring too late
+    effect: deny
+    methods: [pat]
+    except:
+      expr: "has(grant.expires_at) && grant.expires_at - now <= duration('1h')"
+  - name: require an email
+    effect: deny
+    methods: [jwt]
+    expr: "!claims.email.endsWith('@example.com')"
+`))
+	assert.NoError(t, err)
+	now := time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC)
+
+	for name, tc := range map[string]struct {
+		in     policyInput
+		effect policyEffect
+		rule   string
+		err    string
+	}{
+		"superuser with mfa from the office": {
+			in:     policyInput{Role: "postgres", Rhost: "10.8.1.2", Method: AuthJwt, Claims: map[string]any{"aal": "aal2", "email": "a@example.com"}, Time: now},
+			effect: policyAllow, rule: "default",
+		},
+		"superuser without mfa": {
+			in:     policyInput{Role: "postgres", Rhost: "10.8.1.2", Method: AuthJwt, Claims: map[string]any{"aal": "aal1", "email": "a@example.com"}, Time: now},
+			effect: policyDeny, rule: "superuser only with MFA from the office",
+		},
+		"superuser from elsewhere": {
+			in:     policyInput{Role: "postgres", Rhost: "[local]", Method: AuthJwt, Claims: map[string]any{"aal": "aal2"}, Time: now},
+			effect: policyDeny, rule: "superuser only with MFA from the office",
+		},
+		"short grant": {
+			in:     policyInput{Role: "reader", Method: AuthPat, Grant: grant{ExpiresAt: now.Add(time.Hour)}, Time: now},
+			effect: policyAllow, rule: "default",
+		},
+		"long grant": {
+			in:     policyInput{Role: "reader", Method: AuthPat, Grant: grant{ExpiresAt: now.Add(2 * time.Hour)}, Time: now},
+			effect: policyDeny, rule: "grants expiring too late",
+		},
+		"grant without expiry": {
+			in:     policyInput{Role: "reader", Method: AuthPat, Time: now},
+			effect: policyDeny, rule: "grants expiring too late",
+		},
+		"missing claim fails closed": {
+			in:     policyInput{Role: "reader", Method: AuthJwt, Claims: map[string]any{}, Time: now},
+			effect: policyDeny, rule: "require an email", err: "no such key: email",
+		},
+	} {
+		effect, rule, err := p.evaluate(&tc.in)
+		if tc.err != "" {
+			assert.ErrorContains(t, err, tc.err, name)
+		} else {
+			assert.NoError(t, err, name)
+		}
+		assert.Equal(t, tc.effect, effect, name)
+		assert.Equal(t, tc.rule, rule, name)
+	}
+}
+
+func TestPolicy_gatekeeper(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(permsHandler))
+	defer api.Close()
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "trustLocal=true", "policy=" + writeConfig(t, testPolicy)})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	ctx := context.Background()
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "10.8.0.2", Token: pat})
+	assert.NoError(t, err)
+
+	_, err = gk.Authenticate(ctx, &loginRequest{User: "postgres", Rhost: "192.0.2.1", Token: pat})
+	assert.ErrorIs(t, err, errPermDenied)
+	assert.ErrorContains(t, err, `denied by policy rule "no superuser JIT from outside the VPN"`)
+
+	// the loopback is trusted, but not outside the VPN
+	g, err := gk.Trust(ctx, &loginRequest{User: "postgres", Rhost: "127.0.0.1"})
+	assert.NoError(t, err)
+	assert.Nil(t, g)
+	g, err = gk.Trust(ctx, &loginRequest{User: "postgres", Rhost: "[local]"})
+	assert.NoError(t, err)
+	assert.Equal(t, AuthTrust, g.Method)
+
+	cfg.PolicyPath = writeConfig(t, "rules: [")
+	_, err = newGatekeeper(cfg, discardLog)
+	assert.ErrorContains(t, err, "failed to parse policy")
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// processStart is only implemented on Linux, elsewhere backends are recorded without their start time
+func processStart(pid int) (time.Time, error) {
+	return time.Time{}, fmt.Errorf("process start times are not supported on this platform")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Authenticator verifies one kind of token. The enabled authenticators are
+// tried in the configured order, the first to detect the token authenticates it.
+type Authenticator interface {
+	// Method names the authentication method, as used to enable it in the config
+	Method() AuthMethod
+	// Detect reports whether the token looks like one this authenticator handles
+	Detect(token string) bool
+	// Authenticate authenticates the request and returns the grant the user was given.
+	// Errors wrap one of the sentinel errors in errors.go.
+	Authenticate(ctx context.Context, req *authRequest) (*grant, error)
+}
+
+type authRequest struct {
+	// Postgres role the user logs in as
+	User  string
+	Token string
+	// User is an ephemeral role, the grant is for the one role the token is approved for
+	Ephemeral bool
+}
+
+// the order authenticators are tried in when the config does not set one
+var defaultAuthMethods = []AuthMethod{AuthPat, AuthJwt, AuthPassword}
+
+// authenticatorFactories create the authenticator for each method that can be
+// enabled. Supporting a new kind of token only needs an entry here.
+var authenticatorFactories = map[AuthMethod]func(config *config) Authenticator{
+	AuthPat: func(config *config) Authenticator {
+		return &patAuthenticator{newAPIAuthenticator(config)}
+	},
+	AuthJwt: func(config *config) Authenticator {
+		if config.JWKSURL != "" {
+			return &jwtAuthenticator{Verifier: newJWTVerifier(config)}
+		}
+		return &jwtAuthenticator{apiAuthenticator: newAPIAuthenticator(config)}
+	},
+	AuthPassword: func(config *config) Authenticator {
+		return &passwordAuthenticator{Password: config.Password}
+	},
+}
+
+// registry is the ordered list of enabled authenticators
+type registry []Authenticator
+
+func newRegistry(config *config) (registry, error) {
+	methods := config.AuthMethods
+	if len(methods) == 0 {
+		methods = defaultAuthMethods
+	}
+	r := make(registry, 0, len(methods))
+	for _, m := range methods {
+		factory, ok := authenticatorFactories[m]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown authentication method: %s", errServiceConfig, m)
+		}
+		r = append(r, factory(config))
+	}
+	return r, nil
+}
+
+// discover returns the first authenticator that detects the token
+func (r registry) discover(token string) (Authenticator, error) {
+	for _, a := range r {
+		if a.Detect(token) {
+			return a, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no enabled authentication method accepts the token", errAuthFailed)
+}
+
+// parseAuthMethods parses the list of enabled methods, rejecting unknown and repeated methods
+func parseAuthMethods(names []string) ([]AuthMethod, error) {
+	var methods []AuthMethod
+	for _, name := range names {
+		m := AuthMethod(name)
+		if _, ok := authenticatorFactories[m]; !ok {
+			return nil, fmt.Errorf("unknown authentication method: %v", name)
+		}
+		if slices.Contains(methods, m) {
+			return nil, fmt.Errorf("authentication method listed more than once: %v", name)
+		}
+		methods = append(methods, m)
+	}
+	return methods, nil
+}
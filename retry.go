@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// retries of requests to the API when none are configured
+const (
+	defaultAPIRetries   = 2
+	defaultAPIRetryBase = 100 * time.Millisecond
+	defaultAPIRetryMax  = 2 * time.Second
+)
+
+// retryPolicy retries requests to the API that failed in a way another attempt may not
+type retryPolicy struct {
+	// attempts after the first, 0 to never retry
+	Retries int
+	// the delay before the n-th retry is drawn between 0 and Base * 2^n, up to Max.
+	// A longer Retry-After from the API is not waited for.
+	Base time.Duration
+	Max  time.Duration
+}
+
+// apiResponse is what the API answered to a request
+type apiResponse struct {
+	Status     int
+	RetryAfter string
+	Body       []byte
+}
+
+// do calls attempt until it succeeds, fails for good or the retries are used up, and returns the last outcome
+func (p retryPolicy) do(ctx context.Context, attempt func() (*apiResponse, error)) (*apiResponse, error) {
+	for n := 0; ; n++ {
+		resp, err := attempt()
+		if n >= p.Retries || !retryable(resp, err) {
+			return resp, err
+		}
+		delay, ok := p.delay(n, resp, time.Now())
+		if !ok {
+			return resp, err
+		}
+		// a login already waiting on a deadline is not held past it
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		metricsFrom(ctx).inc(metricAPIRetries)
+		sleepCtx(ctx, delay)
+		if ctx.Err() != nil {
+			return resp, err
+		}
+	}
+}
+
+// delay returns how long to wait before the n-th retry, ok is false when the API asked for more than Max
+func (p retryPolicy) delay(n int, resp *apiResponse, now time.Time) (time.Duration, bool) {
+	if resp != nil && resp.RetryAfter != "" {
+		if d, valid := parseRetryAfter(resp.RetryAfter, now); valid {
+			return d, d <= p.Max
+		}
+	}
+	// full jitter, so that backends failing together don't retry together
+	ceiling := p.Base
+	for range n {
+		if ceiling >= p.Max/2 {
+			ceiling = p.Max
+			break
+		}
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, p.Max)
+	if ceiling <= 0 {
+		return 0, true
+	}
+	return rand.N(ceiling + 1), true
+}
+
+// retryable reports whether the request may succeed when made again. The
+// request only reads the approvals, so it is safe to repeat. Timeouts are not
+// retried, another attempt would most likely time out as well.
+func retryable(resp *apiResponse, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return false
+		}
+		return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+	switch resp.Status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter parses the Retry-After header, either seconds or an HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(max(s, 0)) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry_retryable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		resp *apiResponse
+		err  error
+		want bool
+	}{
+		{"connection reset", nil, &net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{"connection refused", nil, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"closed before responding", nil, fmt.Errorf("Post: %w", io.EOF), true},
+		{"timeout", nil, &net.OpError{Op: "dial", Err: timeoutError{}}, false},
+		{"other error", nil, fmt.Errorf("tls: bad certificate"), false},
+		{"bad gateway", &apiResponse{Status: http.StatusBadGateway}, nil, true},
+		{"service unavailable", &apiResponse{Status: http.StatusServiceUnavailable}, nil, true},
+		{"gateway timeout", &apiResponse{Status: http.StatusGatewayTimeout}, nil, true},
+		{"internal server error", &apiResponse{Status: http.StatusInternalServerError}, nil, false},
+		{"not acceptable", &apiResponse{Status: http.StatusNotAcceptable}, nil, false},
+		{"ok", &apiResponse{Status: http.StatusOK}, nil, false},
+	} {
+		assert.Equal(t, tc.want, retryable(tc.resp, tc.err), tc.name)
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetry_delay(t *testing.T) {
+	now := time.Now()
+	p := retryPolicy{Retries: 5, Base: 100 * time.Millisecond, Max: 2 * time.Second}
+
+	t.Run("backs off with jitter up to max", func(t *testing.T) {
+		for n, ceiling := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond, 2 * time.Second, 2 * time.Second} {
+			for range 20 {
+				d, ok := p.delay(n, nil, now)
+				assert.True(t, ok)
+				assert.GreaterOrEqual(t, d, time.Duration(0))
+				assert.LessOrEqual(t, d, ceiling, n)
+			}
+		}
+	})
+
+	t.Run("honours retry-after in seconds", func(t *testing.T) {
+		d, ok := p.delay(0, &apiResponse{RetryAfter: "1"}, now)
+		assert.True(t, ok)
+		assert.Equal(t, time.Second, d)
+	})
+
+	t.Run("honours retry-after as a date", func(t *testing.T) {
+		d, ok := p.delay(0, &apiResponse{RetryAfter: now.Add(2 * time.Second).UTC().Format(http.TimeFormat)}, now)
+		assert.True(t, ok)
+		assert.InDelta(t, float64(2*time.Second), float64(d), float64(time.Second))
+	})
+
+	t.Run("gives up when retry-after is beyond max", func(t *testing.T) {
+		_, ok := p.delay(0, &apiResponse{RetryAfter: "60"}, now)
+		assert.False(t, ok)
+	})
+
+	t.Run("ignores a malformed retry-after", func(t *testing.T) {
+		d, ok := p.delay(0, &apiResponse{RetryAfter: "soon"}, now)
+		assert.True(t, ok)
+		assert.LessOrEqual(t, d, p.Base)
+	})
+}
+
+func TestRetry_authenticate(t *testing.T) {
+	// fails the first requests with the given status, then grants
+	flaky := func(failures int32, status int, retryAfter string) (*httptest.Server, *atomic.Int32) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) <= failures {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(status)
+				return
+			}
+			permsHandler(w, r)
+		}))
+		return server, &calls
+	}
+	retry := retryPolicy{Retries: 2, Base: time.Millisecond, Max: 10 * time.Millisecond}
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		server, calls := flaky(2, http.StatusServiceUnavailable, "")
+		defer server.Close()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none", Retry: retry})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		server, calls := flaky(5, http.StatusBadGateway, "")
+		defer server.Close()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none", Retry: retry})
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.ErrorContains(t, err, "failed with status: 502")
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("does not retry when disabled", func(t *testing.T) {
+		server, calls := flaky(1, http.StatusServiceUnavailable, "")
+		defer server.Close()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none"})
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("does not retry a refusal", func(t *testing.T) {
+		server, calls := flaky(1, http.StatusNotAcceptable, "")
+		defer server.Close()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none", Retry: retry})
+		assert.ErrorIs(t, err, errPermDenied)
+		assert.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("does not wait for a long retry-after", func(t *testing.T) {
+		server, calls := flaky(1, http.StatusServiceUnavailable, "60")
+		defer server.Close()
+		start := time.Now()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none", Retry: retry})
+		assert.ErrorIs(t, err, errAuthInfoUnavailable)
+		assert.Equal(t, int32(1), calls.Load())
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("retries a reset connection", func(t *testing.T) {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) == 1 {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				assert.NoError(t, err)
+				// an RST rather than a FIN
+				_ = conn.(*net.TCPConn).SetLinger(0)
+				_ = conn.Close()
+				return
+			}
+			permsHandler(w, r)
+		}))
+		defer server.Close()
+		err := authenticateWith(context.Background(), server.URL, httpClientConfig{Proxy: "none", Retry: retry})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), calls.Load())
+	})
+}
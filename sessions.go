@@ -0,0 +1,493 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	defaultSessionsPath   = "/run/jit-gatekeeper/sessions.json"
+	defaultReaperInterval = 30 * time.Second
+	defaultReaperUser     = "postgres"
+	defaultReaperDatabase = "postgres"
+)
+
+// sessionsConfig configures the record of who every backend logged in as, and
+// the reaper terminating the sessions that outlive their grant
+type sessionsConfig struct {
+	// record the grant of every login with the PID of its backend
+	Track bool
+	// path of the store the sessions are recorded in
+	Path string
+	// sessions are warned about when their grant expires and terminated Grace later, 0 to terminate them right away
+	Grace time.Duration
+	// time between two passes of the reaper
+	Interval time.Duration
+	// connection the reaper reads pg_stat_activity and terminates backends with
+	Conn     passwordConfig
+	User     string
+	Password string
+}
+
+func (c sessionsConfig) withDefaults() sessionsConfig {
+	if c.User == "" {
+		c.User = defaultReaperUser
+	}
+	if c.Conn.Database == "" {
+		c.Conn.Database = defaultReaperDatabase
+	}
+	if c.Interval <= 0 {
+		c.Interval = defaultReaperInterval
+	}
+	c.Conn = c.Conn.withDefaults()
+	return c
+}
+
+// sessionRecord is the grant a backend logged in with
+type sessionRecord struct {
+	PID int `json:"pid"`
+	// zero when the start time of the process is unknown
+	BackendStart time.Time  `json:"backend_start,omitzero"`
+	Role         string     `json:"role"`
+	UserId       string     `json:"user_id,omitempty"`
+	Rhost        string     `json:"rhost"`
+	Method       AuthMethod `json:"method"`
+	GrantId      string     `json:"grant_id,omitempty"`
+	// when the login was granted, the backend started before that
+	LoggedInAt time.Time `json:"logged_in_at"`
+	// zero when the grant doesn't expire
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	// set once the reaper warned that the grant expired
+	WarnedAt time.Time `json:"warned_at,omitzero"`
+}
+
+func (r *sessionRecord) String() string {
+	s := fmt.Sprintf("pid %d (%s from %s", r.PID, r.Role, r.Rhost)
+	if r.UserId != "" {
+		s += ", user " + r.UserId
+	}
+	return s + ")"
+}
+
+// gone reports whether the backend has exited, or its PID was taken by
+// another process. A backend that can't be looked up is assumed to run.
+func (r *sessionRecord) gone() bool {
+	start, err := processStart(r.PID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	return err == nil && !r.BackendStart.IsZero() && !start.Equal(r.BackendStart)
+}
+
+// sessionStore records who every backend logged in as in a store shared by every process, keyed by backend PID
+type sessionStore struct {
+	store *fileStore[map[int]*sessionRecord]
+}
+
+func newSessionStore(path string) *sessionStore {
+	return &sessionStore{store: &fileStore[map[int]*sessionRecord]{Path: path}}
+}
+
+// record remembers the grant of the login for its backend, replacing what an
+// earlier backend with the same PID left, and forgets the backends that are
+// gone. Logins without a backend are not recorded.
+func (s *sessionStore) record(req *loginRequest, g *grant, method AuthMethod, now time.Time) error {
+	if req.PID == 0 {
+		return nil
+	}
+	r := &sessionRecord{
+		PID:        req.PID,
+		Role:       g.Role,
+		UserId:     g.UserId,
+		Rhost:      req.Rhost,
+		Method:     method,
+		GrantId:    g.Id,
+		LoggedInAt: now.UTC(),
+		ExpiresAt:  g.ExpiresAt.UTC(),
+	}
+	if start, err := processStart(req.PID); err == nil {
+		r.BackendStart = start.UTC()
+	}
+	return s.store.update(func(records *map[int]*sessionRecord) error {
+		if *records == nil {
+			*records = map[int]*sessionRecord{}
+		}
+		for pid, old := range *records {
+			if old.gone() {
+				delete(*records, pid)
+			}
+		}
+		(*records)[req.PID] = r
+		return nil
+	})
+}
+
+// lookup returns the record of the backend, nil when there is none
+func (s *sessionStore) lookup(pid int) (*sessionRecord, error) {
+	var r *sessionRecord
+	err := s.store.view(func(records *map[int]*sessionRecord) error {
+		r = (*records)[pid]
+		return nil
+	})
+	return r, err
+}
+
+// backend is a client backend in pg_stat_activity
+type backend struct {
+	PID   int
+	User  string
+	Start time.Time
+}
+
+// runs reports whether the backend is the one the session was recorded for, and not a later one reusing its PID
+func (r *sessionRecord) runs(b backend) bool {
+	return b.User == r.Role && !b.Start.After(r.LoggedInAt)
+}
+
+// reapPlan is what a pass of the reaper does
+type reapPlan struct {
+	// sessions whose grant expired within the grace period
+	Warn []*sessionRecord
+	// sessions whose grant expired longer than the grace period ago
+	Terminate []*sessionRecord
+	// records of backends that are gone, or whose PID was reused
+	Stale []*sessionRecord
+}
+
+// planReap joins the recorded sessions with the backends running at now
+func planReap(records map[int]*sessionRecord, backends map[int]backend, now time.Time, grace time.Duration) *reapPlan {
+	plan := &reapPlan{}
+	for _, pid := range slices.Sorted(maps.Keys(records)) {
+		r := records[pid]
+		b, ok := backends[pid]
+		switch {
+		case !r.LoggedInAt.Before(now):
+			// logged in after the backends were listed, it may not be in the list yet
+		case !ok || !r.runs(b):
+			plan.Stale = append(plan.Stale, r)
+		case r.ExpiresAt.IsZero():
+		case !now.Before(r.ExpiresAt.Add(grace)):
+			plan.Terminate = append(plan.Terminate, r)
+		case !now.Before(r.ExpiresAt) && r.WarnedAt.IsZero():
+			plan.Warn = append(plan.Warn, r)
+		}
+	}
+	return plan
+}
+
+// reaper terminates the sessions whose grant has expired
+type reaper struct {
+	config   sessionsConfig
+	sessions *sessionStore
+	db       *sql.DB
+	// nil when the reaper is not audited
+	auditLog *auditLog
+	// only report what would be done
+	dryRun bool
+}
+
+func newReaper(cfg *config, dryRun bool) (*reaper, error) {
+	sessions := cfg.Sessions.withDefaults()
+	connector, err := pq.NewConnector(sessions.Conn.dsn(sessions.User, sessions.Password))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errServiceConfig, err)
+	}
+	r := &reaper{config: sessions, sessions: newSessionStore(sessions.Path), db: sql.OpenDB(connector), dryRun: dryRun}
+	r.sessions.store.Existing = true
+	if cfg.Audit.Path != "" {
+		r.auditLog = newAuditLog(cfg.Audit)
+	}
+	return r, nil
+}
+
+func (r *reaper) Close() error {
+	return r.db.Close()
+}
+
+// reap runs one pass of the reaper. The plan it returns only holds the sessions
+// that were terminated, those that failed are retried on the next pass.
+func (r *reaper) reap(ctx context.Context) (*reapPlan, error) {
+	now := time.Now()
+	backends, err := r.backends(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backends: %w", err)
+	}
+	var records map[int]*sessionRecord
+	if err := r.sessions.store.view(func(doc *map[int]*sessionRecord) error {
+		records = *doc
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read sessions: %w", err)
+	}
+	plan := planReap(records, backends, now, r.config.Grace)
+	if r.dryRun {
+		return plan, nil
+	}
+
+	var errs []error
+	done := map[int]*sessionRecord{}
+	for _, s := range plan.Stale {
+		done[s.PID] = s
+	}
+	terminated := plan.Terminate[:0]
+	for _, s := range plan.Terminate {
+		err := r.terminate(ctx, s)
+		r.audit("terminate", s, err, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to terminate %v: %w", s, err))
+			continue
+		}
+		terminated = append(terminated, s)
+		done[s.PID] = s
+	}
+	plan.Terminate = terminated
+	for _, s := range plan.Warn {
+		r.audit("warn", s, nil, now)
+	}
+
+	err = r.sessions.store.update(func(records *map[int]*sessionRecord) error {
+		for pid, s := range *records {
+			// a new login may have replaced the record since it was read
+			if d, ok := done[pid]; ok && d.LoggedInAt.Equal(s.LoggedInAt) {
+				delete(*records, pid)
+			}
+		}
+		for _, w := range plan.Warn {
+			if s, ok := (*records)[w.PID]; ok && w.LoggedInAt.Equal(s.LoggedInAt) {
+				s.WarnedAt = now.UTC()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to write sessions: %w", err))
+	}
+	return plan, errors.Join(errs...)
+}
+
+// backends lists the client backends by PID
+func (r *reaper) backends(ctx context.Context) (map[int]backend, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Conn.Timeout)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, "SELECT pid, usename, backend_start FROM pg_stat_activity WHERE backend_type = 'client backend' AND usename IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	backends := map[int]backend{}
+	for rows.Next() {
+		var b backend
+		if err := rows.Scan(&b.PID, &b.User, &b.Start); err != nil {
+			return nil, err
+		}
+		backends[b.PID] = b
+	}
+	return backends, rows.Err()
+}
+
+// terminate ends the backend of the session, unless its PID was reused since the backends were listed
+func (r *reaper) terminate(ctx context.Context, s *sessionRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Conn.Timeout)
+	defer cancel()
+	var terminated bool
+	err := r.db.QueryRowContext(ctx, "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE pid = $1 AND usename = $2 AND backend_start <= $3", s.PID, s.Role, s.LoggedInAt).Scan(&terminated)
+	if err == sql.ErrNoRows {
+		// gone by itself
+		return nil
+	}
+	if err == nil && !terminated {
+		err = fmt.Errorf("backend not signalled")
+	}
+	return err
+}
+
+func (r *reaper) audit(action string, s *sessionRecord, err error, now time.Time) {
+	if r.auditLog == nil {
+		return
+	}
+	if auditErr := r.auditLog.write(newAuditSessionEvent(action, s, err, now)); auditErr != nil {
+		fmt.Fprintf(os.Stderr, "failed to write audit log: %v\n", auditErr)
+	}
+}
+
+// auditSessionEvent is a line of the audit log recording what the reaper did to a session
+type auditSessionEvent struct {
+	chainLink
+	Type      string     `json:"type"`
+	Time      time.Time  `json:"time"`
+	Action    string     `json:"action"`
+	PID       int        `json:"pid"`
+	Role      string     `json:"role"`
+	Rhost     string     `json:"rhost"`
+	Method    AuthMethod `json:"method"`
+	UserId    string     `json:"user_id,omitempty"`
+	GrantId   string     `json:"grant_id,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	Error     string     `json:"error,omitempty"`
+}
+
+const sessionEventType = "session"
+
+func newAuditSessionEvent(action string, s *sessionRecord, err error, now time.Time) *auditSessionEvent {
+	ev := &auditSessionEvent{
+		Type:      sessionEventType,
+		Time:      now.UTC(),
+		Action:    action,
+		PID:       s.PID,
+		Role:      s.Role,
+		Rhost:     s.Rhost,
+		Method:    s.Method,
+		UserId:    s.UserId,
+		GrantId:   s.GrantId,
+		ExpiresAt: s.ExpiresAt,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// runReaper is gatekeeper reaper, it terminates the sessions whose grant has
+// expired every interval, or once with -once
+func runReaper(args []string) int {
+	flags := flag.NewFlagSet("reaper", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	once := flags.Bool("once", false, "run a single pass and exit")
+	dryRun := flags.Bool("dry-run", false, "list the sessions that would be terminated without terminating them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := configFromArgs([]string{"config=" + *configPath})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	if !cfg.Sessions.Track {
+		fmt.Fprintln(os.Stderr, "sessions are not tracked, set sessions.track")
+		return 1
+	}
+	r, err := newReaper(cfg, *dryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer r.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	for {
+		status := r.pass(ctx)
+		if *once {
+			return status
+		}
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-time.After(r.config.Interval):
+		}
+	}
+}
+
+// pass runs a pass of the reaper and prints what it did
+func (r *reaper) pass(ctx context.Context) int {
+	plan, err := r.reap(ctx)
+	if plan == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	prefix := ""
+	if r.dryRun {
+		prefix = "would "
+	}
+	for _, s := range plan.Terminate {
+		fmt.Printf("%sterminate %v, expired %s\n", prefix, s, s.ExpiresAt.UTC().Format(time.RFC3339))
+	}
+	for _, s := range plan.Warn {
+		fmt.Printf("%swarn %v, expired %s and terminated at %s\n", prefix, s, s.ExpiresAt.UTC().Format(time.RFC3339), s.ExpiresAt.Add(r.config.Grace).UTC().Format(time.RFC3339))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// runWhois is gatekeeper whois, it prints who the backend with the PID logged in as
+func runWhois(args []string) int {
+	flags := flag.NewFlagSet("whois", flag.ContinueOnError)
+	configPath := flags.String("config", defaultConfigPath, "path of the config file")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	pid, err := strconv.Atoi(flags.Arg(0))
+	if flags.NArg() != 1 || err != nil {
+		fmt.Fprintln(os.Stderr, "usage: gatekeeper whois [-config path] <pid>")
+		return 2
+	}
+
+	cfg, err := configFromArgs([]string{"config=" + *configPath})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		return 1
+	}
+	store := newSessionStore(cfg.Sessions.Path)
+	store.store.Existing = true
+	r, err := store.lookup(pid)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read sessions: %v\n", err)
+		return 1
+	}
+	if r == nil {
+		fmt.Fprintf(os.Stderr, "no login recorded for pid %d\n", pid)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
+		}
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	field("pid", strconv.Itoa(r.PID))
+	field("role", r.Role)
+	field("user_id", r.UserId)
+	field("method", string(r.Method))
+	field("rhost", r.Rhost)
+	field("grant_id", r.GrantId)
+	field("backend_start", formatTime(r.BackendStart))
+	field("logged_in_at", formatTime(r.LoggedInAt))
+	if r.ExpiresAt.IsZero() {
+		field("expires_at", "never")
+	} else {
+		field("expires_at", formatTime(r.ExpiresAt))
+	}
+	if r.gone() {
+		// the record outlives the backend until the next login or reaper pass
+		field("status", "exited")
+	}
+	if err := w.Flush(); err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessions_planReap(t *testing.T) {
+	loggedIn := time.Date(2025, 7, 23, 8, 0, 0, 0, time.UTC)
+	expires := loggedIn.Add(time.Hour)
+	session := func(pid int, role string, warned bool) *sessionRecord {
+		s := &sessionRecord{PID: pid, Role: role, LoggedInAt: loggedIn, ExpiresAt: expires}
+		if warned {
+			s.WarnedAt = expires
+		}
+		return s
+	}
+	records := map[int]*sessionRecord{
+		1: session(1, "postgres", false),
+		2: session(2, "postgres", false),
+		3: session(3, "postgres", false),
+		4: session(4, "postgres", false),
+		5: session(5, "postgres", true),
+		6: {PID: 6, Role: "postgres", LoggedInAt: expires.Add(time.Minute), ExpiresAt: expires},
+		// a grant that doesn't expire
+		7: {PID: 7, Role: "postgres", LoggedInAt: loggedIn},
+	}
+	backends := map[int]backend{
+		1: {PID: 1, User: "postgres", Start: loggedIn.Add(-time.Second)},
+		// the PID was reused by a later backend
+		2: {PID: 2, User: "postgres", Start: loggedIn.Add(time.Second)},
+		3: {PID: 3, User: "reader", Start: loggedIn},
+		5: {PID: 5, User: "postgres", Start: loggedIn},
+		7: {PID: 7, User: "postgres", Start: loggedIn},
+	}
+
+	plan := planReap(records, backends, expires.Add(-time.Second), 0)
+	assert.Empty(t, plan.Terminate)
+	assert.Empty(t, plan.Warn)
+	assert.Equal(t, []*sessionRecord{records[2], records[3], records[4]}, plan.Stale)
+
+	plan = planReap(records, backends, expires, 0)
+	assert.Equal(t, []*sessionRecord{records[1], records[5]}, plan.Terminate)
+	assert.Empty(t, plan.Warn)
+
+	// within the grace period sessions are warned about once
+	plan = planReap(records, backends, expires, 5*time.Minute)
+	assert.Empty(t, plan.Terminate)
+	assert.Equal(t, []*sessionRecord{records[1]}, plan.Warn)
+	// logged in after the backends were listed
+	assert.NotContains(t, plan.Stale, records[6])
+
+	plan = planReap(records, backends, expires.Add(5*time.Minute), 5*time.Minute)
+	assert.Equal(t, []*sessionRecord{records[1], records[5]}, plan.Terminate)
+	assert.Equal(t, []*sessionRecord{records[2], records[3], records[4], records[6]}, plan.Stale)
+}
+
+func TestSessions_record(t *testing.T) {
+	s := newSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	now := time.Now()
+	g := &grant{Id: "grant-1", Role: "postgres", UserId: "user-1", ExpiresAt: now.Add(time.Hour)}
+	pid, ppid := os.Getpid(), os.Getppid()
+	start, err := processStart(pid)
+	assert.NoError(t, err)
+
+	// a backend that exited long ago
+	assert.NoError(t, s.store.update(func(records *map[int]*sessionRecord) error {
+		*records = map[int]*sessionRecord{1 << 30: {PID: 1 << 30, Role: "postgres"}}
+		return nil
+	}))
+	assert.NoError(t, s.record(&loginRequest{User: "postgres", Rhost: "10.0.0.1", PID: pid}, g, AuthPat, now))
+	assert.NoError(t, s.record(&loginRequest{User: "postgres", Rhost: "10.0.0.1"}, g, AuthPat, now))
+	assert.NoError(t, s.record(&loginRequest{User: "postgres", Rhost: "[local]", PID: ppid}, &grant{Role: "postgres", Method: AuthPassword}, AuthPassword, now))
+
+	r, err := s.lookup(pid)
+	assert.NoError(t, err)
+	assert.Equal(t, &sessionRecord{PID: pid, BackendStart: start.UTC(), Role: "postgres", UserId: "user-1", Rhost: "10.0.0.1", Method: AuthPat, GrantId: "grant-1", LoggedInAt: now.UTC(), ExpiresAt: g.ExpiresAt.UTC()}, r)
+	assert.Equal(t, "pid "+strconv.Itoa(pid)+" (postgres from 10.0.0.1, user user-1)", r.String())
+	assert.False(t, r.gone())
+	r, err = s.lookup(ppid)
+	assert.NoError(t, err)
+	assert.True(t, r.ExpiresAt.IsZero())
+	r, err = s.lookup(1 << 30)
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	// a new backend with the same PID replaces the record
+	assert.NoError(t, s.record(&loginRequest{User: "reader", Rhost: "10.0.0.2", PID: pid}, &grant{Role: "reader"}, AuthJwt, now))
+	r, err = s.lookup(pid)
+	assert.NoError(t, err)
+	assert.Equal(t, "reader", r.Role)
+	// the PID was taken by another process
+	r.BackendStart = start.Add(-time.Second)
+	assert.True(t, r.gone())
+}
+
+func TestSessions_processStart(t *testing.T) {
+	start, err := processStart(os.Getpid())
+	assert.NoError(t, err)
+	// the boot time is only known to the second
+	assert.WithinDuration(t, time.Now(), start, time.Minute)
+	again, err := processStart(os.Getpid())
+	assert.NoError(t, err)
+	assert.Equal(t, start, again)
+
+	_, err = processStart(1 << 30)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestSessions_config(t *testing.T) {
+	c, err := configFromArgs([]string{"trackSessions=true", "sessionsPath=/tmp/sessions.json"})
+	assert.NoError(t, err)
+	assert.Equal(t, sessionsConfig{Track: true, Path: "/tmp/sessions.json"}, c.Sessions)
+
+	c, err = configFromArgs([]string{"config=" + writeConfig(t, `
+sessions:
+  track: true
+  grace: 5m
+  user: reaper
+  socket_dir: /var/run/postgresql
+`)})
+	assert.NoError(t, err)
+	assert.True(t, c.Sessions.Track)
+	assert.Equal(t, defaultSessionsPath, c.Sessions.Path)
+	cfg := c.Sessions.withDefaults()
+	assert.Equal(t, 5*time.Minute, cfg.Grace)
+	assert.Equal(t, defaultReaperInterval, cfg.Interval)
+	assert.Equal(t, "reaper", cfg.User)
+	assert.Equal(t, "postgres", cfg.Conn.Database)
+	assert.Equal(t, "/var/run/postgresql", cfg.Conn.SocketDir)
+
+	_, err = configFromArgs([]string{"trackSessions=maybe"})
+	assert.ErrorContains(t, err, "invalid trackSessions")
+}
+
+func TestSessions_gatekeeper(t *testing.T) {
+	api := mockServer(&UserPermissionSet{UserId: "user-1", Roles: []UserRole{{GrantId: "grant-1", Role: "postgres", ExpiresAt: apiTime{time.Now().Add(time.Hour)}}}})
+	defer api.Close()
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "trackSessions=true", "sessionsPath=" + path})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+	pat := "sbp_1112223336d4dddd54e60cfa33441499b182bbbb"
+
+	g, err := gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.1", Token: pat, PID: os.Getpid()})
+	assert.NoError(t, err)
+	_, err = gk.Authenticate(context.Background(), &loginRequest{User: "nobody", Rhost: "10.0.0.1", Token: pat, PID: os.Getppid()})
+	assert.Error(t, err)
+
+	var records map[int]*sessionRecord
+	assert.NoError(t, newSessionStore(path).store.view(func(doc *map[int]*sessionRecord) error {
+		records = *doc
+		return nil
+	}))
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "postgres", records[os.Getpid()].Role)
+		assert.Equal(t, g.UserId, records[os.Getpid()].UserId)
+		assert.Equal(t, AuthPat, records[os.Getpid()].Method)
+		assert.Equal(t, "grant-1", records[os.Getpid()].GrantId)
+		assert.True(t, g.ExpiresAt.Equal(records[os.Getpid()].ExpiresAt))
+	}
+
+	// without a database to ask nothing is reaped, and nothing is forgotten
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	cfg.Sessions.Conn = passwordConfig{Port: port, Timeout: time.Second}
+	r, err := newReaper(cfg, false)
+	assert.NoError(t, err)
+	defer r.Close()
+	plan, err := r.reap(context.Background())
+	assert.Nil(t, plan)
+	assert.ErrorContains(t, err, "failed to list backends")
+	assert.Equal(t, 1, r.pass(context.Background()))
+	assert.NoError(t, newSessionStore(path).store.view(func(doc *map[int]*sessionRecord) error {
+		assert.Len(t, *doc, 1)
+		return nil
+	}))
+}
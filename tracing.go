@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// service.name of the spans
+	tracingServiceName = "jit-gatekeeper"
+	// deadline for posting a batch of spans from gatekeeperd
+	otlpTimeout = 2 * time.Second
+	// deadline for posting the spans of a login from the PAM module, in the background of the session
+	otlpLoginTimeout = 500 * time.Millisecond
+	// how long gatekeeperd collects the spans of logins before posting them together
+	otlpBatchDelay = 5 * time.Second
+	// spans waiting for the collector beyond which those of new logins are dropped
+	otlpMaxQueue = 4096
+)
+
+// tracingConfig configures OpenTelemetry tracing of the authentication path, it is enabled when either exporter is set
+type tracingConfig struct {
+	// base URL of an OTLP/HTTP collector, such as http://localhost:4318. Spans are posted to /v1/traces.
+	Endpoint string
+	// file the spans are appended to, one OTLP JSON export request per line
+	File string
+}
+
+func (c tracingConfig) enabled() bool {
+	return c.Endpoint != "" || c.File != ""
+}
+
+type spanKind int
+
+// the values of SpanKind in OTLP
+const (
+	spanKindInternal spanKind = 1
+	spanKindClient   spanKind = 3
+)
+
+type attribute struct {
+	Key   string
+	Value any
+}
+
+func attr(key string, value any) attribute {
+	return attribute{Key: key, Value: value}
+}
+
+type spanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []attribute
+}
+
+// span is a timed operation of a trace. Methods are safe to call on a nil
+// *span, which is what startSpan returns when tracing is disabled.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     spanKind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []attribute
+	events     []spanEvent
+	err        error
+}
+
+// tracer collects the spans ended by a process until they are exported
+type tracer struct {
+	config tracingConfig
+	client *http.Client
+	log    logFunc
+
+	mu    sync.Mutex
+	spans []*span
+	// set by batch, the spans of logins then wait in queue to be posted together
+	batchDelay time.Duration
+	queue      []*span
+	dropped    int
+	// posts the next batch, nil when none is due
+	timer *time.Timer
+}
+
+func newTracer(cfg tracingConfig, log logFunc) *tracer {
+	return &tracer{config: cfg, client: &http.Client{Timeout: otlpTimeout}, log: log}
+}
+
+// batch makes the tracer post the spans of all logins ended within delay in
+// one request, for gatekeeperd which decides the logins of every backend
+func (t *tracer) batch(delay time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.batchDelay = delay
+}
+
+// withTracer stores the tracer in the context, spans started from it are collected by the tracer
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey, t)
+}
+
+// startSpan starts a span, a child of the span in ctx when there is one, and returns the context carrying it
+func startSpan(ctx context.Context, name string, attributes ...attribute) (context.Context, *span) {
+	t, _ := ctx.Value(tracerKey).(*tracer)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: spanKindInternal, start: time.Now(), attributes: attributes}
+	if parent, ok := ctx.Value(spanKey).(*span); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// startClientSpan starts a span for a request to another service
+func startClientSpan(ctx context.Context, name string, attributes ...attribute) (context.Context, *span) {
+	ctx, s := startSpan(ctx, name, attributes...)
+	if s != nil {
+		s.kind = spanKindClient
+	}
+	return ctx, s
+}
+
+func (s *span) setAttributes(attributes ...attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+func (s *span) addEvent(name string, attributes ...attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, spanEvent{Name: name, Time: time.Now(), Attributes: attributes})
+}
+
+// finish ends the span, failed when err is set, and hands it to the tracer
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.err = err
+	s.mu.Unlock()
+
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+// traceparent returns the W3C trace context header naming the span as the parent
+func (s *span) traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// clientTrace records the phases of an HTTP request as events of the span
+func (s *span) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) { s.addEvent("get_conn", attr("net.peer.name", hostPort)) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.addEvent("got_conn", attr("reused", info.Reused), attr("idle_ms", info.IdleTime.Milliseconds()))
+		},
+		DNSStart: func(info httptrace.DNSStartInfo) { s.addEvent("dns_start", attr("host", info.Host)) },
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				s.addEvent("dns_done", attr("error", info.Err.Error()))
+				return
+			}
+			s.addEvent("dns_done", attr("addresses", len(info.Addrs)))
+		},
+		ConnectStart: func(network, addr string) { s.addEvent("connect_start", attr("addr", addr)) },
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				s.addEvent("connect_done", attr("addr", addr), attr("error", err.Error()))
+				return
+			}
+			s.addEvent("connect_done", attr("addr", addr))
+		},
+		TLSHandshakeStart: func() { s.addEvent("tls_handshake_start") },
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				s.addEvent("tls_handshake_done", attr("error", err.Error()))
+				return
+			}
+			s.addEvent("tls_handshake_done", attr("tls.version", tls.VersionName(state.Version)))
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { s.addEvent("wrote_request") },
+		GotFirstResponseByte: func() { s.addEvent("first_response_byte") },
+	}
+}
+
+// flush hands the spans ended so far to the exporters. The file is written
+// right away, the collector is posted to in the background so that no login
+// waits for it.
+func (t *tracer) flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	batched := t.batchDelay > 0
+	if batched && t.config.Endpoint != "" {
+		t.enqueue(spans)
+	}
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	if t.config.Endpoint != "" && !batched {
+		// the backend goes on with the session once the login is decided and
+		// the export finishes meanwhile. Its outcome is not logged, the PAM
+		// handle may be gone by then.
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), otlpLoginTimeout)
+			defer cancel()
+			_ = t.post(ctx, data)
+		}()
+	}
+	if t.config.File != "" {
+		if err := appendLine(t.config.File, data); err != nil {
+			return fmt.Errorf("failed to write spans: %w", err)
+		}
+	}
+	return nil
+}
+
+// enqueue adds spans to the next batch, t.mu must be held
+func (t *tracer) enqueue(spans []*span) {
+	if room := otlpMaxQueue - len(t.queue); len(spans) > room {
+		t.dropped += len(spans) - room
+		spans = spans[:room]
+	}
+	t.queue = append(t.queue, spans...)
+	if len(t.queue) > 0 && t.timer == nil {
+		t.timer = time.AfterFunc(t.batchDelay, t.exportBatch)
+	}
+}
+
+// exportBatch posts the queued spans. One batch is posted at a time, spans
+// ended meanwhile are posted batchDelay after it.
+func (t *tracer) exportBatch() {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.log(syslog.LOG_WARNING, "dropped %d spans, the collector is not keeping up", dropped)
+	}
+	if len(spans) > 0 {
+		if err := t.export(spans); err != nil {
+			t.log(syslog.LOG_WARNING, "%v", err)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer = nil
+	if len(t.queue) > 0 && t.batchDelay > 0 {
+		t.timer = time.AfterFunc(t.batchDelay, t.exportBatch)
+	}
+}
+
+// close stops batching and posts the spans still queued, for gatekeeperd
+// shutting down or replacing the tracer on reload. Spans of logins ending
+// later are posted on their own.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.batchDelay = 0
+	if t.timer != nil && t.timer.Stop() {
+		t.timer = nil
+	}
+	spans := t.queue
+	t.queue = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.export(spans); err != nil {
+		t.log(syslog.LOG_WARNING, "%v", err)
+	}
+}
+
+func (t *tracer) export(spans []*span) error {
+	data, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	if err := t.post(ctx, data); err != nil {
+		return fmt.Errorf("failed to export spans: %w", err)
+	}
+	return nil
+}
+
+func (t *tracer) post(ctx context.Context, data []byte) error {
+	url := strings.TrimSuffix(t.config.Endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// appendLine appends the line with a single write, so lines of several processes don't interleave
+func appendLine(path string, line []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// The OTLP/JSON encoding of ExportTraceServiceRequest, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/trace/v1/trace_service.proto
+type (
+	otlpExportRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              spanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		// 0 unset, 1 ok, 2 error
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+func otlpRequest(spans []*span) *otlpExportRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        otlpAttributes(s.attributes),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, ev := range s.events {
+			o.Events = append(o.Events, otlpEvent{TimeUnixNano: unixNano(ev.Time), Name: ev.Name, Attributes: otlpAttributes(ev.Attributes)})
+		}
+		if s.err != nil {
+			o.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mu.Unlock()
+		out = append(out, o)
+	}
+	return &otlpExportRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes([]attribute{attr("service.name", tracingServiceName)})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: tracingServiceName}, Spans: out}},
+	}}}
+}
+
+func otlpAttributes(attributes []attribute) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, a := range attributes {
+		var value map[string]any
+		switch v := a.Value.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: value})
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSpans(t *testing.T, path string) map[string]otlpSpan {
+	f, err := os.Open(path)
+	assert.NoError(t, err)
+	defer f.Close()
+
+	spans := map[string]otlpSpan{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var req otlpExportRequest
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &req))
+		for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[s.Name] = s
+		}
+	}
+	return spans
+}
+
+func TestTracing_gatekeeper(t *testing.T) {
+	var traceparent string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		permsHandler(w, r)
+	}))
+	defer api.Close()
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	cfg, err := configFromArgs([]string{"apiUrl=" + api.URL, "tracingFile=" + path})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+
+	_, err = gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "sbp_1112223336d4dddd54e60cfa33441499b182bbbb", PID: 4242})
+	assert.NoError(t, err)
+
+	spans := readSpans(t, path)
+	root := spans["authenticate"]
+	assert.Empty(t, root.ParentSpanID)
+	assert.Equal(t, 0, root.Status.Code)
+	assert.Contains(t, root.Attributes, otlpKeyValue{Key: "db.user", Value: map[string]any{"stringValue": "postgres"}})
+	assert.Contains(t, root.Attributes, otlpKeyValue{Key: "process.pid", Value: map[string]any{"intValue": "4242"}})
+
+	for _, name := range []string{"discover", "check_method", "authenticator pat"} {
+		assert.Equal(t, root.TraceID, spans[name].TraceID, name)
+		assert.Equal(t, root.SpanID, spans[name].ParentSpanID, name)
+	}
+	request := spans["POST"]
+	assert.Equal(t, spans["authenticator pat"].SpanID, request.ParentSpanID)
+	assert.Equal(t, spanKindClient, request.Kind)
+	assert.Contains(t, request.Attributes, otlpKeyValue{Key: "http.response.status_code", Value: map[string]any{"intValue": "200"}})
+	var events []string
+	for _, ev := range request.Events {
+		events = append(events, ev.Name)
+	}
+	assert.Subset(t, events, []string{"get_conn", "connect_start", "connect_done", "wrote_request", "first_response_byte"})
+
+	// the API continues the trace
+	assert.Equal(t, "00-"+root.TraceID+"-"+request.SpanID+"-01", traceparent)
+}
+
+func TestTracing_endpoint(t *testing.T) {
+	exported := make(chan otlpExportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var req otlpExportRequest
+		assert.NoError(t, json.Unmarshal(body, &req))
+		exported <- req
+	}))
+	defer collector.Close()
+	cfg, err := configFromArgs([]string{"methods=pat", "tracingEndpoint=" + collector.URL + "/"})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+
+	_, err = gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString"})
+	assert.Error(t, err)
+
+	req := <-exported
+	assert.Equal(t, otlpKeyValue{Key: "service.name", Value: map[string]any{"stringValue": tracingServiceName}}, req.ResourceSpans[0].Resource.Attributes[0])
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	root := spans[len(spans)-1]
+	assert.Equal(t, "authenticate", root.Name)
+	assert.Equal(t, 2, root.Status.Code)
+	assert.True(t, strings.HasPrefix(root.Status.Message, "authentication failed"), root.Status.Message)
+}
+
+func TestTracing_slowCollector(t *testing.T) {
+	release := make(chan struct{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer collector.Close()
+	defer close(release)
+	cfg, err := configFromArgs([]string{"methods=pat", "tracingEndpoint=" + collector.URL})
+	assert.NoError(t, err)
+	gk, err := newGatekeeper(cfg, discardLog)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	_, err = gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString"})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), otlpLoginTimeout)
+}
+
+func TestTracing_batch(t *testing.T) {
+	exported := make(chan []otlpSpan, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpExportRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		exported <- req.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer collector.Close()
+	cfg, err := configFromArgs([]string{"methods=pat", "tracingEndpoint=" + collector.URL})
+	assert.NoError(t, err)
+	logins := func(gk *gatekeeper, n int) {
+		for range n {
+			_, err := gk.Authenticate(context.Background(), &loginRequest{User: "postgres", Rhost: "10.0.0.2", Token: "aPasswordString"})
+			assert.Error(t, err)
+		}
+	}
+	roots := func(spans []otlpSpan) int {
+		var n int
+		for _, s := range spans {
+			if s.Name == "authenticate" {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("posts the spans of several logins together", func(t *testing.T) {
+		gk, err := newGatekeeper(cfg, discardLog)
+		assert.NoError(t, err)
+		gk.tracer.batch(100 * time.Millisecond)
+		logins(gk, 3)
+		assert.Equal(t, 3, roots(<-exported))
+		assert.Empty(t, exported)
+	})
+
+	t.Run("posts the queue when closed", func(t *testing.T) {
+		gk, err := newGatekeeper(cfg, discardLog)
+		assert.NoError(t, err)
+		gk.tracer.batch(time.Hour)
+		logins(gk, 2)
+		assert.Empty(t, exported)
+		gk.close()
+		assert.Equal(t, 2, roots(<-exported))
+
+		// later logins are posted on their own
+		logins(gk, 1)
+		assert.Equal(t, 1, roots(<-exported))
+	})
+}
+
+func TestTracing_disabled(t *testing.T) {
+	ctx, sp := startSpan(context.Background(), "authenticate")
+	assert.Nil(t, sp)
+	assert.Nil(t, ctx.Value(spanKey))
+	// a nil span can be used all the same
+	sp.setAttributes(attr("db.user", "postgres"))
+	sp.finish(nil)
+}
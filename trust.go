@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// rhost Postgres reports for connections over the unix socket
+const localRhost = "[local]"
+
+// trustRule emulates a pg_hba.conf trust line, connections from Prefix are
+// let in without a token when the requested role is one of Roles
+type trustRule struct {
+	// Local matches connections over the unix socket, instead of Prefix
+	Local  bool
+	Prefix netip.Prefix
+	// globs, empty for any role
+	Roles []string
+}
+
+func (r trustRule) String() string {
+	source := r.Prefix.String()
+	if r.Local {
+		source = localRhost
+	}
+	if len(r.Roles) == 0 {
+		return source
+	}
+	return source + " roles=" + strings.Join(r.Roles, ",")
+}
+
+func (r trustRule) matches(addr netip.Addr, local bool, role string) bool {
+	if r.Local != local {
+		return false
+	}
+	if !local && !r.Prefix.Contains(addr) {
+		return false
+	}
+	return len(r.Roles) == 0 || matchRole(r.Roles, role)
+}
+
+// loopbackTrustRules are the rules trustLocal enables, the equivalent of
+//
+//	local all all trust
+//	host all all 127.0.0.1/32 trust
+//	host all all ::1/128 trust
+func loopbackTrustRules() []trustRule {
+	return []trustRule{
+		{Local: true},
+		{Prefix: netip.MustParsePrefix("127.0.0.0/8")},
+		{Prefix: netip.MustParsePrefix("::1/128")},
+	}
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, a bare address is treated as a single host
+func parseCIDRs(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", s, err)
+		}
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseRhost normalises the rhost reported by Postgres. Zone IDs are dropped
+// and IPv4-mapped IPv6 addresses are unmapped, so that ::ffff:10.0.0.1%eth0
+// matches 10.0.0.0/8. local is set for unix socket connections.
+func parseRhost(rhost string) (addr netip.Addr, local bool, err error) {
+	if rhost == localRhost {
+		return netip.Addr{}, true, nil
+	}
+	addr, err = netip.ParseAddr(strings.Trim(rhost, "[]"))
+	if err != nil {
+		return netip.Addr{}, false, fmt.Errorf("invalid rhost %q: %w", rhost, err)
+	}
+	return addr.WithZone("").Unmap(), false, nil
+}
+
+// trustedBy returns the rule that lets role in from rhost without authentication, if any
+func (c *config) trustedBy(rhost, role string) (*trustRule, bool) {
+	addr, local, err := parseRhost(rhost)
+	if err != nil {
+		// never trust what we can't parse
+		return nil, false
+	}
+	if len(c.TrustRoles) > 0 && !matchRole(c.TrustRoles, role) {
+		return nil, false
+	}
+
+	rules := c.TrustRules
+	if c.TrustLocal {
+		rules = append(loopbackTrustRules(), rules...)
+	}
+	for _, r := range rules {
+		if r.matches(addr, local, role) {
+			return &r, true
+		}
+	}
+	return nil, false
+}
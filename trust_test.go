@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrust_trustedBy(t *testing.T) {
+	t.Run("nothing is trusted by default", func(t *testing.T) {
+		c := &config{}
+		for _, rhost := range []string{"127.0.0.1", "::1", localRhost} {
+			_, ok := c.trustedBy(rhost, "postgres")
+			assert.False(t, ok, rhost)
+		}
+	})
+
+	t.Run("trustLocal trusts loopback and the unix socket", func(t *testing.T) {
+		c := &config{TrustLocal: true}
+		for _, rhost := range []string{"127.0.0.1", "127.0.0.53", "::1", "::ffff:127.0.0.1", localRhost} {
+			_, ok := c.trustedBy(rhost, "postgres")
+			assert.True(t, ok, rhost)
+		}
+		for _, rhost := range []string{"10.0.0.2", "2001:db8::1", "", "localhost"} {
+			_, ok := c.trustedBy(rhost, "postgres")
+			assert.False(t, ok, rhost)
+		}
+	})
+
+	t.Run("matches CIDRs with zones and mapped addresses normalised", func(t *testing.T) {
+		c, err := configFromArgs([]string{"trustCidrs=10.0.0.0/8,fe80::/10"})
+		assert.NoError(t, err)
+		for _, rhost := range []string{"10.1.2.3", "::ffff:10.1.2.3", "fe80::1%eth0"} {
+			_, ok := c.trustedBy(rhost, "postgres")
+			assert.True(t, ok, rhost)
+		}
+		for _, rhost := range []string{"11.0.0.1", "127.0.0.1", localRhost} {
+			_, ok := c.trustedBy(rhost, "postgres")
+			assert.False(t, ok, rhost)
+		}
+	})
+
+	t.Run("mapped IPv6 CIDR matches IPv4 rhost", func(t *testing.T) {
+		c, err := configFromArgs([]string{"trustCidrs=::ffff:192.168.0.0/112"})
+		assert.NoError(t, err)
+		rule, ok := c.trustedBy("192.168.1.1", "postgres")
+		assert.True(t, ok)
+		assert.Equal(t, "192.168.0.0/16", rule.String())
+	})
+
+	t.Run("trustRoles limits the roles a trusted connection can reach", func(t *testing.T) {
+		c, err := configFromArgs([]string{"trustLocal=true", "trustRoles=app_user,supabase_read_only_user"})
+		assert.NoError(t, err)
+		_, ok := c.trustedBy("127.0.0.1", "app_user")
+		assert.True(t, ok)
+		_, ok = c.trustedBy("127.0.0.1", "postgres")
+		assert.False(t, ok)
+	})
+
+	t.Run("roles are globs", func(t *testing.T) {
+		c, err := configFromArgs([]string{"trustLocal=true", "trustRoles=app_*"})
+		assert.NoError(t, err)
+		_, ok := c.trustedBy("[local]", "app_reporting")
+		assert.True(t, ok)
+		_, ok = c.trustedBy("[local]", "postgres")
+		assert.False(t, ok)
+
+		path := writeConfig(t, `
+trust_cidrs:
+  - cidrs: [10.0.0.0/8]
+    roles: ["readonly_*", replicator]
+`)
+		c, err = configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		_, ok = c.trustedBy("10.1.2.3", "readonly_metrics")
+		assert.True(t, ok)
+		_, ok = c.trustedBy("10.1.2.3", "replicator")
+		assert.True(t, ok)
+		_, ok = c.trustedBy("10.1.2.3", "readonly")
+		assert.False(t, ok)
+	})
+
+	t.Run("per rule roles from the config file", func(t *testing.T) {
+		path := writeConfig(t, `
+trust_cidrs:
+  - cidrs: [10.0.0.0/8, 2001:db8::/32]
+    roles: [app_user]
+  - cidrs: [192.168.1.10]
+`)
+		c, err := configFromArgs([]string{"config=" + path})
+		assert.NoError(t, err)
+		rule, ok := c.trustedBy("2001:db8::5", "app_user")
+		assert.True(t, ok)
+		assert.Equal(t, "2001:db8::/32 roles=app_user", rule.String())
+		_, ok = c.trustedBy("10.0.0.5", "postgres")
+		assert.False(t, ok)
+		_, ok = c.trustedBy("192.168.1.10", "postgres")
+		assert.True(t, ok)
+		_, ok = c.trustedBy("192.168.1.11", "postgres")
+		assert.False(t, ok)
+	})
+
+	t.Run("takes any other trustLocal value as true", func(t *testing.T) {
+		c, err := configFromArgs([]string{"trustLocal=false"})
+		assert.NoError(t, err)
+		assert.False(t, c.TrustLocal)
+		assert.Empty(t, c.Warnings)
+
+		// as it always did
+		c, err = configFromArgs([]string{"trustLocal=yes"})
+		assert.NoError(t, err)
+		assert.True(t, c.TrustLocal)
+		assert.Equal(t, []string{"trustLocal=yes is taken as trustLocal=true, set it to true or false"}, c.Warnings)
+	})
+
+	t.Run("rejects invalid options", func(t *testing.T) {
+		_, err := configFromArgs([]string{"trustCidrs=10.0.0.0/33"})
+		assert.ErrorContains(t, err, "invalid cidr")
+		_, err = configFromArgs([]string{"trustRoles=app_["})
+		assert.ErrorContains(t, err, `invalid role pattern "app_["`)
+		_, err = configFromArgs([]string{"config=" + writeConfig(t, "trust_cidrs: [{cidrs: [10.0.0.0/8], roles: ['[']}]\n")})
+		assert.ErrorContains(t, err, `invalid role pattern "["`)
+		_, err = configFromArgs([]string{"config=" + writeConfig(t, "trust_roles: ['a[']\n")})
+		assert.ErrorContains(t, err, `invalid role pattern "a["`)
+	})
+}